@@ -210,21 +210,24 @@ class ArgLoader(ContestLoader, TaskLoader, UserLoader, TeamLoader):
         if get_statement:
             primary_language = "ar"
 
-            paths = [os.path.join(self.path, name+".pdf")]
+            # CMS keeps one statement per language, so other formats of the
+            # statement are stored with the format after the language
+            paths = [
+                (primary_language, os.path.join(self.path, name+".pdf")),
+                (primary_language + ".md", os.path.join(self.path, name+".md")),
+            ]
 
-            for path in paths:
+            args["statements"] = dict()
+            for language, path in paths:
                 if os.path.exists(path):
                     digest = self.file_cacher.put_file_from_path(
                         path,
                         "Statement for task %s (lang: %s)" %
-                        (name, primary_language))
-                    break
-            else:
+                        (name, language))
+                    args["statements"][language] = Statement(language, digest)
+            if not args["statements"]:
                 logger.critical("Couldn't find any task statement, aborting.")
                 sys.exit(1)
-            args["statements"] = {
-                primary_language: Statement(primary_language, digest)
-            }
 
             if self.compat():
                 args["primary_statements"] = "[" + primary_language + "]"
@@ -254,6 +257,13 @@ class ArgLoader(ContestLoader, TaskLoader, UserLoader, TeamLoader):
                         os.path.join(self.path, "kits", filename),
                         "Attachment %s for task %s" % (filename, name))
                     args["attachments"][filename] = Attachment(filename, digest)
+        # Images used by the Markdown statement
+        if os.path.exists(os.path.join(self.path, "images")):
+            for filename in os.listdir(os.path.join(self.path, "images")):
+                digest = self.file_cacher.put_file_from_path(
+                    os.path.join(self.path, "images", filename),
+                    "Image %s for task %s" % (filename, name))
+                args["attachments"][filename] = Attachment(filename, digest)
 
         task = Task(**args)
         return task
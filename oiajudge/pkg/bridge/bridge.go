@@ -8,14 +8,40 @@ type Event struct {
 	EventId   Id
 	ObjectId  Id
 	EventType string
-	Error     error
+	// Number of times the event was handled before, and failed
+	Attempts int64
+	Error    error
 }
 
 type Bridge interface {
 	HandleEvents(ctx context.Context, handler func(context.Context, Event) error) error
 	CreateUser(ctx context.Context, username string) (Id, error)
 	GetSubmission(ctx context.Context, submission Id) (*Submission, error)
+	GetSubmissionProgress(ctx context.Context, submission Id) (*SubmissionProgress, error)
 	GetTask(ctx context.Context, task Id) (*Task, error)
-	MakeSubmission(ctx context.Context, uid Id, task_id Id, sources map[string][]byte) error
+	MakeSubmission(ctx context.Context, uid Id, task_id Id, sources map[string][]byte) (Id, error)
+	MakeUserTest(ctx context.Context, uid Id, task_id Id, sources map[string][]byte, input []byte) (Id, error)
+	// GetUserTest returns a user test with up to max_output bytes of output
+	GetUserTest(ctx context.Context, id Id, max_output int) (*UserTest, error)
+	// RejudgeSubmissions discards the results of the submissions so they are
+	// evaluated again
+	RejudgeSubmissions(ctx context.Context, ids []Id) error
 	GetAttachment(ctx context.Context, tid Id, filename string) ([]byte, error)
+	// GetSampleFile returns the whole input or output of a public testcase
+	GetSampleFile(ctx context.Context, tid Id, codename string, output bool) ([]byte, error)
+
+	GetDeadEvents(ctx context.Context, limit int64) ([]DeadEvent, error)
+	GetDeadEvent(ctx context.Context, id Id) (*DeadEvent, error)
+	// ReplayDeadEvent puts the event back in the queue with no failed attempts
+	ReplayDeadEvent(ctx context.Context, id Id) error
+	DiscardDeadEvent(ctx context.Context, id Id) error
+	GetEventStats(ctx context.Context) (*EventStats, error)
+	GetEventListenerStatus(ctx context.Context) EventListenerStatus
+	EnqueueEvent(ctx context.Context, event_type string, id Id) error
+
+	// The List methods return up to `limit` objects with id greater than
+	// `after`, ordered by id
+	ListTasks(ctx context.Context, after Id, limit int64) ([]TaskSummary, error)
+	ListSubmissions(ctx context.Context, after Id, limit int64) ([]SubmissionSummary, error)
+	ListUsers(ctx context.Context, after Id, limit int64) ([]UserSummary, error)
 }
@@ -0,0 +1,38 @@
+package bridge
+
+import "time"
+
+// DeadEvent is an event that failed on every retry. It is kept aside until an
+// admin replays or discards it.
+type DeadEvent struct {
+	Id        Id        `json:"id"`
+	EventId   Id        `json:"event_id"`
+	ObjectId  Id        `json:"object_id"`
+	EventType string    `json:"event_type"`
+	Attempts  int64     `json:"attempts"`
+	LastError string    `json:"last_error"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+type EventStats struct {
+	// Events waiting to be handled, including the ones waiting for a retry
+	Pending int64 `json:"pending"`
+	// Events being handled by some server right now
+	Claimed  int64 `json:"claimed"`
+	Retrying int64 `json:"retrying"`
+	Dead     int64 `json:"dead"`
+	// Events handled successfully
+	Processed int64 `json:"processed"`
+	// Changes that were collapsed into an event already in the queue
+	Coalesced int64 `json:"coalesced"`
+}
+
+// EventListenerStatus describes the connection used to receive the events of
+// the queue as soon as they happen
+type EventListenerStatus struct {
+	State      string    `json:"state"`
+	Listening  bool      `json:"listening"`
+	Since      time.Time `json:"since"`
+	Reconnects int64     `json:"reconnects"`
+	LastError  string    `json:"last_error,omitempty"`
+}
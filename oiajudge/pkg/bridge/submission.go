@@ -10,8 +10,23 @@ type Score struct {
 	MaxScore float64 `json:"max_score"`
 }
 
+type Verdict string
+
+const (
+	OK                    Verdict = "ok"
+	WRONG_ANSWER          Verdict = "wrong_answer"
+	PARTIAL               Verdict = "partial"
+	TIME_LIMIT_EXCEEDED   Verdict = "time_limit_exceeded"
+	MEMORY_LIMIT_EXCEEDED Verdict = "memory_limit_exceeded"
+	RUNTIME_ERROR         Verdict = "runtime_error"
+	// The program was killed by a signal not caused by the limits
+	SIGNAL        Verdict = "signal"
+	CHECKER_ERROR Verdict = "checker_error"
+)
+
 type TestcaseResult struct {
 	Testcase      string        `json:"testcase"`
+	Verdict       Verdict       `json:"verdict"`
 	Score         Score         `json:"score"`
 	ExecutionTime ExecutionTime `json:"execution_time"`
 	MemoryUsage   MemoryUsage   `json:"memory_usage"`
@@ -52,4 +67,19 @@ type Submission struct {
 	CompilationMessage string            `json:"compilation_message"`
 	Result             *SubmissionResult `json:"result"`
 	Deleted            bool              `json:"-"`
+	// Only set by the single submission endpoint, while the submission is
+	// being compiled or evaluated
+	Progress *SubmissionProgress `json:"progress,omitempty"`
+}
+
+// SubmissionProgress is how far a submission that isn't scored yet is from
+// being scored
+type SubmissionProgress struct {
+	// 1 if no submission will be evaluated before this one
+	QueuePosition      int64 `json:"queue_position"`
+	EvaluatedTestcases int64 `json:"evaluated_testcases"`
+	TotalTestcases     int64 `json:"total_testcases"`
+	// Estimated from the recent evaluation throughput. Missing if nothing was
+	// evaluated recently
+	EtaSeconds *float64 `json:"eta_seconds,omitempty"`
 }
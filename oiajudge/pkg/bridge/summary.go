@@ -0,0 +1,24 @@
+package bridge
+
+// Summaries are the fields of the CMS objects needed to detect that the
+// judge's copy is out of date, without loading the whole object
+
+type TaskSummary struct {
+	Id    Id     `json:"id"`
+	Name  string `json:"name"`
+	Title string `json:"title"`
+}
+
+type SubmissionSummary struct {
+	Id               Id               `json:"id"`
+	UserId           Id               `json:"user_id"`
+	ProblemId        Id               `json:"problem_id"`
+	SubmissionStatus SubmissionStatus `json:"submission_status"`
+	// Only meaningful when the submission is scored
+	Score float64 `json:"score"`
+}
+
+type UserSummary struct {
+	Id       Id     `json:"id"`
+	Username string `json:"username"`
+}
@@ -1,14 +1,94 @@
 package bridge
 
+// Task types of CMS that need special handling
+const (
+	TASK_TYPE_BATCH         = "Batch"
+	TASK_TYPE_OUTPUT_ONLY   = "OutputOnly"
+	TASK_TYPE_COMMUNICATION = "Communication"
+	TASK_TYPE_TWO_STEPS     = "TwoSteps"
+)
+
+// Formats of statements
+const (
+	STATEMENT_PDF      = "pdf"
+	STATEMENT_MARKDOWN = "markdown"
+	STATEMENT_HTML     = "html"
+	STATEMENT_OTHER    = "other"
+)
+
+// TaskStatement is a statement of a task in one language and format. Tasks
+// only list their statements, the content is served on its own.
+type TaskStatement struct {
+	Language    string `json:"language"`
+	Format      string `json:"format"`
+	ContentType string `json:"content_type"`
+	// Primary statements are preferred when the language doesn't matter
+	Primary bool   `json:"primary"`
+	Content []byte `json:"-"`
+}
+
+// SampleTestcase is a testcase that is public in CMS. Long inputs and
+// outputs only have their beginning, the whole files are downloaded
+// separately.
+type SampleTestcase struct {
+	Codename string `json:"codename"`
+	Input    []byte `json:"input"`
+	Output   []byte `json:"output"`
+	// Sizes of the whole files, in bytes
+	InputSize  int64 `json:"input_size"`
+	OutputSize int64 `json:"output_size"`
+	// Where to download the whole files, set only if they are truncated
+	InputUrl  string `json:"input_url,omitempty"`
+	OutputUrl string `json:"output_url,omitempty"`
+}
+
+// TaskKit is an attachment with what is needed to solve a task in a language,
+// e.g. a grader and an example solution
+type TaskKit struct {
+	// The extension of the language, e.g. cpp or java
+	Language   string `json:"language"`
+	Attachment string `json:"attachment"`
+}
+
+// TaskMetadata describes how submissions to a task are compiled and evaluated.
+// The fields that don't apply to the task type are left empty. The files
+// that must be implemented are the ones in the submission format.
+type TaskMetadata struct {
+	// How the sources are compiled: alone, with a grader of the task
+	// (Batch) or with a stub (Communication)
+	Compilation string `json:"compilation,omitempty"`
+	// Files used instead of stdin and stdout, if any
+	InputFile  string `json:"input_file,omitempty"`
+	OutputFile string `json:"output_file,omitempty"`
+	// How outputs are checked: diff or comparator
+	Evaluation string `json:"evaluation,omitempty"`
+	// Number of copies of the program that talk with the manager, and
+	// whether they use stdin and stdout or fifos (Communication)
+	Processes int    `json:"processes,omitempty"`
+	UserIo    string `json:"user_io,omitempty"`
+	// Kits of the task, sorted by language
+	Kits []TaskKit `json:"kits"`
+}
+
 type Task struct {
 	Id               Id       `json:"id"`
 	Name             string   `json:"name"`
 	Title            string   `json:"title"`
 	Tags             []string `json:"tags"`
-	Statement        []byte   `json:"-"`
 	Deleted          bool     `json:"-"`
 	MaxScore         float64  `json:"max_score"`
 	Multiplier       float64  `json:"multiplier"`
 	SubmissionFormat []string `json:"submission_format"`
 	Attachments      []string `json:"attachments"`
+	// In seconds, 0 if there is no limit
+	TimeLimit float64 `json:"time_limit"`
+	// In bytes, 0 if there is no limit
+	MemoryLimit int64 `json:"memory_limit"`
+	// The CMS task type. Submissions to OutputOnly tasks are the outputs
+	// for every testcase instead of source code
+	TaskType   string          `json:"task_type"`
+	Metadata   TaskMetadata    `json:"metadata"`
+	Statements []TaskStatement `json:"statements"`
+	// Only set when a single task is requested
+	Samples []SampleTestcase `json:"samples,omitempty"`
 }
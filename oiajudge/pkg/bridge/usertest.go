@@ -0,0 +1,31 @@
+package bridge
+
+import "time"
+
+type UserTestStatus string
+
+const (
+	USER_TEST_COMPILING          UserTestStatus = "compiling"
+	USER_TEST_COMPILATION_FAILED UserTestStatus = "compilation_failed"
+	USER_TEST_EVALUATING         UserTestStatus = "evaluating"
+	USER_TEST_EVALUATED          UserTestStatus = "evaluated"
+)
+
+// UserTest is a run of a program on an input given by the user, which isn't
+// scored
+type UserTest struct {
+	Id                 Id             `json:"id"`
+	UserId             Id             `json:"user_id"`
+	TaskId             Id             `json:"task_id"`
+	Timestamp          time.Time      `json:"timestamp"`
+	Status             UserTestStatus `json:"status"`
+	CompilationMessage string         `json:"compilation_message"`
+	// What the program printed, if it was evaluated
+	Output []byte `json:"output"`
+	// True if Output only has the beginning of the output
+	OutputTruncated bool          `json:"output_truncated"`
+	ExecutionTime   ExecutionTime `json:"execution_time"`
+	MemoryUsage     MemoryUsage   `json:"memory_usage"`
+	// Message of the sandbox, e.g. if the program timed out
+	Message string `json:"message"`
+}
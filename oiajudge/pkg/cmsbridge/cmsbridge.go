@@ -8,8 +8,11 @@ import (
 	"github.com/carlosmiguelsoto/oiajudge/pkg/utils"
 
 	"context"
+	"fmt"
 	"log"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
 type Config struct {
@@ -18,22 +21,57 @@ type Config struct {
 	CmsBridgeAddress     string
 	OiaSubmitterAddress  string
 	CmsContestId         bridge.Id
+
+	// Events that fail this many times are moved to the dead letter table
+	MaxEventAttempts int64
+	EventBackoffBase time.Duration
+	EventBackoffMax  time.Duration
+	// How often the queue is scanned for events whose backoff expired
+	EventPollInterval time.Duration
+	// Number of goroutines handling events in parallel
+	EventWorkers int64
+	// How long a claimed event is reserved for this server. If it isn't
+	// handled by then, e.g. because the server died, another one takes it
+	EventLease     time.Duration
+	EventBatchSize int64
+	// Identifies this server in the claims of the event queue
+	WorkerId string
 }
 
 type CmsBridge struct {
 	Config Config
 	Db     store.DBClient
+
+	listener   atomic.Pointer[store.Listener]
+	throughput ThroughputSampler
+	claims     ClaimSet
 }
 
 //go:embed migrations/*
 var migrations embed.FS
 
+func workerId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
 func CreateCmsBridge() (bridge.Bridge, error) {
 	ctx := context.Background()
 	config := Config{
 		DbConnectionString: os.Getenv("OIAJ_DB_CONNECTION_STRING"),
 		CmsContestId:       1,
 		CmsBridgeAddress:   os.Getenv("OIAJ_CMS_BRIDGE_ADDRESS"),
+		MaxEventAttempts:   utils.GetenvIntWithDefault("OIAJ_EVENT_MAX_ATTEMPTS", 10),
+		EventBackoffBase:   time.Millisecond * time.Duration(utils.GetenvIntWithDefault("OIAJ_EVENT_BACKOFF_BASE_MS", 1000)),
+		EventBackoffMax:    time.Millisecond * time.Duration(utils.GetenvIntWithDefault("OIAJ_EVENT_BACKOFF_MAX_MS", 10*60*1000)),
+		EventPollInterval:  time.Millisecond * time.Duration(utils.GetenvIntWithDefault("OIAJ_EVENT_POLL_INTERVAL_MS", 1000)),
+		EventWorkers:       utils.GetenvIntWithDefault("OIAJ_EVENT_WORKERS", 4),
+		EventLease:         time.Millisecond * time.Duration(utils.GetenvIntWithDefault("OIAJ_EVENT_LEASE_MS", 5*60*1000)),
+		EventBatchSize:     utils.GetenvIntWithDefault("OIAJ_EVENT_BATCH_SIZE", 100),
+		WorkerId:           workerId(),
 	}
 
 	sql, err := utils.ExtractEmbeddedFsIntoFileMap(migrations, "migrations")
@@ -2,9 +2,13 @@ package cmsbridge
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"sync"
 
 	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
 )
 
 func (b *CmsBridge) GetTask(ctx context.Context, submission bridge.Id) (res *bridge.Task, err error) {
@@ -20,12 +24,39 @@ func (b *CmsBridge) GetTask(ctx context.Context, submission bridge.Id) (res *bri
 	return
 }
 
+// HandleEvents processes events with a pool of workers. Submission events for
+// the same user and task always go to the same worker, so they are handled in
+// order. Task events, and submission events whose user and task are unknown,
+// wait for every event in flight and are handled on their own, so a task is
+// always up to date before the submissions that come after it.
 func (b *CmsBridge) HandleEvents(ctx context.Context, handler func(context.Context, bridge.Event) error) error {
-	channel, err := GetNotificationChannel(ctx, &b.Db)
+	channel, listener, err := GetNotificationChannel(ctx, &b.Db, b.Config, &b.claims)
 	if err != nil {
 		return err
 	}
+	b.listener.Store(listener)
+	go b.sampleThroughput(ctx)
+	n := b.Config.EventWorkers
+	if n <= 0 {
+		n = 1
+	}
+	var inflight sync.WaitGroup
+	workers := make([]chan bridge.Event, n)
+	for i := range workers {
+		workers[i] = make(chan bridge.Event, 64)
+		go func(events chan bridge.Event) {
+			for event := range events {
+				b.handleEvent(ctx, handler, event)
+				inflight.Done()
+			}
+		}(workers[i])
+	}
 	go func() {
+		defer func() {
+			for _, worker := range workers {
+				close(worker)
+			}
+		}()
 		for {
 			event, ok := <-channel
 			if !ok {
@@ -35,29 +66,65 @@ func (b *CmsBridge) HandleEvents(ctx context.Context, handler func(context.Conte
 				log.Printf("HandleEvents(): got error %s. Ignoring", event.Error)
 				continue
 			}
-			retries := 10
-			for i := 0; i < retries; i += 1 {
-				err := handler(ctx, event)
-				if err == nil {
-					break
-				}
-				if i < retries-1 {
-					log.Printf("HandleEvents(): got error %s. Retrying (%d/%d)", err, i+1, retries)
-				} else {
-					log.Printf("HandleEvents(): got error %s. Retried %d times. Ignoring", err, retries)
-				}
-			}
-			tx, err := b.Db.Tx(ctx)
-			if err != nil {
+			key, ok := b.eventOrderingKey(ctx, event)
+			if !ok {
+				inflight.Wait()
+				b.handleEvent(ctx, handler, event)
 				continue
 			}
-			err = DeleteNotification(*tx, event.EventId)
-			tx.Close(&err)
+			hasher := fnv.New32a()
+			hasher.Write([]byte(key))
+			inflight.Add(1)
+			workers[hasher.Sum32()%uint32(n)] <- event
 		}
 	}()
 	return nil
 }
 
+// eventOrderingKey returns the user/task pair of a submission event. It
+// returns false for task events, and for submissions that don't exist anymore.
+func (b *CmsBridge) eventOrderingKey(ctx context.Context, event bridge.Event) (key string, ok bool) {
+	if event.EventType != "submission" {
+		return
+	}
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	uid, tid, err := GetSubmissionOwner(*tx, event.ObjectId)
+	if err != nil {
+		return
+	}
+	return fmt.Sprintf("%d/%d", uid, tid), true
+}
+
+func (b *CmsBridge) handleEvent(ctx context.Context, handler func(context.Context, bridge.Event) error, event bridge.Event) {
+	// If the event can't be updated its claim expires, and it is retried
+	defer b.claims.Remove(event.EventId)
+	handler_err := handler(ctx, event)
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		log.Printf("HandleEvents(): could not update event %d: %s", event.EventId, err)
+		return
+	}
+	if handler_err == nil {
+		err = DeleteNotification(*tx, b.Config, event.EventId)
+	} else {
+		var dead bool
+		dead, err = FailNotification(*tx, b.Config, event, handler_err)
+		if dead {
+			log.Printf("HandleEvents(): got error %s. Failed %d times, moved to the dead letter table", handler_err, event.Attempts+1)
+		} else {
+			log.Printf("HandleEvents(): got error %s. Retrying later (%d/%d)", handler_err, event.Attempts+1, b.Config.MaxEventAttempts)
+		}
+	}
+	tx.Close(&err)
+	if err != nil {
+		log.Printf("HandleEvents(): could not update event %d: %s", event.EventId, err)
+	}
+}
+
 func (b *CmsBridge) CreateUser(ctx context.Context, username string) (uid bridge.Id, err error) {
 	tx, err := b.Db.Tx(ctx)
 	if err != nil {
@@ -84,6 +151,17 @@ func (b *CmsBridge) GetSubmission(ctx context.Context, submission bridge.Id) (re
 	return
 }
 
+func (b *CmsBridge) GetSubmissionProgress(ctx context.Context, submission bridge.Id) (progress *bridge.SubmissionProgress, err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	rate, rate_ok := b.throughput.Rate()
+	progress, err = GetSubmissionProgress(*tx, submission, rate, rate_ok)
+	return
+}
+
 type SubmitQuery struct {
 	Uid      bridge.Id         `json:"user_id"`
 	Task     bridge.Id         `json:"task_id"`
@@ -91,19 +169,49 @@ type SubmitQuery struct {
 	Language string            `json:"language"`
 }
 
-func (b *CmsBridge) MakeSubmission(ctx context.Context, uid bridge.Id, task_id bridge.Id, sources map[string][]byte) (err error) {
+func (b *CmsBridge) MakeSubmission(ctx context.Context, uid bridge.Id, task_id bridge.Id, sources map[string][]byte) (sid bridge.Id, err error) {
 	tx, err := b.Db.Tx(ctx)
 	if err != nil {
 		return
 	}
 	defer tx.Close(&err)
-	err = MakeSubmission(*tx, b.Config.CmsContestId, uid, task_id, sources)
+	sid, err = MakeSubmission(*tx, b.Config.CmsContestId, uid, task_id, sources)
 	if err != nil {
 		return
 	}
 	return
 }
 
+func (b *CmsBridge) MakeUserTest(ctx context.Context, uid bridge.Id, task_id bridge.Id, sources map[string][]byte, input []byte) (id bridge.Id, err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	id, err = MakeUserTest(*tx, b.Config.CmsContestId, uid, task_id, sources, input)
+	return
+}
+
+func (b *CmsBridge) GetUserTest(ctx context.Context, id bridge.Id, max_output int) (test *bridge.UserTest, err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	test, err = GetUserTest(*tx, id, max_output)
+	return
+}
+
+func (b *CmsBridge) RejudgeSubmissions(ctx context.Context, ids []bridge.Id) (err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = RejudgeSubmissions(*tx, ids)
+	return
+}
+
 func (b *CmsBridge) GetAttachment(ctx context.Context, tid bridge.Id, filename string) (attachment []byte, err error) {
 	tx, err := b.Db.Tx(ctx)
 	if err != nil {
@@ -116,3 +224,136 @@ func (b *CmsBridge) GetAttachment(ctx context.Context, tid bridge.Id, filename s
 	}
 	return
 }
+
+func (b *CmsBridge) GetSampleFile(ctx context.Context, tid bridge.Id, codename string, output bool) (content []byte, err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	content, err = GetSampleFile(*tx, tid, codename, output)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (b *CmsBridge) GetDeadEvents(ctx context.Context, limit int64) (events []bridge.DeadEvent, err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	events, err = GetDeadEvents(*tx, limit)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (b *CmsBridge) GetDeadEvent(ctx context.Context, id bridge.Id) (event *bridge.DeadEvent, err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	event, err = GetDeadEvent(*tx, id)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (b *CmsBridge) ReplayDeadEvent(ctx context.Context, id bridge.Id) (err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = ReplayDeadEvent(*tx, id)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (b *CmsBridge) DiscardDeadEvent(ctx context.Context, id bridge.Id) (err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = DiscardDeadEvent(*tx, id)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (b *CmsBridge) GetEventStats(ctx context.Context) (stats *bridge.EventStats, err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	stats, err = GetEventStats(*tx)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (b *CmsBridge) GetEventListenerStatus(ctx context.Context) bridge.EventListenerStatus {
+	listener := b.listener.Load()
+	if listener == nil {
+		return bridge.EventListenerStatus{State: string(store.ListenerStopped)}
+	}
+	status := listener.Status()
+	return bridge.EventListenerStatus{
+		State:      string(status.State),
+		Listening:  status.State == store.ListenerListening,
+		Since:      status.Since,
+		Reconnects: status.Reconnects,
+		LastError:  status.LastError,
+	}
+}
+
+func (b *CmsBridge) EnqueueEvent(ctx context.Context, event_type string, id bridge.Id) (err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = EnqueueEvent(*tx, event_type, id)
+	return
+}
+
+func (b *CmsBridge) ListTasks(ctx context.Context, after bridge.Id, limit int64) (tasks []bridge.TaskSummary, err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	tasks, err = ListTasks(*tx, after, limit)
+	return
+}
+
+func (b *CmsBridge) ListSubmissions(ctx context.Context, after bridge.Id, limit int64) (submissions []bridge.SubmissionSummary, err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	submissions, err = ListSubmissions(*tx, after, limit)
+	return
+}
+
+func (b *CmsBridge) ListUsers(ctx context.Context, after bridge.Id, limit int64) (users []bridge.UserSummary, err error) {
+	tx, err := b.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	users, err = ListUsers(*tx, b.Config, after, limit)
+	return
+}
@@ -0,0 +1,98 @@
+package cmsbridge
+
+import (
+	"database/sql"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+func ListTasks(tx store.Transaction, after bridge.Id, limit int64) (v []bridge.TaskSummary, err error) {
+	rows, err := tx.Query("SELECT id, name, title FROM tasks WHERE id > $1 ORDER BY id LIMIT $2", after, limit)
+	if err != nil {
+		return
+	}
+	v = make([]bridge.TaskSummary, 0)
+	for rows.Next() {
+		var task bridge.TaskSummary
+		err = rows.Scan(&task.Id, &task.Name, &task.Title)
+		if err != nil {
+			return
+		}
+		v = append(v, task)
+	}
+	return
+}
+
+func ListSubmissions(tx store.Transaction, after bridge.Id, limit int64) (v []bridge.SubmissionSummary, err error) {
+	rows, err := tx.Query(`
+		SELECT
+			submissions.id,
+			participations.user_id,
+			submissions.task_id,
+			compilation_outcome,
+			evaluation_outcome,
+			score_details::text,
+			score,
+			datasets.task_type
+		FROM submissions
+			INNER JOIN participations
+				ON participations.id = submissions.participation_id
+			INNER JOIN tasks
+				ON tasks.id = submissions.task_id
+			LEFT JOIN submission_results
+				ON submission_results.submission_id = submissions.id
+				AND submission_results.dataset_id = tasks.active_dataset_id
+			LEFT JOIN datasets
+				ON datasets.id = tasks.active_dataset_id
+		WHERE submissions.id > $1
+		ORDER BY submissions.id
+		LIMIT $2`, after, limit)
+	if err != nil {
+		return
+	}
+	v = make([]bridge.SubmissionSummary, 0)
+	for rows.Next() {
+		var submission bridge.SubmissionSummary
+		var compilation_outcome sql.NullString
+		var evaluation_outcome sql.NullString
+		var score_details sql.NullString
+		var score sql.NullFloat64
+		var task_type sql.NullString
+		err = rows.Scan(&submission.Id, &submission.UserId, &submission.ProblemId, &compilation_outcome, &evaluation_outcome, &score_details, &score, &task_type)
+		if err != nil {
+			return
+		}
+		submission.SubmissionStatus = submissionStatus(task_type.String, compilation_outcome, evaluation_outcome, score_details)
+		if submission.SubmissionStatus == bridge.SCORED {
+			submission.Score = score.Float64
+		}
+		v = append(v, submission)
+	}
+	return
+}
+
+// ListUsers returns the users that take part in the contest used by the judge
+func ListUsers(tx store.Transaction, config Config, after bridge.Id, limit int64) (v []bridge.UserSummary, err error) {
+	rows, err := tx.Query(`
+		SELECT users.id, users.username
+		FROM users
+			INNER JOIN participations
+				ON participations.user_id = users.id
+		WHERE participations.contest_id = $1 AND users.id > $2
+		ORDER BY users.id
+		LIMIT $3`, config.CmsContestId, after, limit)
+	if err != nil {
+		return
+	}
+	v = make([]bridge.UserSummary, 0)
+	for rows.Next() {
+		var user bridge.UserSummary
+		err = rows.Scan(&user.Id, &user.Username)
+		if err != nil {
+			return
+		}
+		v = append(v, user)
+	}
+	return
+}
@@ -0,0 +1,17 @@
+ALTER TABLE event_queue ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;;
+
+ALTER TABLE event_queue ADD COLUMN IF NOT EXISTS last_error TEXT;;
+
+-- Failed events are retried with exponential backoff
+ALTER TABLE event_queue ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now();;
+
+-- Events that failed on every retry
+CREATE TABLE IF NOT EXISTS event_dead_letter (
+    id SERIAL PRIMARY KEY,
+    event_id INTEGER NOT NULL,
+    foreign_id INTEGER NOT NULL,
+    object_type TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    last_error TEXT NOT NULL,
+    failed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)
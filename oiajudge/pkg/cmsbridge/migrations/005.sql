@@ -0,0 +1,79 @@
+-- Changes to an object that already has a pending event are collapsed into
+-- that event, counting how many were collapsed
+ALTER TABLE event_queue ADD COLUMN IF NOT EXISTS coalesced INTEGER NOT NULL DEFAULT 0;;
+
+UPDATE event_queue SET coalesced = event_queue.coalesced + duplicates.count
+FROM (
+    SELECT MIN(id) AS id, COUNT(*) - 1 AS count
+    FROM event_queue
+    WHERE seen = false
+    GROUP BY object_type, foreign_id
+    HAVING COUNT(*) > 1
+) duplicates
+WHERE event_queue.id = duplicates.id;;
+
+DELETE FROM event_queue duplicate
+USING event_queue original
+WHERE duplicate.seen = false AND original.seen = false
+    AND duplicate.object_type = original.object_type
+    AND duplicate.foreign_id = original.foreign_id
+    AND duplicate.id > original.id;;
+
+CREATE UNIQUE INDEX IF NOT EXISTS event_queue_pending
+    ON event_queue(object_type, foreign_id)
+    WHERE seen = false;;
+
+CREATE TABLE IF NOT EXISTS event_queue_stats (
+    id INTEGER PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+    processed BIGINT NOT NULL DEFAULT 0,
+    coalesced BIGINT NOT NULL DEFAULT 0
+);;
+
+INSERT INTO event_queue_stats(id) VALUES (1) ON CONFLICT DO NOTHING;;
+
+CREATE OR REPLACE FUNCTION enqueue_event(object_id INTEGER, type TEXT)
+    RETURNS VOID
+    LANGUAGE PLPGSQL AS
+$$
+BEGIN
+    INSERT INTO event_queue(foreign_id, object_type) VALUES (object_id, type)
+    ON CONFLICT (object_type, foreign_id) WHERE seen = false
+    DO UPDATE SET coalesced = event_queue.coalesced + 1;
+END;
+$$;;
+
+CREATE OR REPLACE FUNCTION register_submission_result_change()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL AS
+$$
+BEGIN
+    IF NEW.submission_id IS NOT NULL THEN
+        PERFORM enqueue_event(NEW.submission_id, 'submission');
+    END IF;
+    RETURN NEW;
+END;
+$$;;
+
+CREATE OR REPLACE FUNCTION register_submission_change()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL AS
+$$
+BEGIN
+    IF NEW.id IS NOT NULL THEN
+        PERFORM enqueue_event(NEW.id, 'submission');
+    END IF;
+    RETURN NEW;
+END;
+$$;;
+
+CREATE OR REPLACE FUNCTION register_task_change()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL AS
+$$
+BEGIN
+    IF NEW.id IS NOT NULL THEN
+        PERFORM enqueue_event(NEW.id, 'task');
+    END IF;
+    RETURN NEW;
+END;
+$$
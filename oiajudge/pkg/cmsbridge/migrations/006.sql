@@ -0,0 +1,39 @@
+-- Events are claimed by a single worker for a limited time, instead of being
+-- globally marked as seen. Events whose claim expires are handled again
+ALTER TABLE event_queue ADD COLUMN IF NOT EXISTS claimed_by TEXT;;
+
+ALTER TABLE event_queue ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ;;
+
+-- Events marked as seen were never completed, so they are released. Drop the
+-- ones that would collide with a pending event first
+DELETE FROM event_queue seen_event
+USING event_queue pending
+WHERE seen_event.seen = true AND pending.seen = false
+    AND seen_event.object_type = pending.object_type
+    AND seen_event.foreign_id = pending.foreign_id;;
+
+DELETE FROM event_queue duplicate
+USING event_queue original
+WHERE duplicate.seen = true AND original.seen = true
+    AND duplicate.object_type = original.object_type
+    AND duplicate.foreign_id = original.foreign_id
+    AND duplicate.id > original.id;;
+
+DROP INDEX IF EXISTS event_queue_pending;;
+
+ALTER TABLE event_queue DROP COLUMN seen;;
+
+CREATE UNIQUE INDEX IF NOT EXISTS event_queue_pending
+    ON event_queue(object_type, foreign_id)
+    WHERE claimed_by IS NULL;;
+
+CREATE OR REPLACE FUNCTION enqueue_event(object_id INTEGER, type TEXT)
+    RETURNS VOID
+    LANGUAGE PLPGSQL AS
+$$
+BEGIN
+    INSERT INTO event_queue(foreign_id, object_type) VALUES (object_id, type)
+    ON CONFLICT (object_type, foreign_id) WHERE claimed_by IS NULL
+    DO UPDATE SET coalesced = event_queue.coalesced + 1;
+END;
+$$
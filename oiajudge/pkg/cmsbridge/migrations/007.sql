@@ -0,0 +1,38 @@
+-- Deletions are also notified, so the judge can hide deleted tasks
+CREATE OR REPLACE FUNCTION register_submission_delete()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL AS
+$$
+BEGIN
+    PERFORM enqueue_event(OLD.id, 'submission');
+    RETURN OLD;
+END;
+$$
+
+;;
+
+CREATE OR REPLACE TRIGGER submission_delete
+    AFTER DELETE
+    ON submissions
+    FOR EACH ROW
+    EXECUTE PROCEDURE register_submission_delete();
+
+;;
+
+CREATE OR REPLACE FUNCTION register_task_delete()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL AS
+$$
+BEGIN
+    PERFORM enqueue_event(OLD.id, 'task');
+    RETURN OLD;
+END;
+$$
+
+;;
+
+CREATE OR REPLACE TRIGGER task_delete
+    AFTER DELETE
+    ON tasks
+    FOR EACH ROW
+    EXECUTE PROCEDURE register_task_delete();
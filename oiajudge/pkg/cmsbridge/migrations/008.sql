@@ -0,0 +1,45 @@
+-- Submissions are scored with the active dataset of their task, so all of
+-- them change when the active dataset does
+CREATE OR REPLACE FUNCTION register_active_dataset_change()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL AS
+$$
+BEGIN
+    PERFORM enqueue_event(submissions.id, 'submission')
+    FROM submissions
+    WHERE submissions.task_id = NEW.id;
+    RETURN NEW;
+END;
+$$
+
+;;
+
+CREATE OR REPLACE TRIGGER active_dataset_change
+    AFTER UPDATE OF active_dataset_id
+    ON tasks
+    FOR EACH ROW
+    WHEN (OLD.active_dataset_id IS DISTINCT FROM NEW.active_dataset_id)
+    EXECUTE PROCEDURE register_active_dataset_change();
+
+;;
+
+-- Changes to the active dataset, e.g. of its score type, change the task
+CREATE OR REPLACE FUNCTION register_dataset_change()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL AS
+$$
+BEGIN
+    PERFORM enqueue_event(tasks.id, 'task')
+    FROM tasks
+    WHERE tasks.active_dataset_id = NEW.id;
+    RETURN NEW;
+END;
+$$
+
+;;
+
+CREATE OR REPLACE TRIGGER dataset_change
+    AFTER UPDATE
+    ON datasets
+    FOR EACH ROW
+    EXECUTE PROCEDURE register_dataset_change();
@@ -0,0 +1,4 @@
+-- Tasks now include their limits, and testcase results their verdict
+SELECT enqueue_event(id, 'task') FROM tasks;;
+
+SELECT enqueue_event(id, 'submission') FROM submissions
@@ -0,0 +1,9 @@
+-- Tasks now include their task type, and submissions to output only tasks
+-- have no compilation phase
+SELECT enqueue_event(id, 'task') FROM tasks;;
+
+SELECT enqueue_event(submissions.id, 'submission')
+FROM submissions
+	INNER JOIN tasks ON tasks.id = submissions.task_id
+	INNER JOIN datasets ON datasets.id = tasks.active_dataset_id
+WHERE datasets.task_type = 'OutputOnly'
@@ -0,0 +1,2 @@
+-- Tasks now include their metadata and kits
+SELECT enqueue_event(id, 'task') FROM tasks
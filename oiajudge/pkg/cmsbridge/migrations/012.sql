@@ -0,0 +1,27 @@
+-- Statements are added and replaced without touching their task
+CREATE OR REPLACE FUNCTION register_statement_change()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL AS
+$$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM enqueue_event(OLD.task_id, 'task');
+        RETURN OLD;
+    END IF;
+    PERFORM enqueue_event(NEW.task_id, 'task');
+    RETURN NEW;
+END;
+$$
+
+;;
+
+CREATE OR REPLACE TRIGGER statement_change
+    AFTER INSERT OR UPDATE OR DELETE
+    ON statements
+    FOR EACH ROW
+    EXECUTE PROCEDURE register_statement_change();
+
+;;
+
+-- Tasks now include all their statements
+SELECT enqueue_event(id, 'task') FROM tasks
@@ -0,0 +1,35 @@
+-- Testcases are made public without touching their dataset
+CREATE OR REPLACE FUNCTION register_testcase_change()
+    RETURNS TRIGGER
+    LANGUAGE PLPGSQL AS
+$$
+DECLARE
+    changed_dataset_id INTEGER;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed_dataset_id := OLD.dataset_id;
+    ELSE
+        changed_dataset_id := NEW.dataset_id;
+    END IF;
+    PERFORM enqueue_event(tasks.id, 'task')
+    FROM tasks
+    WHERE tasks.active_dataset_id = changed_dataset_id;
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$
+
+;;
+
+CREATE OR REPLACE TRIGGER testcase_change
+    AFTER INSERT OR UPDATE OR DELETE
+    ON testcases
+    FOR EACH ROW
+    EXECUTE PROCEDURE register_testcase_change();
+
+;;
+
+-- Tasks now include their public testcases
+SELECT enqueue_event(id, 'task') FROM tasks
@@ -0,0 +1,153 @@
+package cmsbridge
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+const (
+	throughputSampleInterval = 10 * time.Second
+	throughputWindow         = 5 * time.Minute
+	// Submissions older than this that still aren't evaluated are assumed to
+	// be stuck, and don't count for the queue position
+	pendingSubmissionMaxAge = 24 * time.Hour
+)
+
+type throughputSample struct {
+	at time.Time
+	// Evaluation ids only grow, so the difference between two samples is
+	// the number of testcases evaluated in between
+	last_evaluation bridge.Id
+}
+
+// ThroughputSampler estimates how many testcases CMS evaluates per second
+type ThroughputSampler struct {
+	mu      sync.Mutex
+	samples []throughputSample
+}
+
+func (t *ThroughputSampler) add(sample throughputSample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.samples, sample)
+	first := 0
+	for first < len(t.samples)-1 && sample.at.Sub(t.samples[first].at) > throughputWindow {
+		first += 1
+	}
+	t.samples = t.samples[first:]
+}
+
+// Rate returns the testcases evaluated per second over the window, or false
+// if there isn't enough data
+func (t *ThroughputSampler) Rate() (float64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < 2 {
+		return 0, false
+	}
+	first := t.samples[0]
+	last := t.samples[len(t.samples)-1]
+	evaluated := last.last_evaluation - first.last_evaluation
+	seconds := last.at.Sub(first.at).Seconds()
+	if evaluated <= 0 || seconds <= 0 {
+		return 0, false
+	}
+	return float64(evaluated) / seconds, true
+}
+
+func (b *CmsBridge) sampleThroughput(ctx context.Context) {
+	ticker := time.NewTicker(throughputSampleInterval)
+	defer ticker.Stop()
+	for {
+		tx, err := b.Db.Tx(ctx)
+		if err == nil {
+			var sample throughputSample
+			sample.at = time.Now()
+			err = tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM evaluations").Scan(&sample.last_evaluation)
+			tx.Close(&err)
+			if err == nil {
+				b.throughput.add(sample)
+			}
+		}
+		if err != nil {
+			log.Printf("sampleThroughput(): %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetSubmissionProgress returns nil for submissions that are already scored
+// or failed to compile. CMS keeps its queue in memory, so the queue position
+// is approximated by the older submissions that aren't evaluated yet.
+func GetSubmissionProgress(tx store.Transaction, sid bridge.Id, rate float64, rate_ok bool) (progress *bridge.SubmissionProgress, err error) {
+	submission, err := GetSubmission(tx, sid)
+	if err != nil {
+		return
+	}
+	switch submission.SubmissionStatus {
+	case bridge.SCORED, bridge.COMPILATION_FAILED:
+		return nil, nil
+	}
+	if submission.Deleted {
+		return nil, nil
+	}
+	progress = &bridge.SubmissionProgress{}
+	row := tx.QueryRow(`
+		SELECT
+			(SELECT count(*) FROM evaluations
+				WHERE evaluations.submission_id = submissions.id
+					AND evaluations.dataset_id = tasks.active_dataset_id),
+			(SELECT count(*) FROM testcases
+				WHERE testcases.dataset_id = tasks.active_dataset_id)
+		FROM submissions
+			INNER JOIN tasks ON tasks.id = submissions.task_id
+		WHERE submissions.id = $1`, sid)
+	err = row.Scan(&progress.EvaluatedTestcases, &progress.TotalTestcases)
+	if err != nil {
+		return
+	}
+
+	var ahead int64
+	var ahead_testcases int64
+	row = tx.QueryRow(`
+		SELECT count(*), COALESCE(SUM(remaining), 0)
+		FROM (
+			SELECT
+				(SELECT count(*) FROM testcases
+					WHERE testcases.dataset_id = tasks.active_dataset_id) -
+				(SELECT count(*) FROM evaluations
+					WHERE evaluations.submission_id = submissions.id
+						AND evaluations.dataset_id = tasks.active_dataset_id) AS remaining
+			FROM submissions
+				INNER JOIN tasks ON tasks.id = submissions.task_id
+				LEFT JOIN submission_results
+					ON submission_results.submission_id = submissions.id
+					AND submission_results.dataset_id = tasks.active_dataset_id
+			WHERE submissions.id < $1
+				AND submissions.timestamp > $2
+				AND (submission_results.compilation_outcome IS NULL
+					OR (submission_results.compilation_outcome = 'ok'
+						AND submission_results.evaluation_outcome IS NULL))
+		) AS pending`, sid, time.Now().Add(-pendingSubmissionMaxAge))
+	err = row.Scan(&ahead, &ahead_testcases)
+	if err != nil {
+		return
+	}
+	progress.QueuePosition = ahead + 1
+
+	if rate_ok {
+		remaining := ahead_testcases + progress.TotalTestcases - progress.EvaluatedTestcases
+		eta := float64(remaining) / rate
+		progress.EtaSeconds = &eta
+	}
+	return
+}
@@ -0,0 +1,29 @@
+package cmsbridge
+
+import (
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+// RejudgeSubmissions invalidates the results of the submissions for the
+// active dataset of their task, the same way the CMS admin does. The
+// evaluation service finds submissions without results in its periodic
+// sweep, so they are compiled and evaluated again after a while.
+func RejudgeSubmissions(tx store.Transaction, ids []bridge.Id) (err error) {
+	for _, table := range []string{"evaluations", "executables", "submission_results"} {
+		_, err = tx.Exec(`
+			DELETE FROM `+table+` results
+			USING submissions
+				INNER JOIN tasks ON tasks.id = submissions.task_id
+			WHERE results.submission_id = submissions.id
+				AND results.dataset_id = tasks.active_dataset_id
+				AND submissions.id = ANY($1)`, ids)
+		if err != nil {
+			return
+		}
+	}
+	// Deleting the results doesn't trigger an event, but the submissions
+	// are now pending
+	_, err = tx.Exec("SELECT enqueue_event(id, 'submission') FROM submissions WHERE id = ANY($1)", ids)
+	return
+}
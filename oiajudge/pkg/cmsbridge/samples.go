@@ -0,0 +1,97 @@
+package cmsbridge
+
+import (
+	"math"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+const (
+	// Samples are shown in the task page, so only the beginning of long
+	// files is sent with the task
+	MaxSampleFileSize = 4 << 10
+	MaxSamples        = 10
+)
+
+// GetFsObjectSize returns the size of a file without reading it
+func GetFsObjectSize(tx store.Transaction, digest string) (size int64, err error) {
+	row := tx.QueryRow(`
+		SELECT COALESCE(SUM(length(pg_largeobject.data)), 0)
+		FROM fsobjects
+			INNER JOIN pg_largeobject ON fsobjects.loid = pg_largeobject.loid
+		WHERE fsobjects.digest = $1`, digest)
+	err = row.Scan(&size)
+	return
+}
+
+// GetSampleTestcases returns the public testcases of a dataset, sorted by
+// codename, with up to MaxSampleFileSize bytes of each file
+func GetSampleTestcases(tx store.Transaction, dataset_id bridge.Id) (samples []bridge.SampleTestcase, err error) {
+	rows, err := tx.Query(`
+		SELECT codename, input, output
+		FROM testcases
+		WHERE dataset_id = $1 AND public
+		ORDER BY codename
+		LIMIT $2`, dataset_id, MaxSamples)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	type digests struct {
+		input  string
+		output string
+	}
+	var files []digests
+	samples = make([]bridge.SampleTestcase, 0)
+	for rows.Next() {
+		var sample bridge.SampleTestcase
+		var d digests
+		err = rows.Scan(&sample.Codename, &d.input, &d.output)
+		if err != nil {
+			return
+		}
+		samples = append(samples, sample)
+		files = append(files, d)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for i := range samples {
+		samples[i].Input, _, err = GetFsObject(tx, files[i].input, MaxSampleFileSize)
+		if err != nil {
+			return
+		}
+		samples[i].InputSize, err = GetFsObjectSize(tx, files[i].input)
+		if err != nil {
+			return
+		}
+		samples[i].Output, _, err = GetFsObject(tx, files[i].output, MaxSampleFileSize)
+		if err != nil {
+			return
+		}
+		samples[i].OutputSize, err = GetFsObjectSize(tx, files[i].output)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// GetSampleFile returns the whole input or output of a public testcase of
+// the active dataset of a task
+func GetSampleFile(tx store.Transaction, tid bridge.Id, codename string, output bool) (content []byte, err error) {
+	row := tx.QueryRow(`
+		SELECT CASE WHEN $3 THEN testcases.output ELSE testcases.input END
+		FROM testcases
+			INNER JOIN tasks ON tasks.active_dataset_id = testcases.dataset_id
+		WHERE tasks.id = $1 AND testcases.codename = $2 AND testcases.public`,
+		tid, codename, output)
+	var digest string
+	err = row.Scan(&digest)
+	if err != nil {
+		return
+	}
+	content, _, err = GetFsObject(tx, digest, math.MaxInt)
+	return
+}
@@ -0,0 +1,192 @@
+package cmsbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+// Score types of CMS supported by the bridge
+const (
+	ScoreTypeSum            = "Sum"
+	ScoreTypeGroupMin       = "GroupMin"
+	ScoreTypeGroupMul       = "GroupMul"
+	ScoreTypeGroupThreshold = "GroupThreshold"
+)
+
+type ScoreGroup struct {
+	MaxScore  float64
+	Testcases []string
+	// Only for GroupThreshold. A testcase passes if its outcome is between 0
+	// and Threshold
+	Threshold float64
+}
+
+type ScoreType struct {
+	Name string
+	// Only for Sum
+	TestcaseScore float64
+	// Only for the Group score types
+	Groups []ScoreGroup
+}
+
+func (st ScoreType) MaxScore(testcases int) float64 {
+	if st.Name == ScoreTypeSum {
+		return st.TestcaseScore * float64(testcases)
+	}
+	max_score := float64(0)
+	for _, group := range st.Groups {
+		max_score += group.MaxScore
+	}
+	return max_score
+}
+
+// ParseScoreType parses the parameters of a score type the same way CMS does.
+// testcases are the codenames of the testcases of the dataset, sorted.
+//
+// The parameters of the Group score types are a list of
+// [max_score, testcases] or, for GroupThreshold, [max_score, testcases,
+// threshold]. testcases is either the number of testcases of the group,
+// taken in order, or a regular expression that matches the beginning of the
+// codenames of the testcases of the group. Every testcase must be in exactly
+// one group.
+func ParseScoreType(name string, parameters string, testcases []string) (st ScoreType, err error) {
+	st.Name = name
+	switch name {
+	case ScoreTypeSum:
+		st.TestcaseScore, err = strconv.ParseFloat(parameters, 64)
+		if err != nil {
+			err = fmt.Errorf("invalid parameters for %s: %s", name, parameters)
+		}
+		return
+	case ScoreTypeGroupMin, ScoreTypeGroupMul, ScoreTypeGroupThreshold:
+	default:
+		err = fmt.Errorf("unsupported score type %s", name)
+		return
+	}
+
+	var params [][]interface{}
+	err = json.Unmarshal([]byte(parameters), &params)
+	if err != nil {
+		err = fmt.Errorf("invalid parameters for %s: %s", name, parameters)
+		return
+	}
+	expected_len := 2
+	if name == ScoreTypeGroupThreshold {
+		expected_len = 3
+	}
+	next := 0
+	by_count := false
+	group_of := make(map[string]int)
+	for i, group_params := range params {
+		if len(group_params) != expected_len {
+			err = fmt.Errorf("group %d of %s should have %d parameters, has %d", i, name, expected_len, len(group_params))
+			return
+		}
+		var group ScoreGroup
+		var ok bool
+		group.MaxScore, ok = group_params[0].(float64)
+		if !ok {
+			err = fmt.Errorf("invalid max score of group %d: %v", i, group_params[0])
+			return
+		}
+		if name == ScoreTypeGroupThreshold {
+			group.Threshold, ok = group_params[2].(float64)
+			if !ok {
+				err = fmt.Errorf("invalid threshold of group %d: %v", i, group_params[2])
+				return
+			}
+		}
+		switch target := group_params[1].(type) {
+		case float64:
+			if i > 0 && !by_count {
+				err = fmt.Errorf("the testcases of every group should be either counts or regular expressions")
+				return
+			}
+			by_count = true
+			if target < 0 || target != math.Trunc(target) || next+int(target) > len(testcases) {
+				err = fmt.Errorf("invalid testcase count of group %d: %v, with %d testcases left", i, target, len(testcases)-next)
+				return
+			}
+			group.Testcases = testcases[next : next+int(target)]
+			next += int(target)
+		case string:
+			if by_count {
+				err = fmt.Errorf("the testcases of every group should be either counts or regular expressions")
+				return
+			}
+			// CMS uses Python's re.match, which only anchors the beginning
+			var re *regexp.Regexp
+			re, err = regexp.Compile("^(?:" + target + ")")
+			if err != nil {
+				err = fmt.Errorf("invalid regular expression of group %d: %s", i, err)
+				return
+			}
+			for _, testcase := range testcases {
+				if !re.MatchString(testcase) {
+					continue
+				}
+				if other, ok := group_of[testcase]; ok {
+					err = fmt.Errorf("testcase %s is in groups %d and %d", testcase, other, i)
+					return
+				}
+				group_of[testcase] = i
+				group.Testcases = append(group.Testcases, testcase)
+			}
+			if len(group.Testcases) == 0 {
+				err = fmt.Errorf("regular expression %s of group %d matches no testcases", target, i)
+				return
+			}
+		default:
+			err = fmt.Errorf("invalid testcases of group %d: %v", i, group_params[1])
+			return
+		}
+		st.Groups = append(st.Groups, group)
+	}
+	if by_count && next != len(testcases) {
+		err = fmt.Errorf("the groups of %s have %d testcases, the dataset has %d", name, next, len(testcases))
+		return
+	}
+	if !by_count {
+		for _, testcase := range testcases {
+			if _, ok := group_of[testcase]; !ok {
+				err = fmt.Errorf("testcase %s is in no group", testcase)
+				return
+			}
+		}
+	}
+	return
+}
+
+// GetDatasetTestcases returns the codenames of the testcases of a dataset,
+// sorted
+func GetDatasetTestcases(tx store.Transaction, dataset_id bridge.Id) (codenames []string, err error) {
+	rows, err := tx.Query("SELECT codename FROM testcases WHERE dataset_id = $1 ORDER BY codename", dataset_id)
+	if err != nil {
+		return
+	}
+	codenames = make([]string, 0)
+	for rows.Next() {
+		var codename string
+		err = rows.Scan(&codename)
+		if err != nil {
+			return
+		}
+		codenames = append(codenames, codename)
+	}
+	return
+}
+
+func GetDatasetScoreType(tx store.Transaction, dataset_id bridge.Id, name string, parameters string) (st ScoreType, testcases []string, err error) {
+	testcases, err = GetDatasetTestcases(tx, dataset_id)
+	if err != nil {
+		return
+	}
+	st, err = ParseScoreType(name, parameters, testcases)
+	return
+}
@@ -0,0 +1,90 @@
+package cmsbridge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseScoreType(t *testing.T) {
+	testcases := []string{"sub1_001", "sub1_002", "sub2_001", "sub2_002", "sub2_003"}
+	tests := []struct {
+		name       string
+		score_type string
+		parameters string
+		want       ScoreType
+		want_err   bool
+	}{
+		{
+			name:       "sum",
+			score_type: ScoreTypeSum,
+			parameters: "20",
+			want:       ScoreType{Name: ScoreTypeSum, TestcaseScore: 20},
+		},
+		{
+			name:       "groups by count",
+			score_type: ScoreTypeGroupMin,
+			parameters: `[[40, 2], [60, 3]]`,
+			want: ScoreType{Name: ScoreTypeGroupMin, Groups: []ScoreGroup{
+				{MaxScore: 40, Testcases: []string{"sub1_001", "sub1_002"}},
+				{MaxScore: 60, Testcases: []string{"sub2_001", "sub2_002", "sub2_003"}},
+			}},
+		},
+		{
+			name:       "groups by regex",
+			score_type: ScoreTypeGroupMul,
+			parameters: `[[40, "sub1"], [60, "sub2_.*"]]`,
+			want: ScoreType{Name: ScoreTypeGroupMul, Groups: []ScoreGroup{
+				{MaxScore: 40, Testcases: []string{"sub1_001", "sub1_002"}},
+				{MaxScore: 60, Testcases: []string{"sub2_001", "sub2_002", "sub2_003"}},
+			}},
+		},
+		{
+			// Without anchoring the alternatives, sub1_001 would match the
+			// second group too
+			name:       "regex alternatives are anchored",
+			score_type: ScoreTypeGroupMin,
+			parameters: `[[40, "sub1"], [60, "sub2|_001"]]`,
+			want: ScoreType{Name: ScoreTypeGroupMin, Groups: []ScoreGroup{
+				{MaxScore: 40, Testcases: []string{"sub1_001", "sub1_002"}},
+				{MaxScore: 60, Testcases: []string{"sub2_001", "sub2_002", "sub2_003"}},
+			}},
+		},
+		{
+			name:       "threshold",
+			score_type: ScoreTypeGroupThreshold,
+			parameters: `[[50, 2, 0.5], [50, 3, 1.0]]`,
+			want: ScoreType{Name: ScoreTypeGroupThreshold, Groups: []ScoreGroup{
+				{MaxScore: 50, Testcases: []string{"sub1_001", "sub1_002"}, Threshold: 0.5},
+				{MaxScore: 50, Testcases: []string{"sub2_001", "sub2_002", "sub2_003"}, Threshold: 1},
+			}},
+		},
+		{name: "unsupported score type", score_type: "GroupMax", parameters: `[[100, 5]]`, want_err: true},
+		{name: "invalid sum", score_type: ScoreTypeSum, parameters: "many", want_err: true},
+		{name: "invalid json", score_type: ScoreTypeGroupMin, parameters: `[[40, 2]`, want_err: true},
+		{name: "missing threshold", score_type: ScoreTypeGroupThreshold, parameters: `[[50, 2], [50, 3]]`, want_err: true},
+		{name: "invalid threshold", score_type: ScoreTypeGroupThreshold, parameters: `[[50, 2, "half"], [50, 3, 1]]`, want_err: true},
+		{name: "invalid max score", score_type: ScoreTypeGroupMin, parameters: `[["40", 2], [60, 3]]`, want_err: true},
+		{name: "fractional count", score_type: ScoreTypeGroupMin, parameters: `[[40, 2.5], [60, 2.5]]`, want_err: true},
+		{name: "counts short of the testcases", score_type: ScoreTypeGroupMin, parameters: `[[40, 2], [60, 2]]`, want_err: true},
+		{name: "counts over the testcases", score_type: ScoreTypeGroupMin, parameters: `[[40, 2], [60, 4]]`, want_err: true},
+		{name: "counts and regexes", score_type: ScoreTypeGroupMin, parameters: `[[40, 2], [60, "sub2"]]`, want_err: true},
+		{name: "invalid regex", score_type: ScoreTypeGroupMin, parameters: `[[40, "sub1("], [60, "sub2"]]`, want_err: true},
+		{name: "regex matching nothing", score_type: ScoreTypeGroupMin, parameters: `[[40, "sub1"], [60, "sub2"], [0, "sub3"]]`, want_err: true},
+		{name: "overlapping regexes", score_type: ScoreTypeGroupMin, parameters: `[[40, "sub"], [60, "sub2"]]`, want_err: true},
+		{name: "regexes missing testcases", score_type: ScoreTypeGroupMin, parameters: `[[40, "sub1"], [60, "sub2_00[12]"]]`, want_err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseScoreType(tt.score_type, tt.parameters, testcases)
+			if (err != nil) != tt.want_err {
+				t.Fatalf("ParseScoreType() error = %v, want_err %v", err, tt.want_err)
+			}
+			if tt.want_err {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseScoreType() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package cmsbridge
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+// DetectStatementFormat guesses the format of a statement from its content.
+// Text that isn't HTML is taken as Markdown, since plain text is valid
+// Markdown.
+func DetectStatementFormat(content []byte) (format string, content_type string) {
+	if bytes.HasPrefix(content, []byte("%PDF-")) {
+		return bridge.STATEMENT_PDF, "application/pdf"
+	}
+	detected := http.DetectContentType(content)
+	switch {
+	case strings.HasPrefix(detected, "text/html"):
+		return bridge.STATEMENT_HTML, "text/html; charset=utf-8"
+	case strings.HasPrefix(detected, "text/plain") && utf8.Valid(content):
+		return bridge.STATEMENT_MARKDOWN, "text/markdown; charset=utf-8"
+	}
+	return bridge.STATEMENT_OTHER, detected
+}
+
+// StatementFormatFromSuffix returns the format named after the dot in the
+// language of a statement, e.g. md in es.md
+func StatementFormatFromSuffix(suffix string) (format string, content_type string, ok bool) {
+	switch strings.ToLower(suffix) {
+	case "md":
+		return bridge.STATEMENT_MARKDOWN, "text/markdown; charset=utf-8", true
+	case "html":
+		return bridge.STATEMENT_HTML, "text/html; charset=utf-8", true
+	case "pdf":
+		return bridge.STATEMENT_PDF, "application/pdf", true
+	}
+	return "", "", false
+}
+
+// GetTaskStatements returns every statement of a task. CMS has a statement
+// per language, so more formats in the same language are uploaded with the
+// format after a dot, e.g. es and es.md. The format is taken from that
+// suffix when there is one, and guessed from the content otherwise.
+func GetTaskStatements(tx store.Transaction, tid bridge.Id) (statements []bridge.TaskStatement, err error) {
+	rows, err := tx.Query(`
+		SELECT statements.language, statements.digest, statements.language = ANY(tasks.primary_statements)
+		FROM statements
+			INNER JOIN tasks ON tasks.id = statements.task_id
+		WHERE statements.task_id = $1`, tid)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	var digests []string
+	var suffixes []string
+	statements = make([]bridge.TaskStatement, 0)
+	for rows.Next() {
+		var statement bridge.TaskStatement
+		var digest string
+		err = rows.Scan(&statement.Language, &digest, &statement.Primary)
+		if err != nil {
+			return
+		}
+		var suffix string
+		statement.Language, suffix, _ = strings.Cut(statement.Language, ".")
+		statements = append(statements, statement)
+		digests = append(digests, digest)
+		suffixes = append(suffixes, suffix)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for i := range statements {
+		statements[i].Content, _, err = GetFsObject(tx, digests[i], math.MaxInt)
+		if err != nil {
+			return
+		}
+		var ok bool
+		statements[i].Format, statements[i].ContentType, ok = StatementFormatFromSuffix(suffixes[i])
+		if !ok {
+			statements[i].Format, statements[i].ContentType = DetectStatementFormat(statements[i].Content)
+		}
+	}
+	sort.SliceStable(statements, func(i, j int) bool {
+		if statements[i].Language != statements[j].Language {
+			return statements[i].Language < statements[j].Language
+		}
+		return statements[i].Format < statements[j].Format
+	})
+	// Only one statement is kept for each language and format
+	unique := statements[:0]
+	for _, statement := range statements {
+		if len(unique) > 0 && statement.Language == unique[len(unique)-1].Language && statement.Format == unique[len(unique)-1].Format {
+			continue
+		}
+		unique = append(unique, statement)
+	}
+	statements = unique
+	return
+}
@@ -4,16 +4,54 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"log"
+	"math/rand"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
 	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+	"github.com/jackc/pgx/v5"
 )
 
-func DeleteNotification(tx store.Transaction, id bridge.Id) (err error) {
-	_, err = tx.Exec("DELETE FROM event_queue WHERE id = $1", id)
+// DeleteNotification removes a handled event from the queue. It fails if the
+// event isn't claimed by this worker anymore, since another worker may be
+// handling it.
+func DeleteNotification(tx store.Transaction, config Config, id bridge.Id) (err error) {
+	row := tx.QueryRow("DELETE FROM event_queue WHERE id = $1 AND claimed_by = $2 RETURNING coalesced", id, config.WorkerId)
+	var coalesced int64
+	err = row.Scan(&coalesced)
+	if store.IsNoRows(err) {
+		return fmt.Errorf("lost the lease of event %d", id)
+	}
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("UPDATE event_queue_stats SET processed = processed + 1, coalesced = coalesced + $1", coalesced)
+	return
+}
+
+// EnqueueEvent adds an event to the queue, unless there is already a pending
+// event for the same object
+func EnqueueEvent(tx store.Transaction, object_type string, id bridge.Id) (err error) {
+	_, err = tx.Exec("SELECT enqueue_event($1, $2)", id, object_type)
+	return
+}
+
+func GetEventStats(tx store.Transaction) (stats *bridge.EventStats, err error) {
+	stats = &bridge.EventStats{}
+	row := tx.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM event_queue),
+			(SELECT COUNT(*) FROM event_queue WHERE claimed_until >= now()),
+			(SELECT COUNT(*) FROM event_queue WHERE attempts > 0),
+			(SELECT COUNT(*) FROM event_dead_letter),
+			processed,
+			coalesced + (SELECT COALESCE(SUM(coalesced), 0) FROM event_queue)
+		FROM event_queue_stats`)
+	err = row.Scan(&stats.Pending, &stats.Claimed, &stats.Retrying, &stats.Dead, &stats.Processed, &stats.Coalesced)
 	return
 }
 
@@ -49,69 +87,314 @@ func CreateUser(config Config, tx store.Transaction, username string) (d bridge.
 	return
 }
 
-func GetNotifications(tx store.Transaction) (v []bridge.Event, err error) {
-	rows, err := tx.Query("SELECT id, foreign_id, object_type FROM event_queue WHERE seen = false")
+// ReleaseExpiredClaims drops the events whose claim expired when the same
+// object has a newer unclaimed event, which will be handled anyway.
+func ReleaseExpiredClaims(tx store.Transaction) (err error) {
+	_, err = tx.Exec(`
+		DELETE FROM event_queue stuck
+		USING event_queue pending
+		WHERE stuck.claimed_until < now() AND pending.claimed_by IS NULL
+			AND pending.object_type = stuck.object_type
+			AND pending.foreign_id = stuck.foreign_id`)
+	return
+}
+
+// GetNotifications claims up to config.EventBatchSize events for this
+// worker. Events claimed by other workers are skipped until their claim
+// expires, which happens if the worker died while handling them. Reclaiming
+// an event counts as a failed attempt, so an event that keeps crashing the
+// server ends up in the dead letter table.
+func GetNotifications(tx store.Transaction, config Config) (v []bridge.Event, err error) {
+	err = ReleaseExpiredClaims(tx)
+	if err != nil {
+		return
+	}
+	rows, err := tx.Query(`
+		WITH claimable AS (
+			SELECT id FROM event_queue
+			WHERE (claimed_by IS NULL OR claimed_until < now()) AND next_attempt_at <= now()
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE event_queue SET
+			attempts = attempts + CASE WHEN claimed_by IS NULL THEN 0 ELSE 1 END,
+			last_error = CASE WHEN claimed_by IS NULL THEN last_error ELSE 'claim by ' || claimed_by || ' expired' END,
+			claimed_by = $1,
+			claimed_until = now() + make_interval(secs => $2)
+		FROM claimable
+		WHERE event_queue.id = claimable.id
+		RETURNING event_queue.id, foreign_id, object_type, attempts`,
+		config.WorkerId, config.EventLease.Seconds(), config.EventBatchSize)
 	if err != nil {
 		return
 	}
 	for rows.Next() {
 		var event bridge.Event
-		err = rows.Scan(&event.EventId, &event.ObjectId, &event.EventType)
+		err = rows.Scan(&event.EventId, &event.ObjectId, &event.EventType, &event.Attempts)
 		if err != nil {
 			return
 		}
 		v = append(v, event)
 	}
-	_, err = tx.Exec("UPDATE event_queue SET seen = true")
-	if err != nil {
-		return
-	}
+	sort.Slice(v, func(i, j int) bool {
+		return v[i].EventId < v[j].EventId
+	})
 	return
 }
 
-func GetNotificationChannel(ctx context.Context, db *store.DBClient) (chan bridge.Event, error) {
-	events := make(chan bridge.Event)
-	notifs, err := db.ListenOn(ctx, "event_queue")
-	if err != nil {
-		return nil, err
+// RenewClaims extends the claims of events that this worker still has to
+// handle
+func RenewClaims(tx store.Transaction, config Config, ids []bridge.Id) (err error) {
+	_, err = tx.Exec(`
+		UPDATE event_queue SET claimed_until = now() + make_interval(secs => $2)
+		WHERE claimed_by = $1 AND id = ANY($3)`,
+		config.WorkerId, config.EventLease.Seconds(), ids)
+	return
+}
+
+// ClaimSet has the events claimed by this worker that weren't handled yet.
+// They may wait for a worker for longer than the lease, so their claims are
+// renewed until they are handled.
+type ClaimSet struct {
+	mu  sync.Mutex
+	ids map[bridge.Id]bool
+}
+
+func (c *ClaimSet) Add(events []bridge.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ids == nil {
+		c.ids = make(map[bridge.Id]bool)
 	}
-	push_existing_rows := func() {
+	for _, event := range events {
+		c.ids[event.EventId] = true
+	}
+}
+
+func (c *ClaimSet) Remove(id bridge.Id) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ids, id)
+}
+
+func (c *ClaimSet) Ids() []bridge.Id {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]bridge.Id, 0, len(c.ids))
+	for id := range c.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// renewClaims renews the claims in the set three times per lease, so they
+// don't expire while their events are queued
+func renewClaims(ctx context.Context, db *store.DBClient, config Config, claims *ClaimSet) {
+	ticker := time.NewTicker(config.EventLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ids := claims.Ids()
+		if len(ids) == 0 {
+			continue
+		}
 		tx, err := db.Tx(ctx)
 		if err != nil {
-			events <- bridge.Event{Error: err}
-			return
+			log.Printf("renewClaims(): %s", err)
+			continue
 		}
+		err = RenewClaims(*tx, config, ids)
+		tx.Close(&err)
+		if err != nil {
+			log.Printf("renewClaims(): %s", err)
+		}
+	}
+}
 
-		evs, err := GetNotifications(*tx)
-
-		// Always process tasks first, so submissions are processed after the
-		// associated task
-		priority := map[string]int{
-			"task":       0,
-			"submission": 1,
+// FailNotification schedules a retry of an event whose handler failed, or
+// moves it to the dead letter table once it runs out of attempts. Like
+// DeleteNotification, it fails if the event isn't claimed by this worker.
+func FailNotification(tx store.Transaction, config Config, event bridge.Event, handler_err error) (dead bool, err error) {
+	attempts := event.Attempts + 1
+	if attempts >= config.MaxEventAttempts {
+		_, err = tx.Exec(`
+			INSERT INTO event_dead_letter(event_id, foreign_id, object_type, attempts, last_error)
+			VALUES ($1, $2, $3, $4, $5)`,
+			event.EventId, event.ObjectId, event.EventType, attempts, handler_err.Error())
+		if err != nil {
+			return
 		}
-		sort.Slice(evs, func(i int, j int) bool {
-			return priority[evs[i].EventType] < priority[evs[j].EventType]
-		})
+		err = DeleteNotification(tx, config, event.EventId)
+		dead = err == nil
+		return
+	}
+	// A change that arrived while the event was being handled is already
+	// queued, and will be handled anyway
+	tag, err := tx.Exec(`
+		DELETE FROM event_queue failed
+		USING event_queue pending
+		WHERE failed.id = $1 AND failed.claimed_by = $2 AND pending.claimed_by IS NULL
+			AND pending.object_type = failed.object_type
+			AND pending.foreign_id = failed.foreign_id`,
+		event.EventId, config.WorkerId)
+	if err != nil || tag.RowsAffected() > 0 {
+		return
+	}
+	tag, err = tx.Exec(`
+		UPDATE event_queue SET
+			claimed_by = NULL, claimed_until = NULL,
+			attempts = $2, last_error = $3, next_attempt_at = now() + make_interval(secs => $4)
+		WHERE id = $1 AND claimed_by = $5`,
+		event.EventId, attempts, handler_err.Error(), EventBackoff(config, attempts).Seconds(), config.WorkerId)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = fmt.Errorf("lost the lease of event %d", event.EventId)
+	}
+	return
+}
 
-		tx.Close(&err)
+// EventBackoff is the time to wait before the next attempt of an event that
+// already failed `attempts` times. It doubles on every attempt, and half of
+// it is random so that events that failed together aren't retried together.
+func EventBackoff(config Config, attempts int64) time.Duration {
+	delay := config.EventBackoffBase
+	for i := int64(1); i < attempts && delay < config.EventBackoffMax; i += 1 {
+		delay *= 2
+	}
+	if delay > config.EventBackoffMax {
+		delay = config.EventBackoffMax
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func GetDeadEvents(tx store.Transaction, limit int64) (v []bridge.DeadEvent, err error) {
+	rows, err := tx.Query(`
+		SELECT id, event_id, foreign_id, object_type, attempts, last_error, failed_at
+		FROM event_dead_letter
+		ORDER BY failed_at DESC
+		LIMIT $1`, limit)
+	if err != nil {
+		return
+	}
+	v = make([]bridge.DeadEvent, 0)
+	for rows.Next() {
+		var event bridge.DeadEvent
+		err = rows.Scan(&event.Id, &event.EventId, &event.ObjectId, &event.EventType, &event.Attempts, &event.LastError, &event.FailedAt)
 		if err != nil {
-			events <- bridge.Event{Error: err}
 			return
 		}
-		for _, ev := range evs {
-			events <- ev
+		v = append(v, event)
+	}
+	return
+}
+
+func GetDeadEvent(tx store.Transaction, id bridge.Id) (event *bridge.DeadEvent, err error) {
+	event = &bridge.DeadEvent{}
+	row := tx.QueryRow(`
+		SELECT id, event_id, foreign_id, object_type, attempts, last_error, failed_at
+		FROM event_dead_letter
+		WHERE id = $1`, id)
+	err = row.Scan(&event.Id, &event.EventId, &event.ObjectId, &event.EventType, &event.Attempts, &event.LastError, &event.FailedAt)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func ReplayDeadEvent(tx store.Transaction, id bridge.Id) (err error) {
+	event, err := GetDeadEvent(tx, id)
+	if err != nil {
+		return
+	}
+	err = EnqueueEvent(tx, event.EventType, event.ObjectId)
+	if err != nil {
+		return
+	}
+	err = DiscardDeadEvent(tx, id)
+	return
+}
+
+// DiscardDeadEvent returns pgx.ErrNoRows if there is no such event, like
+// GetDeadEvent
+func DiscardDeadEvent(tx store.Transaction, id bridge.Id) (err error) {
+	tag, err := tx.Exec("DELETE FROM event_dead_letter WHERE id = $1", id)
+	if err != nil {
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		err = pgx.ErrNoRows
+	}
+	return
+}
+
+// GetNotificationChannel claims events whenever the queue notifies a change,
+// when the listener reconnects, and periodically. Claimed events are added to
+// claims, and should be removed once they are handled.
+func GetNotificationChannel(ctx context.Context, db *store.DBClient, config Config, claims *ClaimSet) (chan bridge.Event, *store.Listener, error) {
+	events := make(chan bridge.Event)
+	listener, err := db.ListenOn(ctx, "event_queue")
+	if err != nil {
+		return nil, nil, err
+	}
+	// Claims events in batches until there are none left to claim. Events
+	// can wait in the queue of a worker for longer than the lease, so the
+	// claims are renewed until they are handled. Otherwise they would be
+	// claimed again and handled twice.
+	push_existing_rows := func() {
+		for {
+			tx, err := db.Tx(ctx)
+			if err != nil {
+				events <- bridge.Event{Error: err}
+				return
+			}
+
+			evs, err := GetNotifications(*tx, config)
+
+			// Always process tasks first, so submissions are processed after the
+			// associated task
+			priority := map[string]int{
+				"task":       0,
+				"submission": 1,
+			}
+			sort.SliceStable(evs, func(i int, j int) bool {
+				return priority[evs[i].EventType] < priority[evs[j].EventType]
+			})
+
+			tx.Close(&err)
+			if err != nil {
+				events <- bridge.Event{Error: err}
+				return
+			}
+			claims.Add(evs)
+			for _, ev := range evs {
+				events <- ev
+			}
+			if int64(len(evs)) < config.EventBatchSize {
+				return
+			}
 		}
 	}
+	go renewClaims(ctx, db, config, claims)
 	go func() {
+		// Failed events don't produce a notification when their backoff
+		// expires, so the queue is also polled
+		ticker := time.NewTicker(config.EventPollInterval)
+		defer ticker.Stop()
 		push_existing_rows()
 		for {
-			_, ok := <-notifs
-			if !ok {
-				break
+			select {
+			case _, ok := <-listener.Notifications:
+				if !ok {
+					return
+				}
+			case <-ticker.C:
 			}
 			push_existing_rows()
 		}
 	}()
-	return events, nil
+	return events, listener, nil
 }
@@ -6,9 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
@@ -17,30 +15,50 @@ import (
 	"github.com/jackc/pgx/v5"
 )
 
+// The only language the bridge submits in
+const (
+	Language          = "C++11 / g++"
+	LanguageExtension = ".cpp"
+)
+
 func GetSubmission(tx store.Transaction, id bridge.Id) (submission *bridge.Submission, err error) {
 	submission = &bridge.Submission{Id: id}
 	row := tx.QueryRow(`
 	SELECT
-		task_id,
-		user_id,
-		timestamp,
+		submissions.task_id,
+		participations.user_id,
+		submissions.timestamp,
 		compilation_outcome,
 		compilation_stderr,
 		evaluation_outcome,
-		score,
-		score_details
+		score_details,
+		tasks.active_dataset_id,
+		datasets.score_type,
+		datasets.score_type_parameters,
+		datasets.time_limit,
+		datasets.memory_limit,
+		datasets.task_type
 	FROM submissions
 		INNER JOIN participations
 			ON participations.id = submissions.participation_id
+		INNER JOIN tasks
+			ON tasks.id = submissions.task_id
+		LEFT JOIN datasets
+			ON datasets.id = tasks.active_dataset_id
 		LEFT JOIN submission_results
 			ON submission_results.submission_id = submissions.id
+			AND submission_results.dataset_id = tasks.active_dataset_id
 		WHERE submissions.id = $1
 `, id)
 	var compilation_outcome sql.NullString
 	var compilation_stderr sql.NullString
 	var evaluation_outcome sql.NullString
-	var score sql.NullFloat64
 	var score_details sql.NullString
+	var dataset_id sql.NullInt64
+	var score_type sql.NullString
+	var score_type_parameters sql.NullString
+	var limits DatasetLimits
+	var task_type sql.NullString
 	err = row.Scan(
 		&submission.ProblemId,
 		&submission.UserId,
@@ -48,8 +66,13 @@ func GetSubmission(tx store.Transaction, id bridge.Id) (submission *bridge.Submi
 		&compilation_outcome,
 		&compilation_stderr,
 		&evaluation_outcome,
-		&score,
-		&score_details)
+		&score_details,
+		&dataset_id,
+		&score_type,
+		&score_type_parameters,
+		&limits.TimeLimit,
+		&limits.MemoryLimit,
+		&task_type)
 	if store.IsNoRows(err) {
 		submission.Deleted = true
 		return
@@ -57,48 +80,68 @@ func GetSubmission(tx store.Transaction, id bridge.Id) (submission *bridge.Submi
 	if err != nil {
 		return
 	}
+	if !dataset_id.Valid {
+		err = fmt.Errorf("task %d has no active dataset", submission.ProblemId)
+		return
+	}
+
+	submission.SubmissionStatus = submissionStatus(task_type.String, compilation_outcome, evaluation_outcome, score_details)
+	if submission.SubmissionStatus != bridge.COMPILING {
+		submission.CompilationMessage = compilation_stderr.String
+	}
+	if submission.SubmissionStatus != bridge.SCORED {
+		return
+	}
+	submission.Result = &bridge.SubmissionResult{}
 
-	row = tx.QueryRow(`
-			SELECT score_type, score_type_parameters
-			FROM tasks
-				INNER JOIN datasets ON tasks.id = datasets.task_id
-			WHERE tasks.id = $1`,
-		submission.ProblemId)
-	var score_type string
-	var score_type_parameters string
-	err = row.Scan(&score_type, &score_type_parameters)
+	st, _, err := GetDatasetScoreType(tx, dataset_id.Int64, score_type.String, score_type_parameters.String)
+	if err != nil {
+		err = fmt.Errorf("submission %d: %s", id, err)
+		return
+	}
+	err = FillTestcaseResults(tx, dataset_id.Int64, limits, submission)
 	if err != nil {
 		return
 	}
+	switch st.Name {
+	case ScoreTypeSum:
+		err = FillSubmissionResultsScoreTypeSum(st, submission)
+	default:
+		err = FillSubmissionResultsScoreTypeGrouped(st, score_details.String, submission)
+	}
+	return
+}
 
+func submissionStatus(task_type string, compilation_outcome, evaluation_outcome, score_details sql.NullString) bridge.SubmissionStatus {
 	if !compilation_outcome.Valid {
-		submission.SubmissionStatus = bridge.COMPILING
-		return
+		// CMS still runs a trivial compilation for outputs, but there is
+		// nothing to compile as far as the user is concerned
+		if task_type == bridge.TASK_TYPE_OUTPUT_ONLY {
+			return bridge.EVALUATING
+		}
+		return bridge.COMPILING
 	}
-	submission.CompilationMessage = compilation_stderr.String
 	if compilation_outcome.String == "fail" {
-		submission.SubmissionStatus = bridge.COMPILATION_FAILED
-		return
+		return bridge.COMPILATION_FAILED
 	}
 	if !evaluation_outcome.Valid {
-		submission.SubmissionStatus = bridge.EVALUATING
-		return
+		return bridge.EVALUATING
 	}
 	if !score_details.Valid || score_details.String == "null" {
-		submission.SubmissionStatus = bridge.SCORING
-		return
+		return bridge.SCORING
 	}
-	submission.SubmissionStatus = bridge.SCORED
-	submission.Result = &bridge.SubmissionResult{}
-
-	FillTestcaseResults(tx, submission)
+	return bridge.SCORED
+}
 
-	switch score_type {
-	case "Sum":
-		FillSubmissionResultsScoreTypeSum(tx, score_details.String, score_type_parameters, submission)
-	default:
-		FillSubmissionResultsScoreTypeGrouped(tx, score_details.String, score_type_parameters, submission)
-	}
+// GetSubmissionOwner returns the user and task of a submission
+func GetSubmissionOwner(tx store.Transaction, id bridge.Id) (uid bridge.Id, tid bridge.Id, err error) {
+	row := tx.QueryRow(`
+		SELECT participations.user_id, submissions.task_id
+		FROM submissions
+			INNER JOIN participations
+				ON participations.id = submissions.participation_id
+		WHERE submissions.id = $1`, id)
+	err = row.Scan(&uid, &tid)
 	return
 }
 
@@ -106,29 +149,27 @@ type Testcase struct {
 	Idx string `json:"idx"`
 }
 
-func FillSubmissionResultsScoreTypeSum(tx store.Transaction, score_details string, score_type_parameters string, submission *bridge.Submission) (err error) {
-	multiplier, err := strconv.ParseFloat(score_type_parameters, 64)
-	if err != nil {
-		return
-	}
+func FillSubmissionResultsScoreTypeSum(st ScoreType, submission *bridge.Submission) (err error) {
 	submission.Result.Score.MaxScore = float64(0)
 	submission.Result.Score.Score = float64(0)
 	for i, t := range submission.Result.Testcases {
 		submission.Result.Subtasks = append(submission.Result.Subtasks, bridge.SubtaskResult{
 			Subtask: int64(i),
 			Score: bridge.Score{
-				t.Score.Score * multiplier,
-				t.Score.MaxScore * multiplier,
+				Score:    t.Score.Score * st.TestcaseScore,
+				MaxScore: t.Score.MaxScore * st.TestcaseScore,
 			},
 			Testcases: []string{t.Testcase},
 		})
-		submission.Result.Score.MaxScore += t.Score.MaxScore * multiplier
-		submission.Result.Score.Score += t.Score.Score * multiplier
+		submission.Result.Score.MaxScore += t.Score.MaxScore * st.TestcaseScore
+		submission.Result.Score.Score += t.Score.Score * st.TestcaseScore
 	}
 	return
 }
 
-func FillSubmissionResultsScoreTypeGrouped(tx store.Transaction, score_details string, score_type_parameters string, submission *bridge.Submission) (err error) {
+// FillSubmissionResultsScoreTypeGrouped takes the subtask scores computed by
+// CMS, which have the same format for every Group score type
+func FillSubmissionResultsScoreTypeGrouped(st ScoreType, score_details string, submission *bridge.Submission) (err error) {
 	type Submission struct {
 		Idx           int64   `json:"idx"`
 		MaxScore      float64 `json:"max_score"`
@@ -136,8 +177,11 @@ func FillSubmissionResultsScoreTypeGrouped(tx store.Transaction, score_details s
 		Testcases     []Testcase
 	}
 	var sub []Submission
-	log.Printf("UNMARSHALLING: %s", score_details)
-	json.Unmarshal([]byte(score_details), &sub)
+	err = json.Unmarshal([]byte(score_details), &sub)
+	if err != nil {
+		err = fmt.Errorf("invalid score details of submission %d: %s", submission.Id, err)
+		return
+	}
 	submission.Result.Score.MaxScore = float64(0)
 	submission.Result.Score.Score = float64(0)
 	for _, s := range sub {
@@ -156,10 +200,36 @@ func FillSubmissionResultsScoreTypeGrouped(tx store.Transaction, score_details s
 			Testcases: ts,
 		})
 	}
+
+	if st.Name == ScoreTypeGroupThreshold {
+		// The outcome of the testcases isn't a score but a value compared
+		// with the threshold of the group, so it is replaced by whether the
+		// testcase passed
+		threshold := make(map[string]float64)
+		for _, group := range st.Groups {
+			for _, testcase := range group.Testcases {
+				threshold[testcase] = group.Threshold
+			}
+		}
+		for i, t := range submission.Result.Testcases {
+			passed := t.Score.Score >= 0 && t.Score.Score <= threshold[t.Testcase]
+			submission.Result.Testcases[i].Score.Score = 0
+			if passed {
+				submission.Result.Testcases[i].Score.Score = 1
+			}
+			switch t.Verdict {
+			case bridge.OK, bridge.WRONG_ANSWER, bridge.PARTIAL:
+				submission.Result.Testcases[i].Verdict = bridge.WRONG_ANSWER
+				if passed {
+					submission.Result.Testcases[i].Verdict = bridge.OK
+				}
+			}
+		}
+	}
 	return
 }
 
-func FillTestcaseResults(tx store.Transaction, submission *bridge.Submission) (err error) {
+func FillTestcaseResults(tx store.Transaction, dataset_id bridge.Id, limits DatasetLimits, submission *bridge.Submission) (err error) {
 	rows, err := tx.Query(`
 	SELECT
 		outcome,
@@ -170,8 +240,8 @@ func FillTestcaseResults(tx store.Transaction, submission *bridge.Submission) (e
 	FROM evaluations
 		INNER JOIN testcases
 			ON evaluations.testcase_id = testcases.id
-		WHERE submission_id = $1
-`, submission.Id)
+		WHERE submission_id = $1 AND evaluations.dataset_id = $2
+`, submission.Id, dataset_id)
 	if err != nil {
 		return
 	}
@@ -186,12 +256,14 @@ func FillTestcaseResults(tx store.Transaction, submission *bridge.Submission) (e
 			return
 		}
 		outcome, err := parseOutcome(outcome_str)
+		verdict := TestcaseVerdict(outcome, err == nil, messages, execution_time, memory_usage, limits)
 		if err != nil {
 			messages = []string{err.Error()}
 		}
 		message := strings.Join(messages, "\n")
 		submission.Result.Testcases = append(submission.Result.Testcases, bridge.TestcaseResult{
 			Testcase: codename.String,
+			Verdict:  verdict,
 			Message:  message,
 			Score: bridge.Score{
 				MaxScore: 1.0,
@@ -248,8 +320,57 @@ func AddFsObject(tx store.Transaction, content []byte, description string) (stri
 	return digest, nil
 }
 
-func MakeSubmission(tx store.Transaction, cid bridge.Id, uid bridge.Id, task_id bridge.Id, sources map[string][]byte) (err error) {
-	language := "C++11 / g++"
+// GetFsObject reads up to max_size bytes of a file stored by CMS
+func GetFsObject(tx store.Transaction, digest string, max_size int) (content []byte, truncated bool, err error) {
+	rows, err := tx.Query(`
+			SELECT pg_largeobject.data
+					FROM fsobjects
+					INNER JOIN pg_largeobject ON fsobjects.loid = pg_largeobject.loid
+					WHERE fsobjects.digest = $1
+					ORDER BY pg_largeobject.pageno ASC;`,
+		digest)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var page []byte
+		err = rows.Scan(&page)
+		if err != nil {
+			return
+		}
+		content = append(content, page...)
+		if len(content) > max_size {
+			return content[:max_size], true, nil
+		}
+	}
+	return
+}
+
+// submissionLanguage is the CMS language of the submissions to a task, which
+// is NULL for output only tasks since there is nothing to compile
+func submissionLanguage(tx store.Transaction, task_id bridge.Id) (language sql.NullString, err error) {
+	var task_type string
+	row := tx.QueryRow(`
+		SELECT datasets.task_type
+		FROM tasks
+			INNER JOIN datasets ON datasets.id = tasks.active_dataset_id
+		WHERE tasks.id = $1`, task_id)
+	err = row.Scan(&task_type)
+	if err != nil {
+		return
+	}
+	if task_type != bridge.TASK_TYPE_OUTPUT_ONLY {
+		language = sql.NullString{String: Language, Valid: true}
+	}
+	return
+}
+
+func MakeSubmission(tx store.Transaction, cid bridge.Id, uid bridge.Id, task_id bridge.Id, sources map[string][]byte) (sid bridge.Id, err error) {
+	language, err := submissionLanguage(tx, task_id)
+	if err != nil {
+		return
+	}
 
 	submission_time := time.Now()
 
@@ -261,7 +382,6 @@ func MakeSubmission(tx store.Transaction, cid bridge.Id, uid bridge.Id, task_id
 			$3, $4, $5, '', $6
 		) RETURNING id`, uid, cid, task_id, submission_time, language, true)
 
-	var sid int64
 	err = row.Scan(&sid)
 	if err != nil {
 		return
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"sort"
-	"strconv"
 
 	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
 	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
@@ -19,9 +18,9 @@ type OiajTaskEmbeddedData struct {
 func GetTask(tx store.Transaction, taskId bridge.Id) (task *bridge.Task, err error) {
 	task = &bridge.Task{}
 	row := tx.QueryRow(`
-		SELECT name, title, score_type, score_type_parameters, datasets.id, submission_format, datasets.description
+		SELECT name, title, score_type, score_type_parameters, datasets.id, submission_format, datasets.description, time_limit, memory_limit, task_type, task_type_parameters
 		FROM tasks
-		INNER JOIN datasets ON datasets.task_id = tasks.id
+		INNER JOIN datasets ON datasets.id = tasks.active_dataset_id
 		WHERE tasks.id = $1
 	`, taskId)
 	task.Id = taskId
@@ -29,7 +28,23 @@ func GetTask(tx store.Transaction, taskId bridge.Id) (task *bridge.Task, err err
 	var score_parameters string
 	var dataset_id bridge.Id
 	var description string
-	err = row.Scan(&task.Name, &task.Title, &score_type, &score_parameters, &dataset_id, &task.SubmissionFormat, &description)
+	var limits DatasetLimits
+	var task_type_parameters string
+	err = row.Scan(&task.Name, &task.Title, &score_type, &score_parameters, &dataset_id, &task.SubmissionFormat, &description, &limits.TimeLimit, &limits.MemoryLimit, &task.TaskType, &task_type_parameters)
+	if store.IsNoRows(err) {
+		// Either the task was deleted, or it has no active dataset yet
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tasks WHERE id = $1)", taskId).Scan(&exists)
+		if err != nil {
+			return
+		}
+		if !exists {
+			task.Deleted = true
+			return
+		}
+		err = fmt.Errorf("task %d has no active dataset", taskId)
+		return
+	}
 	if err != nil {
 		return
 	}
@@ -45,37 +60,18 @@ func GetTask(tx store.Transaction, taskId bridge.Id) (task *bridge.Task, err err
 		task.Tags = embedded_data.Tags
 	}
 
-	switch score_type {
-	case "Sum":
-		var multiplier float64
-		multiplier, err = strconv.ParseFloat(score_parameters, 64)
-		if err != nil {
-			return
-		}
-		var cases int64
-		row = tx.QueryRow(`SELECT count(testcases.id) FROM testcases WHERE dataset_id = $1`, dataset_id)
-		err = row.Scan(&cases)
-		if err != nil {
-			return
-		}
-		task.MaxScore = multiplier * float64(cases)
-	default:
-		var params [][]interface{}
-		err = json.Unmarshal([]byte(score_parameters), &params)
-		if err != nil {
-			return
-		}
-		task.MaxScore = 0
-		for _, params := range params {
-			score := params[0]
-			switch score := score.(type) {
-			case float64:
-				task.MaxScore += float64(score)
-			default:
-				err = fmt.Errorf("invalid score type %s", score)
-				return
-			}
-		}
+	st, testcases, err := GetDatasetScoreType(tx, dataset_id, score_type, score_parameters)
+	if err != nil {
+		err = fmt.Errorf("task %d: %s", taskId, err)
+		return
+	}
+	task.MaxScore = st.MaxScore(len(testcases))
+	task.TimeLimit = limits.TimeLimit.Float64
+	task.MemoryLimit = limits.MemoryLimit.Int64
+	task.Metadata, err = ParseTaskType(task.TaskType, task_type_parameters)
+	if err != nil {
+		err = fmt.Errorf("task %d: %s", taskId, err)
+		return
 	}
 
 	// Get attachments
@@ -100,27 +96,17 @@ func GetTask(tx store.Transaction, taskId bridge.Id) (task *bridge.Task, err err
 	sort.Slice(task.Attachments, func(i, j int) bool {
 		return task.Attachments[i] < task.Attachments[j]
 	})
+	task.Metadata.Kits = TaskKits(task.Name, task.Attachments)
 
-	rows, err = tx.Query(`
-			SELECT pg_largeobject.data
-					FROM statements
-					INNER JOIN fsobjects ON statements.digest = fsobjects.digest
-					INNER JOIN pg_largeobject ON fsobjects.loid = pg_largeobject.loid
-					WHERE statements.task_id = $1
-					ORDER BY pg_largeobject.pageno ASC;`,
-		taskId)
+	task.Statements, err = GetTaskStatements(tx, taskId)
 	if err != nil {
-		log.Printf("GetTask(): error getting statement: %s", err)
+		log.Printf("GetTask(): error getting statements: %s", err)
+		return
 	}
-	var statement []byte
-	for rows.Next() {
-		var page []byte
-		err = rows.Scan(&page)
-		if err != nil {
-			return
-		}
-		statement = append(statement, page...)
+	task.Samples, err = GetSampleTestcases(tx, dataset_id)
+	if err != nil {
+		log.Printf("GetTask(): error getting samples: %s", err)
+		return
 	}
-	task.Statement = statement
 	return
 }
@@ -0,0 +1,86 @@
+package cmsbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+)
+
+// ParseTaskType reads the task type parameters of a dataset. Their layout
+// depends on the task type:
+//
+//	Batch:         [compilation, [input file, output file], evaluation]
+//	Communication: [processes, compilation, user io]
+//	TwoSteps:      [evaluation]
+//	OutputOnly:    [evaluation]
+//
+// Other task types have no metadata.
+func ParseTaskType(task_type string, parameters string) (metadata bridge.TaskMetadata, err error) {
+	metadata.Kits = make([]bridge.TaskKit, 0)
+	var params []interface{}
+	switch task_type {
+	case bridge.TASK_TYPE_BATCH, bridge.TASK_TYPE_COMMUNICATION, bridge.TASK_TYPE_TWO_STEPS, bridge.TASK_TYPE_OUTPUT_ONLY:
+		err = json.Unmarshal([]byte(parameters), &params)
+		if err != nil {
+			err = fmt.Errorf("invalid parameters for %s: %s", task_type, parameters)
+			return
+		}
+	default:
+		return
+	}
+
+	// Parameters that are missing or have the wrong type are left empty,
+	// as CMS has changed them across versions
+	str := func(i int) string {
+		if i >= len(params) {
+			return ""
+		}
+		v, _ := params[i].(string)
+		return v
+	}
+	switch task_type {
+	case bridge.TASK_TYPE_BATCH:
+		metadata.Compilation = str(0)
+		if len(params) > 1 {
+			if files, ok := params[1].([]interface{}); ok && len(files) == 2 {
+				metadata.InputFile, _ = files[0].(string)
+				metadata.OutputFile, _ = files[1].(string)
+			}
+		}
+		metadata.Evaluation = str(2)
+	case bridge.TASK_TYPE_COMMUNICATION:
+		if len(params) > 0 {
+			processes, _ := params[0].(float64)
+			metadata.Processes = int(processes)
+		}
+		metadata.Compilation = str(1)
+		metadata.UserIo = str(2)
+	case bridge.TASK_TYPE_TWO_STEPS, bridge.TASK_TYPE_OUTPUT_ONLY:
+		metadata.Evaluation = str(0)
+	}
+	return
+}
+
+// TaskKits finds the kits among the attachments of a task, which are named
+// <task name>-<language>.zip, e.g. envido-java.zip
+func TaskKits(name string, attachments []string) []bridge.TaskKit {
+	kits := make([]bridge.TaskKit, 0)
+	for _, attachment := range attachments {
+		language := strings.TrimPrefix(attachment, name+"-")
+		if language == attachment || !strings.HasSuffix(language, ".zip") {
+			continue
+		}
+		language = strings.TrimSuffix(language, ".zip")
+		if language == "" {
+			continue
+		}
+		kits = append(kits, bridge.TaskKit{Language: language, Attachment: attachment})
+	}
+	sort.Slice(kits, func(i, j int) bool {
+		return kits[i].Language < kits[j].Language
+	})
+	return kits
+}
@@ -0,0 +1,82 @@
+package cmsbridge
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+)
+
+func TestParseTaskType(t *testing.T) {
+	tests := []struct {
+		name       string
+		task_type  string
+		parameters string
+		want       bridge.TaskMetadata
+		want_err   bool
+	}{
+		{
+			name:       "batch",
+			task_type:  bridge.TASK_TYPE_BATCH,
+			parameters: `["grader", ["input.txt", "output.txt"], "comparator"]`,
+			want:       bridge.TaskMetadata{Compilation: "grader", InputFile: "input.txt", OutputFile: "output.txt", Evaluation: "comparator"},
+		},
+		{
+			name:       "communication",
+			task_type:  bridge.TASK_TYPE_COMMUNICATION,
+			parameters: `[2, "stub", "fifo_io"]`,
+			want:       bridge.TaskMetadata{Processes: 2, Compilation: "stub", UserIo: "fifo_io"},
+		},
+		{
+			name:       "communication from older CMS",
+			task_type:  bridge.TASK_TYPE_COMMUNICATION,
+			parameters: `[1]`,
+			want:       bridge.TaskMetadata{Processes: 1},
+		},
+		{
+			name:       "communication with wrong types",
+			task_type:  bridge.TASK_TYPE_COMMUNICATION,
+			parameters: `["2", 1, null]`,
+			want:       bridge.TaskMetadata{},
+		},
+		{
+			name:       "two steps",
+			task_type:  bridge.TASK_TYPE_TWO_STEPS,
+			parameters: `["comparator"]`,
+			want:       bridge.TaskMetadata{Evaluation: "comparator"},
+		},
+		{
+			name:       "two steps without parameters",
+			task_type:  bridge.TASK_TYPE_TWO_STEPS,
+			parameters: `[]`,
+			want:       bridge.TaskMetadata{},
+		},
+		{
+			name:       "invalid parameters",
+			task_type:  bridge.TASK_TYPE_TWO_STEPS,
+			parameters: `{"evaluation": "diff"}`,
+			want_err:   true,
+		},
+		{
+			name:       "unknown task type",
+			task_type:  "Interactive",
+			parameters: `not json`,
+			want:       bridge.TaskMetadata{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTaskType(tt.task_type, tt.parameters)
+			if (err != nil) != tt.want_err {
+				t.Fatalf("ParseTaskType() error = %v, want_err %v", err, tt.want_err)
+			}
+			if tt.want_err {
+				return
+			}
+			tt.want.Kits = make([]bridge.TaskKit, 0)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTaskType() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package cmsbridge
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// UserTestManagers returns the managers CMS expects to be sent with the user
+// tests of a task, which it doesn't take from the dataset. Only Batch and
+// Communication tasks can be tested.
+func UserTestManagers(task_type string, metadata bridge.TaskMetadata) (managers []string, err error) {
+	switch {
+	case task_type == bridge.TASK_TYPE_BATCH && metadata.Compilation == "grader":
+		managers = append(managers, "grader"+LanguageExtension)
+	case task_type == bridge.TASK_TYPE_COMMUNICATION && metadata.Compilation == "stub":
+		managers = append(managers, "stub"+LanguageExtension)
+	case task_type == bridge.TASK_TYPE_BATCH, task_type == bridge.TASK_TYPE_COMMUNICATION:
+	default:
+		err = fmt.Errorf("%s tasks can't be tested", task_type)
+	}
+	return
+}
+
+func MakeUserTest(tx store.Transaction, cid bridge.Id, uid bridge.Id, task_id bridge.Id, sources map[string][]byte, input []byte) (id bridge.Id, err error) {
+	var task_type, task_type_parameters string
+	row := tx.QueryRow(`
+		SELECT datasets.task_type, datasets.task_type_parameters
+		FROM tasks
+			INNER JOIN datasets ON datasets.id = tasks.active_dataset_id
+		WHERE tasks.id = $1`, task_id)
+	err = row.Scan(&task_type, &task_type_parameters)
+	if err != nil {
+		return
+	}
+	metadata, err := ParseTaskType(task_type, task_type_parameters)
+	if err != nil {
+		return
+	}
+	managers, err := UserTestManagers(task_type, metadata)
+	if err != nil {
+		return
+	}
+
+	test_time := time.Now()
+
+	input_digest, err := AddFsObject(tx, input, fmt.Sprintf("User test input sent by %d at %d.", uid, test_time.Unix()))
+	if err != nil {
+		return
+	}
+
+	row = tx.QueryRow(`
+	INSERT INTO user_tests
+		(participation_id, task_id, timestamp, language, input)
+		VALUES (
+			(SELECT id FROM participations WHERE user_id = $1 AND contest_id = $2),
+			$3, $4, $5, $6
+		) RETURNING id`, uid, cid, task_id, test_time, Language, input_digest)
+	err = row.Scan(&id)
+	if err != nil {
+		return
+	}
+
+	for filename, content := range sources {
+		var digest string
+		digest, err = AddFsObject(tx, content, fmt.Sprintf("User test file %s sent by %d at %d.", filename, uid, test_time.Unix()))
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec("INSERT INTO user_test_files (user_test_id, filename, digest) VALUES ($1, $2, $3)", id, filename, digest)
+		if err != nil {
+			return
+		}
+	}
+
+	// CMS only takes the checker or the manager from the dataset when
+	// evaluating user tests, the grader or stub and the headers are expected
+	// to be sent with them
+	for _, filename := range managers {
+		var tag pgconn.CommandTag
+		tag, err = tx.Exec(`
+		INSERT INTO user_test_managers (user_test_id, filename, digest)
+			SELECT $1, managers.filename, managers.digest
+			FROM managers
+				INNER JOIN tasks ON tasks.active_dataset_id = managers.dataset_id
+			WHERE tasks.id = $2 AND managers.filename = $3`, id, task_id, filename)
+		if err != nil {
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			err = fmt.Errorf("task %d has no manager %s", task_id, filename)
+			return
+		}
+	}
+	_, err = tx.Exec(`
+	INSERT INTO user_test_managers (user_test_id, filename, digest)
+		SELECT $1, managers.filename, managers.digest
+		FROM managers
+			INNER JOIN tasks ON tasks.active_dataset_id = managers.dataset_id
+		WHERE tasks.id = $2 AND managers.filename LIKE '%.h'`, id, task_id)
+	return
+}
+
+func GetUserTest(tx store.Transaction, id bridge.Id, max_output int) (test *bridge.UserTest, err error) {
+	test = &bridge.UserTest{Id: id}
+	row := tx.QueryRow(`
+	SELECT
+		participations.user_id,
+		user_tests.task_id,
+		user_tests.timestamp,
+		user_test_results.compilation_outcome,
+		user_test_results.compilation_stderr,
+		user_test_results.evaluation_outcome,
+		user_test_results.evaluation_text,
+		user_test_results.execution_time,
+		user_test_results.execution_memory,
+		user_test_results.output
+	FROM user_tests
+		INNER JOIN participations
+			ON participations.id = user_tests.participation_id
+		INNER JOIN tasks
+			ON tasks.id = user_tests.task_id
+		LEFT JOIN user_test_results
+			ON user_test_results.user_test_id = user_tests.id
+			AND user_test_results.dataset_id = tasks.active_dataset_id
+	WHERE user_tests.id = $1`, id)
+	var compilation_outcome sql.NullString
+	var compilation_stderr sql.NullString
+	var evaluation_outcome sql.NullString
+	var messages []string
+	var execution_time sql.NullFloat64
+	var memory_usage sql.NullInt64
+	var output sql.NullString
+	err = row.Scan(
+		&test.UserId,
+		&test.TaskId,
+		&test.Timestamp,
+		&compilation_outcome,
+		&compilation_stderr,
+		&evaluation_outcome,
+		&messages,
+		&execution_time,
+		&memory_usage,
+		&output)
+	if err != nil {
+		return
+	}
+	switch {
+	case !compilation_outcome.Valid:
+		test.Status = bridge.USER_TEST_COMPILING
+		return
+	case compilation_outcome.String == "fail":
+		test.Status = bridge.USER_TEST_COMPILATION_FAILED
+		test.CompilationMessage = compilation_stderr.String
+		return
+	case !evaluation_outcome.Valid:
+		test.Status = bridge.USER_TEST_EVALUATING
+		test.CompilationMessage = compilation_stderr.String
+		return
+	}
+	test.Status = bridge.USER_TEST_EVALUATED
+	test.CompilationMessage = compilation_stderr.String
+	test.ExecutionTime = execution_time.Float64
+	test.MemoryUsage = memory_usage.Int64
+	test.Message = strings.Join(messages, "\n")
+	if output.Valid {
+		test.Output, test.OutputTruncated, err = GetFsObject(tx, output.String, max_output)
+	}
+	return
+}
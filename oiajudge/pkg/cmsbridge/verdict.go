@@ -0,0 +1,55 @@
+package cmsbridge
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+)
+
+// DatasetLimits are the limits of a dataset. They are NULL when there is no
+// limit.
+type DatasetLimits struct {
+	TimeLimit   sql.NullFloat64
+	MemoryLimit sql.NullInt64
+}
+
+// TestcaseVerdict classifies the evaluation of a testcase. CMS only stores
+// the message shown to contestants, whose first element is a fixed format
+// string, so the verdict is derived from it, the outcome and the limits.
+// outcome_valid is false when the evaluation has no numeric outcome.
+func TestcaseVerdict(outcome float64, outcome_valid bool, messages []string, execution_time sql.NullFloat64, memory_usage sql.NullInt64, limits DatasetLimits) bridge.Verdict {
+	message := ""
+	if len(messages) > 0 {
+		message = strings.ToLower(messages[0])
+	}
+	switch {
+	case strings.Contains(message, "timed out"):
+		return bridge.TIME_LIMIT_EXCEEDED
+	case strings.Contains(message, "memory"):
+		return bridge.MEMORY_LIMIT_EXCEEDED
+	}
+	// Programs killed by the sandbox for exceeding a limit usually only say
+	// that they were killed by a signal
+	killed := strings.Contains(message, "signal") || strings.Contains(message, "killed")
+	if killed && limits.MemoryLimit.Valid && memory_usage.Valid && memory_usage.Int64 >= limits.MemoryLimit.Int64 {
+		return bridge.MEMORY_LIMIT_EXCEEDED
+	}
+	if killed && limits.TimeLimit.Valid && execution_time.Valid && execution_time.Float64 >= limits.TimeLimit.Float64 {
+		return bridge.TIME_LIMIT_EXCEEDED
+	}
+	switch {
+	case killed:
+		return bridge.SIGNAL
+	case strings.Contains(message, "return code") || strings.Contains(message, "nonzero"):
+		return bridge.RUNTIME_ERROR
+	case !outcome_valid:
+		return bridge.CHECKER_ERROR
+	case outcome >= 1:
+		return bridge.OK
+	case outcome <= 0:
+		return bridge.WRONG_ANSWER
+	default:
+		return bridge.PARTIAL
+	}
+}
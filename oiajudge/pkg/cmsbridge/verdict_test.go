@@ -0,0 +1,50 @@
+package cmsbridge
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+)
+
+func TestTestcaseVerdict(t *testing.T) {
+	limits := DatasetLimits{
+		TimeLimit:   sql.NullFloat64{Float64: 1, Valid: true},
+		MemoryLimit: sql.NullInt64{Int64: 256 << 20, Valid: true},
+	}
+	fast := sql.NullFloat64{Float64: 0.1, Valid: true}
+	small := sql.NullInt64{Int64: 1 << 20, Valid: true}
+	tests := []struct {
+		name           string
+		outcome        float64
+		outcome_valid  bool
+		messages       []string
+		execution_time sql.NullFloat64
+		memory_usage   sql.NullInt64
+		limits         DatasetLimits
+		want           bridge.Verdict
+	}{
+		{"ok", 1, true, []string{"Output is correct"}, fast, small, limits, bridge.OK},
+		{"wrong answer", 0, true, []string{"Output isn't correct"}, fast, small, limits, bridge.WRONG_ANSWER},
+		{"partial", 0.5, true, []string{"Output is partially correct"}, fast, small, limits, bridge.PARTIAL},
+		{"time limit", 0, true, []string{"Execution timed out"}, sql.NullFloat64{}, small, limits, bridge.TIME_LIMIT_EXCEEDED},
+		{"wall time limit", 0, true, []string{"Execution timed out (wall clock limit exceeded)"}, fast, small, limits, bridge.TIME_LIMIT_EXCEEDED},
+		{"memory limit", 0, true, []string{"Memory limit exceeded"}, fast, sql.NullInt64{}, limits, bridge.MEMORY_LIMIT_EXCEEDED},
+		{"runtime error", 0, true, []string{"Execution failed because the return code was nonzero"}, fast, small, limits, bridge.RUNTIME_ERROR},
+		{"signal over memory limit", 0, true, []string{"Execution killed by signal"}, fast, sql.NullInt64{Int64: 256 << 20, Valid: true}, limits, bridge.MEMORY_LIMIT_EXCEEDED},
+		{"signal over time limit", 0, true, []string{"Execution killed by signal"}, sql.NullFloat64{Float64: 1.2, Valid: true}, small, limits, bridge.TIME_LIMIT_EXCEEDED},
+		{"signal within limits", 0, true, []string{"Execution killed by signal"}, fast, small, limits, bridge.SIGNAL},
+		{"signal without limits", 0, true, []string{"Execution killed by signal"}, sql.NullFloat64{Float64: 1.2, Valid: true}, sql.NullInt64{Int64: 256 << 20, Valid: true}, DatasetLimits{}, bridge.SIGNAL},
+		{"signal without usage", 0, true, []string{"Execution killed by signal"}, sql.NullFloat64{}, sql.NullInt64{}, limits, bridge.SIGNAL},
+		{"checker error", 0, false, []string{"Output is correct"}, fast, small, limits, bridge.CHECKER_ERROR},
+		{"no messages", 1, true, nil, fast, small, limits, bridge.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TestcaseVerdict(tt.outcome, tt.outcome_valid, tt.messages, tt.execution_time, tt.memory_usage, tt.limits)
+			if got != tt.want {
+				t.Errorf("TestcaseVerdict() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,10 +3,12 @@ package oiajudge
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -16,6 +18,9 @@ type MakeSubmissionQuery struct {
 
 	// Submissions can have many files, indexed by filename
 	Sources map[string][]byte `json:"sources"`
+	// Submissions to output only tasks can instead send a zip file with
+	// the outputs
+	Outputs []byte `json:"outputs"`
 }
 
 func (q MakeSubmissionQuery) Uid() Id {
@@ -27,14 +32,40 @@ type MakeSubmissionResponse struct {
 }
 
 func (s *Server) MakeSubmission(ctx context.Context, q MakeSubmissionQuery) (r MakeSubmissionResponse, err error) {
+	task, err := s.GetSubmissionTask(ctx, q.Task)
+	if err != nil {
+		return
+	}
+	q.Sources, err = ValidateSources(task, q.Sources, q.Outputs)
+	if err != nil {
+		return
+	}
+	contest, err := s.CheckContestWindow(ctx, q.User, q.Task)
+	if err != nil {
+		return
+	}
+	virtual_contest, err := s.GetVirtualContestForTask(ctx, q.User, q.Task)
+	if err != nil {
+		return
+	}
 	err = CanUserSubmit(s, ctx, q)
 	if err != nil {
 		return
 	}
-	err = s.Bridge.MakeSubmission(ctx, q.User, q.Task, q.Sources)
+	r.Submission, err = s.Bridge.MakeSubmission(ctx, q.User, q.Task, q.Sources)
 	if err != nil {
 		return
 	}
+	// The submission was already made, so failing here would only make the
+	// user retry it
+	contest_err := s.RegisterContestSubmission(ctx, contest, q.User, q.Task, r.Submission)
+	if contest_err != nil {
+		log.Printf("MakeSubmission(): could not register submission %d in contest %d: %s", r.Submission, contest.Id, contest_err)
+	}
+	virtual_err := s.RegisterVirtualSubmission(ctx, virtual_contest, q.Task, r.Submission)
+	if virtual_err != nil {
+		log.Printf("MakeSubmission(): could not register submission %d in virtual contest %d: %s", r.Submission, virtual_contest.Id, virtual_err)
+	}
 	return
 }
 
@@ -51,7 +82,7 @@ func CanUserSubmit(s *Server, ctx context.Context, q MakeSubmissionQuery) (err e
 		return
 	}
 	if last_submission.Add(s.Config.SubmissionCooldown).After(now) {
-		err = fmt.Errorf("wait %v to before retrying", last_submission.Add(s.Config.SubmissionCooldown).Sub(now))
+		err = fmt.Errorf("wait %v before retrying", last_submission.Add(s.Config.SubmissionCooldown).Sub(now))
 		err = &OiaError{
 			HttpCode:      http.StatusTooManyRequests,
 			Message:       err.Error(),
@@ -82,6 +113,13 @@ func (s *Server) GetSubmissions(ctx context.Context, q GetSubmissionsQuery) (r G
 	if err != nil {
 		return
 	}
+	frozen, err := GetFrozenSubmissions(*tx, s.GetTime())
+	if err != nil {
+		return
+	}
+	for i := range submissions {
+		HideFrozenResult(&submissions[i], frozen)
+	}
 	r.Submissions = submissions
 	return
 }
@@ -104,6 +142,23 @@ func (s *Server) GetSubmission(ctx context.Context, q GetSubmissionQuery) (r Get
 	if err != nil {
 		return
 	}
+	frozen, err := GetFrozenSubmissions(*tx, s.GetTime())
+	if err != nil {
+		return
+	}
+	HideFrozenResult(&submission, frozen)
+	// How many testcases were evaluated would also give away the result of
+	// frozen submissions
+	_, is_frozen := frozen[submission.Id]
+	if !isFinalStatus(submission.SubmissionStatus) && !is_frozen {
+		// The progress is only an estimate, so the submission is still
+		// returned without it
+		progress, progress_err := s.Bridge.GetSubmissionProgress(ctx, submission.Id)
+		if progress_err != nil {
+			log.Printf("GetSubmission(): could not get the progress of submission %d: %s", submission.Id, progress_err)
+		}
+		submission.Progress = progress
+	}
 	r.Submission = submission
 	return
 }
@@ -193,6 +248,8 @@ func (q GetUserQuery) Uid() Id {
 type GetUserResponse struct {
 	Username string  `json:"username"`
 	Score    float64 `json:"score"`
+	// Tasks whose editorial the user saw before solving them
+	GaveUp []Id `json:"gave_up"`
 }
 
 func (s *Server) GetUser(ctx context.Context, q GetUserQuery) (r GetUserResponse, err error) {
@@ -206,7 +263,22 @@ func (s *Server) GetUser(ctx context.Context, q GetUserQuery) (r GetUserResponse
 		return
 	}
 	r.Username = user.Username
-	r.Score = user.Score
+	frozen, err := GetFrozenSubmissions(*tx, s.GetTime())
+	if err != nil {
+		return
+	}
+	unfrozen, err := GetUnfrozenBaseScores(*tx, frozen)
+	if err != nil {
+		return
+	}
+	r.Score, err = HideFrozenUserScore(*tx, q.UserId, user.Score, unfrozen)
+	if err != nil {
+		return
+	}
+	r.GaveUp, err = GetGiveUps(*tx, q.UserId)
+	if err != nil {
+		return
+	}
 	return
 }
 
@@ -226,7 +298,15 @@ func (s *Server) GetTasks(ctx context.Context, q GetTasksQuery) (r GetTasksRespo
 	if err != nil {
 		return
 	}
-	r.Tasks = tasks
+	upcoming, err := GetUpcomingContestTasks(*tx, s.GetTime())
+	if err != nil {
+		return
+	}
+	for _, task := range tasks {
+		if !upcoming[task.Id] {
+			r.Tasks = append(r.Tasks, task)
+		}
+	}
 	return
 }
 
@@ -245,27 +325,34 @@ func (s *Server) GetSingleTask(ctx context.Context, q GetSingleTaskQuery) (r Get
 	}
 	defer tx.Close(&err)
 	task, err := GetSingleTask(*tx, q.Id)
+	if store.IsNoRows(err) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("task %d not found", q.Id),
+		}
+		return
+	}
 	if err != nil {
 		return
 	}
-	r.Task = task
-	return
-}
-
-func (s *Server) GetTaskStatement(ctx context.Context, tid Id) (statement []byte, err error) {
-	tx, err := s.Db.Tx(ctx)
+	err = CheckTaskVisible(*tx, q.Id, s.GetTime())
 	if err != nil {
 		return
 	}
-	defer tx.Close(&err)
-	statement, err = GetTaskStatement(*tx, tid)
+	task.Samples, err = GetTaskSamples(*tx, q.Id)
 	if err != nil {
 		return
 	}
+	s.fillSampleUrls(q.Id, task.Samples)
+	r.Task = task
 	return
 }
 
 func (s *Server) GetAttachment(ctx context.Context, tid Id, filename string) (attachment []byte, err error) {
+	err = s.CheckTaskVisible(ctx, tid)
+	if err != nil {
+		return
+	}
 	return s.Bridge.GetAttachment(ctx, tid, filename)
 }
 
@@ -0,0 +1,536 @@
+package oiajudge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+// Contests are live rounds over a set of tasks. While a contest hasn't
+// finished its tasks only accept submissions from its participants during the
+// contest window. After the contest ends the tasks go back to being regular
+// archive tasks.
+type Contest struct {
+	Id        Id        `json:"id"`
+	Name      string    `json:"name"`
+	Tasks     []Id      `json:"tasks"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	// Submissions made after this time are hidden from the scoreboard until
+	// the contest ends. Nil if the scoreboard is never frozen
+	FreezeTime *time.Time `json:"freeze_time"`
+}
+
+func (c Contest) Running(now time.Time) bool {
+	return !now.Before(c.StartTime) && now.Before(c.EndTime)
+}
+
+func (c Contest) Frozen(now time.Time) bool {
+	return c.FreezeTime != nil && !now.Before(*c.FreezeTime) && now.Before(c.EndTime)
+}
+
+type ContestScoreboardEntry struct {
+	UserId   Id                  `json:"user_id"`
+	Username string              `json:"username"`
+	Tasks    []ContestTaskResult `json:"tasks"`
+	Total    float64             `json:"total"`
+	// Submissions made during the freeze, whose results are hidden
+	Hidden int64 `json:"hidden"`
+}
+
+type ContestScoreboard struct {
+	Contest Contest                  `json:"contest"`
+	Frozen  bool                     `json:"frozen"`
+	Entries []ContestScoreboardEntry `json:"entries"`
+}
+
+type GetContestsQuery struct{}
+
+type GetContestsResponse struct {
+	Contests []Contest `json:"contests"`
+}
+
+func (s *Server) GetContests(ctx context.Context, q GetContestsQuery) (r GetContestsResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.Contests, err = GetContests(*tx, "SELECT id, name, task_ids, start_time, end_time, freeze_time FROM oia_contest ORDER BY start_time")
+	if err != nil {
+		return
+	}
+	return
+}
+
+type GetContestScoreboardQuery struct {
+	ContestId Id `json:"contest_id"`
+}
+
+type GetContestScoreboardResponse struct {
+	Scoreboard ContestScoreboard `json:"scoreboard"`
+}
+
+func (s *Server) GetContestScoreboard(ctx context.Context, q GetContestScoreboardQuery) (r GetContestScoreboardResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.Scoreboard, err = GetContestScoreboard(*tx, q.ContestId, s.GetTime(), false)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// GetUnfrozenContestScoreboard shows the real results to the admins, even
+// during the freeze
+func (s *Server) GetUnfrozenContestScoreboard(ctx context.Context, q GetContestScoreboardQuery) (r GetContestScoreboardResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.Scoreboard, err = GetContestScoreboard(*tx, q.ContestId, s.GetTime(), true)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type SaveContestQuery struct {
+	Contest Contest `json:"contest"`
+}
+
+type SaveContestResponse struct {
+	ContestId Id `json:"contest_id"`
+}
+
+// SaveContest creates a contest if it has no id, or updates it otherwise
+func (s *Server) SaveContest(ctx context.Context, q SaveContestQuery) (r SaveContestResponse, err error) {
+	c := q.Contest
+	if !c.StartTime.Before(c.EndTime) {
+		err = &OiaError{
+			HttpCode: http.StatusBadRequest,
+			Message:  "the contest must start before it ends",
+		}
+		return
+	}
+	if c.FreezeTime != nil && (c.FreezeTime.Before(c.StartTime) || c.FreezeTime.After(c.EndTime)) {
+		err = &OiaError{
+			HttpCode: http.StatusBadRequest,
+			Message:  "the freeze time must be inside the contest",
+		}
+		return
+	}
+	if c.Tasks == nil {
+		c.Tasks = []Id{}
+	}
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	if c.Id == 0 {
+		row := tx.QueryRow("INSERT INTO oia_contest(name, task_ids, start_time, end_time, freeze_time) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			c.Name, c.Tasks, c.StartTime, c.EndTime, c.FreezeTime)
+		err = row.Scan(&r.ContestId)
+		return
+	}
+	tag, err := tx.Exec("UPDATE oia_contest SET name = $2, task_ids = $3, start_time = $4, end_time = $5, freeze_time = $6 WHERE id = $1",
+		c.Id, c.Name, c.Tasks, c.StartTime, c.EndTime, c.FreezeTime)
+	if err != nil {
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("contest %d not found", c.Id),
+		}
+		return
+	}
+	r.ContestId = c.Id
+	return
+}
+
+type SetContestParticipantsQuery struct {
+	ContestId Id   `json:"contest_id"`
+	Add       []Id `json:"add"`
+	Remove    []Id `json:"remove"`
+}
+
+type SetContestParticipantsResponse struct {
+	Participants []Id `json:"participants"`
+}
+
+func (s *Server) SetContestParticipants(ctx context.Context, q SetContestParticipantsQuery) (r SetContestParticipantsResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	for _, uid := range q.Add {
+		_, err = tx.Exec("INSERT INTO oia_contest_participant(contest_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", q.ContestId, uid)
+		if err != nil {
+			return
+		}
+	}
+	if len(q.Remove) > 0 {
+		_, err = tx.Exec("DELETE FROM oia_contest_participant WHERE contest_id = $1 AND user_id = ANY($2)", q.ContestId, q.Remove)
+		if err != nil {
+			return
+		}
+	}
+	rows, err := tx.Query("SELECT user_id FROM oia_contest_participant WHERE contest_id = $1 ORDER BY user_id", q.ContestId)
+	if err != nil {
+		return
+	}
+	r.Participants = make([]Id, 0)
+	for rows.Next() {
+		var uid Id
+		err = rows.Scan(&uid)
+		if err != nil {
+			return
+		}
+		r.Participants = append(r.Participants, uid)
+	}
+	return
+}
+
+// CheckContestWindow rejects submissions to tasks of contests that haven't
+// started, or that are running and the user doesn't take part in. It returns
+// the contest the submission counts for, or nil for archive submissions.
+func (s *Server) CheckContestWindow(ctx context.Context, uid Id, tid Id) (contest *Contest, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	now := s.GetTime()
+	contests, err := GetContests(*tx, `
+		SELECT id, name, task_ids, start_time, end_time, freeze_time FROM oia_contest
+		WHERE $1 = ANY(task_ids) AND end_time > $2
+		ORDER BY start_time`, tid, now)
+	if err != nil {
+		return
+	}
+	for _, c := range contests {
+		if !c.Running(now) {
+			err = &OiaError{
+				HttpCode: http.StatusForbidden,
+				Message:  fmt.Sprintf("task %d is part of contest `%s`, which starts at %s", tid, c.Name, c.StartTime.Format(time.RFC3339)),
+			}
+			return
+		}
+	}
+	for i, c := range contests {
+		row := tx.QueryRow("SELECT COUNT(*) FROM oia_contest_participant WHERE contest_id = $1 AND user_id = $2", c.Id, uid)
+		var count int64
+		err = row.Scan(&count)
+		if err != nil {
+			return
+		}
+		if count > 0 {
+			contest = &contests[i]
+			return
+		}
+	}
+	if len(contests) > 0 {
+		err = &OiaError{
+			HttpCode: http.StatusForbidden,
+			Message:  fmt.Sprintf("task %d is part of contest `%s`, which only accepts submissions from its participants until %s", tid, contests[0].Name, contests[0].EndTime.Format(time.RFC3339)),
+		}
+		return
+	}
+	return
+}
+
+// GetUpcomingContestTasks returns the tasks of contests that haven't
+// started. They are hidden until the contest starts.
+func GetUpcomingContestTasks(tx store.Transaction, now time.Time) (upcoming map[Id]bool, err error) {
+	contests, err := GetContests(tx, `
+		SELECT id, name, task_ids, start_time, end_time, freeze_time FROM oia_contest
+		WHERE start_time > $1`, now)
+	if err != nil {
+		return
+	}
+	upcoming = make(map[Id]bool)
+	for _, c := range contests {
+		for _, tid := range c.Tasks {
+			upcoming[tid] = true
+		}
+	}
+	return
+}
+
+// GetFrozenSubmissions returns the contest submissions made during the
+// freeze of contests that haven't ended, with their task. Their results are
+// hidden until the contest ends.
+func GetFrozenSubmissions(tx store.Transaction, now time.Time) (frozen map[Id]Id, err error) {
+	rows, err := tx.Query(`
+		SELECT oia_contest_submission.submission_id, oia_contest_submission.task_id
+		FROM oia_contest_submission
+			INNER JOIN oia_contest ON oia_contest.id = oia_contest_submission.contest_id
+		WHERE oia_contest.freeze_time <= $1 AND oia_contest.end_time > $1
+			AND oia_contest_submission.submitted_at >= oia_contest.freeze_time`, now)
+	if err != nil {
+		return
+	}
+	frozen = make(map[Id]Id)
+	for rows.Next() {
+		var sid, tid Id
+		err = rows.Scan(&sid, &tid)
+		if err != nil {
+			return
+		}
+		frozen[sid] = tid
+	}
+	return
+}
+
+// GetUnfrozenBaseScores returns the base score of every user in the tasks
+// where they have frozen submissions, leaving those submissions out. It is
+// indexed by user and then by task.
+func GetUnfrozenBaseScores(tx store.Transaction, frozen map[Id]Id) (scores map[Id]map[Id]float64, err error) {
+	scores = make(map[Id]map[Id]float64)
+	if len(frozen) == 0 {
+		return
+	}
+	tids := make([]Id, 0)
+	seen := make(map[Id]bool)
+	for _, tid := range frozen {
+		if !seen[tid] {
+			seen[tid] = true
+			tids = append(tids, tid)
+		}
+	}
+	rows, err := tx.Query("SELECT id, user_id, task_id, subtask_details FROM oia_submissions WHERE task_id = ANY($1)", tids)
+	if err != nil {
+		return
+	}
+	type key struct {
+		uid Id
+		tid Id
+	}
+	visible := make(map[key][][]float64)
+	has_frozen := make(map[key]bool)
+	for rows.Next() {
+		var sid Id
+		var k key
+		var details string
+		err = rows.Scan(&sid, &k.uid, &k.tid, &details)
+		if err != nil {
+			return
+		}
+		if _, ok := frozen[sid]; ok {
+			has_frozen[k] = true
+			continue
+		}
+		subtask_scores := make([]float64, 0)
+		err = json.Unmarshal([]byte(details), &subtask_scores)
+		if err != nil {
+			return
+		}
+		visible[k] = append(visible[k], subtask_scores)
+	}
+	for k := range has_frozen {
+		if scores[k.uid] == nil {
+			scores[k.uid] = make(map[Id]float64)
+		}
+		scores[k.uid][k.tid] = BestSubtaskScore(visible[k])
+	}
+	return
+}
+
+// HideFrozenUserScore replaces the points of a user in the tasks with frozen
+// submissions, which are already counted in the stored score, with the ones
+// they had before the freeze
+func HideFrozenUserScore(tx store.Transaction, uid Id, score float64, unfrozen map[Id]map[Id]float64) (float64, error) {
+	for tid, base_score := range unfrozen[uid] {
+		row := tx.QueryRow(`
+			SELECT oia_task_score.score, oia_task.multiplier, oia_task.deleted
+			FROM oia_task_score
+				INNER JOIN oia_task ON oia_task.id = oia_task_score.task_id
+			WHERE oia_task_score.user_id = $1 AND oia_task_score.task_id = $2`, uid, tid)
+		var stored, multiplier float64
+		var deleted bool
+		err := row.Scan(&stored, &multiplier, &deleted)
+		if store.IsNoRows(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		// The score of deleted tasks isn't counted
+		if !deleted {
+			score += base_score*multiplier - stored
+		}
+	}
+	return score, nil
+}
+
+// CheckTaskVisible rejects requests for the tasks of contests that haven't
+// started
+func CheckTaskVisible(tx store.Transaction, tid Id, now time.Time) error {
+	upcoming, err := GetUpcomingContestTasks(tx, now)
+	if err != nil {
+		return err
+	}
+	if upcoming[tid] {
+		return &OiaError{
+			HttpCode: http.StatusForbidden,
+			Message:  fmt.Sprintf("task %d is part of a contest that hasn't started", tid),
+		}
+	}
+	return nil
+}
+
+func (s *Server) CheckTaskVisible(ctx context.Context, tid Id) (err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = CheckTaskVisible(*tx, tid, s.GetTime())
+	return
+}
+
+// HideFrozenResult makes a submission made during the freeze look like it is
+// still being evaluated
+func HideFrozenResult(submission *bridge.Submission, frozen map[Id]Id) {
+	if _, ok := frozen[submission.Id]; !ok || submission.SubmissionStatus != bridge.SCORED {
+		return
+	}
+	submission.SubmissionStatus = bridge.EVALUATING
+	submission.Result = nil
+}
+
+func (s *Server) RegisterContestSubmission(ctx context.Context, contest *Contest, uid Id, tid Id, sid Id) (err error) {
+	if contest == nil {
+		return
+	}
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	_, err = tx.Exec("INSERT INTO oia_contest_submission(submission_id, contest_id, user_id, task_id, submitted_at) VALUES ($1, $2, $3, $4, $5)",
+		sid, contest.Id, uid, tid, s.GetTime())
+	if err != nil {
+		return
+	}
+	return
+}
+
+func GetContests(tx store.Transaction, query string, args ...any) (contests []Contest, err error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return
+	}
+	contests = make([]Contest, 0)
+	for rows.Next() {
+		var c Contest
+		err = rows.Scan(&c.Id, &c.Name, &c.Tasks, &c.StartTime, &c.EndTime, &c.FreezeTime)
+		if err != nil {
+			return
+		}
+		contests = append(contests, c)
+	}
+	return
+}
+
+// GetContestScoreboard ranks every participant. Unless unfrozen is set,
+// submissions made during the freeze are left out while it lasts.
+func GetContestScoreboard(tx store.Transaction, cid Id, now time.Time, unfrozen bool) (scoreboard ContestScoreboard, err error) {
+	contests, err := GetContests(tx, "SELECT id, name, task_ids, start_time, end_time, freeze_time FROM oia_contest WHERE id = $1", cid)
+	if err != nil {
+		return
+	}
+	if len(contests) == 0 {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("contest %d not found", cid),
+		}
+		return
+	}
+	scoreboard.Contest = contests[0]
+	scoreboard.Frozen = !unfrozen && scoreboard.Contest.Frozen(now)
+
+	tasks, err := GetTasks(tx)
+	if err != nil {
+		return
+	}
+	by_id := make(map[Id]bridge.Task)
+	for _, task := range tasks {
+		by_id[task.Id] = task
+	}
+	contest_tasks := make([]bridge.Task, 0)
+	for _, tid := range scoreboard.Contest.Tasks {
+		task, ok := by_id[tid]
+		if !ok {
+			task = bridge.Task{Id: tid}
+		}
+		contest_tasks = append(contest_tasks, task)
+	}
+
+	rows, err := tx.Query(`
+		SELECT oia_user.id, oia_user.username
+		FROM oia_contest_participant
+			INNER JOIN oia_user ON oia_user.id = oia_contest_participant.user_id
+		WHERE oia_contest_participant.contest_id = $1`, cid)
+	if err != nil {
+		return
+	}
+	scoreboard.Entries = make([]ContestScoreboardEntry, 0)
+	for rows.Next() {
+		var entry ContestScoreboardEntry
+		err = rows.Scan(&entry.UserId, &entry.Username)
+		if err != nil {
+			return
+		}
+		scoreboard.Entries = append(scoreboard.Entries, entry)
+	}
+
+	submissions, err := GetContestSubmissions(tx, `
+		SELECT oia_contest_submission.submission_id, oia_contest_submission.user_id, oia_contest_submission.task_id,
+			oia_contest_submission.submitted_at, oia_submissions.details, oia_submissions.subtask_details
+		FROM oia_contest_submission
+			LEFT JOIN oia_submissions ON oia_submissions.id = oia_contest_submission.submission_id
+		WHERE oia_contest_submission.contest_id = $1`, cid)
+	if err != nil {
+		return
+	}
+	by_user := make(map[Id][]ContestSubmission)
+	hidden := make(map[Id]int64)
+	for _, submission := range submissions {
+		if scoreboard.Frozen && !submission.SubmittedAt.Before(*scoreboard.Contest.FreezeTime) {
+			hidden[submission.UserId] += 1
+			continue
+		}
+		by_user[submission.UserId] = append(by_user[submission.UserId], submission)
+	}
+	gave_up, err := GetTaskGiveUps(tx, scoreboard.Contest.Tasks)
+	if err != nil {
+		return
+	}
+	for i := range scoreboard.Entries {
+		entry := &scoreboard.Entries[i]
+		entry.Tasks, entry.Total = ScoreContest(contest_tasks, by_user[entry.UserId])
+		MarkGiveUps(entry.Tasks, gave_up[entry.UserId])
+		entry.Hidden = hidden[entry.UserId]
+	}
+	sort.SliceStable(scoreboard.Entries, func(i, j int) bool {
+		if scoreboard.Entries[i].Total != scoreboard.Entries[j].Total {
+			return scoreboard.Entries[i].Total > scoreboard.Entries[j].Total
+		}
+		return scoreboard.Entries[i].Username < scoreboard.Entries[j].Username
+	})
+	return
+}
@@ -33,5 +33,13 @@ type Config struct {
 	OiaDbConnectionString string
 	OiaServerPort         int64
 	SubmissionCooldown    time.Duration
+	UserTestCooldown      time.Duration
 	Debug                 bool
+	// Bearer token for the /admin APIs. The admin APIs are disabled if empty
+	AdminToken string
+	// How often CMS and the judge are compared. Disabled if not positive
+	ReconcileInterval time.Duration
+	// URL where this server is reachable by browsers, used for the images of
+	// rendered statements. Empty if it's the same origin as the frontend
+	PublicUrl string
 }
@@ -0,0 +1,388 @@
+package oiajudge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+type EditorialSolution struct {
+	// The extension of the language, e.g. cpp or java
+	Language string `json:"language"`
+	Filename string `json:"filename"`
+	Source   []byte `json:"source"`
+}
+
+type Editorial struct {
+	TaskId    Id        `json:"task_id"`
+	Version   int64     `json:"version"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	// Content rendered to sanitized HTML, only for users
+	Html      string              `json:"html,omitempty"`
+	Solutions []EditorialSolution `json:"solutions"`
+}
+
+type SaveEditorialQuery struct {
+	TaskId    Id                  `json:"task_id"`
+	Content   string              `json:"content"`
+	Solutions []EditorialSolution `json:"solutions"`
+}
+
+type SaveEditorialResponse struct {
+	Version int64 `json:"version"`
+}
+
+// SaveEditorial stores a new version of the editorial of a task. Older
+// versions are kept.
+func (s *Server) SaveEditorial(ctx context.Context, q SaveEditorialQuery) (r SaveEditorialResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	_, err = GetSingleTask(*tx, q.TaskId)
+	if store.IsNoRows(err) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("task %d not found", q.TaskId),
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, solution := range q.Solutions {
+		if solution.Language == "" || seen[solution.Language] {
+			err = &OiaError{
+				HttpCode: http.StatusBadRequest,
+				Message:  "every solution must have a different language",
+			}
+			return
+		}
+		seen[solution.Language] = true
+	}
+	r.Version, err = SaveEditorial(*tx, q.TaskId, q.Content, q.Solutions)
+	return
+}
+
+type GetEditorialHistoryQuery struct {
+	TaskId Id `json:"task_id"`
+}
+
+type GetEditorialHistoryResponse struct {
+	// Newest first
+	Versions []Editorial `json:"versions"`
+}
+
+func (s *Server) GetEditorialHistory(ctx context.Context, q GetEditorialHistoryQuery) (r GetEditorialHistoryResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.Versions, err = GetEditorials(*tx, q.TaskId)
+	return
+}
+
+type GetEditorialQuery struct {
+	UserId Id `json:"user_id"`
+	TaskId Id `json:"task_id"`
+}
+
+func (q GetEditorialQuery) Uid() Id {
+	return q.UserId
+}
+
+type GetEditorialResponse struct {
+	Editorial Editorial `json:"editorial"`
+}
+
+// GetEditorial returns the last version of the editorial of a task, once the
+// user solved the task or gave up on it
+func (s *Server) GetEditorial(ctx context.Context, q GetEditorialQuery) (r GetEditorialResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	editorials, err := GetEditorials(*tx, q.TaskId)
+	if err != nil {
+		return
+	}
+	if len(editorials) == 0 {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("task %d has no editorial", q.TaskId),
+		}
+		return
+	}
+	err = CheckEditorialAllowed(*tx, q.UserId, q.TaskId, s.GetTime())
+	if err != nil {
+		return
+	}
+	unlocked, err := IsEditorialUnlocked(*tx, q.UserId, q.TaskId)
+	if err != nil {
+		return
+	}
+	if !unlocked {
+		err = &OiaError{
+			HttpCode: http.StatusForbidden,
+			Message:  "the editorial is available after solving the task or giving up",
+		}
+		return
+	}
+	r.Editorial = editorials[0]
+	key := statementCacheKey(q.TaskId, []byte(r.Editorial.Content), "editorial")
+	html, ok := s.renderedStatements.get(key)
+	if !ok {
+		attachment_base := fmt.Sprintf("%s/task/attachment?task_id=%d&filename=", s.Config.PublicUrl, q.TaskId)
+		html, err = RenderStatement([]byte(r.Editorial.Content), attachment_base)
+		if err != nil {
+			return
+		}
+		s.renderedStatements.put(key, html)
+	}
+	r.Editorial.Html = string(html)
+	return
+}
+
+type GiveUpTaskQuery struct {
+	UserId Id `json:"user_id"`
+	TaskId Id `json:"task_id"`
+}
+
+func (q GiveUpTaskQuery) Uid() Id {
+	return q.UserId
+}
+
+type GiveUpTaskResponse struct{}
+
+// GiveUpTask unlocks the editorial of a task for the user. Giving up is
+// recorded, and shown next to the score of the user.
+func (s *Server) GiveUpTask(ctx context.Context, q GiveUpTaskQuery) (r GiveUpTaskResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	_, err = GetSingleTask(*tx, q.TaskId)
+	if store.IsNoRows(err) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("task %d not found", q.TaskId),
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = CheckEditorialAllowed(*tx, q.UserId, q.TaskId, s.GetTime())
+	if err != nil {
+		return
+	}
+	has_editorial, err := HasEditorial(*tx, q.TaskId)
+	if err != nil {
+		return
+	}
+	if !has_editorial {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("task %d has no editorial", q.TaskId),
+		}
+		return
+	}
+	// Users that already solved the task don't need to give up
+	solved, err := HasFullScore(*tx, q.UserId, q.TaskId)
+	if err != nil || solved {
+		return
+	}
+	err = SaveGiveUp(*tx, q.UserId, q.TaskId, s.GetTime())
+	return
+}
+
+// SaveEditorial adds a version of the editorial of a task, and returns its
+// number
+func SaveEditorial(tx store.Transaction, tid Id, content string, solutions []EditorialSolution) (version int64, err error) {
+	// Locks the task so concurrent saves don't get the same version
+	_, err = tx.Exec("SELECT id FROM oia_task WHERE id = $1 FOR UPDATE", tid)
+	if err != nil {
+		return
+	}
+	row := tx.QueryRow(`
+		INSERT INTO oia_editorial(task_id, version, content)
+		VALUES ($1, (SELECT COALESCE(MAX(version), 0) + 1 FROM oia_editorial WHERE task_id = $1), $2)
+		RETURNING version`, tid, content)
+	err = row.Scan(&version)
+	if err != nil {
+		return
+	}
+	for _, solution := range solutions {
+		_, err = tx.Exec(`
+			INSERT INTO oia_editorial_solution(task_id, version, language, filename, source)
+			VALUES ($1, $2, $3, $4, $5)`,
+			tid, version, solution.Language, solution.Filename, solution.Source)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// GetEditorials returns every version of the editorial of a task, newest
+// first
+func GetEditorials(tx store.Transaction, tid Id) (editorials []Editorial, err error) {
+	rows, err := tx.Query(`
+		SELECT task_id, version, content, created_at
+		FROM oia_editorial
+		WHERE task_id = $1
+		ORDER BY version DESC`, tid)
+	if err != nil {
+		return
+	}
+	editorials = make([]Editorial, 0)
+	by_version := make(map[int64]int)
+	for rows.Next() {
+		var editorial Editorial
+		err = rows.Scan(&editorial.TaskId, &editorial.Version, &editorial.Content, &editorial.CreatedAt)
+		if err != nil {
+			return
+		}
+		editorial.Solutions = make([]EditorialSolution, 0)
+		by_version[editorial.Version] = len(editorials)
+		editorials = append(editorials, editorial)
+	}
+	rows, err = tx.Query(`
+		SELECT version, language, filename, source
+		FROM oia_editorial_solution
+		WHERE task_id = $1
+		ORDER BY language`, tid)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var version int64
+		var solution EditorialSolution
+		err = rows.Scan(&version, &solution.Language, &solution.Filename, &solution.Source)
+		if err != nil {
+			return
+		}
+		i := by_version[version]
+		editorials[i].Solutions = append(editorials[i].Solutions, solution)
+	}
+	return
+}
+
+func HasEditorial(tx store.Transaction, tid Id) (exists bool, err error) {
+	row := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM oia_editorial WHERE task_id = $1)", tid)
+	err = row.Scan(&exists)
+	return
+}
+
+// HasFullScore returns whether the user got the max score of the task
+func HasFullScore(tx store.Transaction, uid Id, tid Id) (solved bool, err error) {
+	row := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM oia_task_score
+				INNER JOIN oia_task ON oia_task.id = oia_task_score.task_id
+			WHERE user_id = $1 AND task_id = $2
+				-- Scores are stored as REAL
+				AND base_score >= oia_task.max_score - 1e-3
+		)`, uid, tid)
+	err = row.Scan(&solved)
+	return
+}
+
+func IsEditorialUnlocked(tx store.Transaction, uid Id, tid Id) (unlocked bool, err error) {
+	unlocked, err = HasFullScore(tx, uid, tid)
+	if err != nil || unlocked {
+		return
+	}
+	row := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM oia_task_give_up WHERE user_id = $1 AND task_id = $2)", uid, tid)
+	err = row.Scan(&unlocked)
+	return
+}
+
+// CheckEditorialAllowed rejects requests for the editorial of tasks of
+// contests that haven't ended, or of the virtual contest the user is taking
+func CheckEditorialAllowed(tx store.Transaction, uid Id, tid Id, now time.Time) (err error) {
+	contests, err := GetContests(tx, `
+		SELECT id, name, task_ids, start_time, end_time, freeze_time FROM oia_contest
+		WHERE $1 = ANY(task_ids) AND end_time > $2
+		ORDER BY start_time`, tid, now)
+	if err != nil {
+		return
+	}
+	if len(contests) > 0 {
+		err = &OiaError{
+			HttpCode: http.StatusForbidden,
+			Message:  fmt.Sprintf("task %d is part of contest `%s`, its editorial is available after %s", tid, contests[0].Name, contests[0].EndTime.Format(time.RFC3339)),
+		}
+		return
+	}
+	virtual_contest, err := GetActiveVirtualContest(tx, uid, now)
+	if err != nil || virtual_contest == nil {
+		return
+	}
+	for _, contest_task := range virtual_contest.Tasks {
+		if contest_task == tid {
+			err = &OiaError{
+				HttpCode: http.StatusForbidden,
+				Message:  fmt.Sprintf("task %d is part of your virtual contest, its editorial is available after %s", tid, virtual_contest.EndTime.Format(time.RFC3339)),
+			}
+			return
+		}
+	}
+	return
+}
+
+func SaveGiveUp(tx store.Transaction, uid Id, tid Id, now time.Time) (err error) {
+	_, err = tx.Exec(`
+		INSERT INTO oia_task_give_up(user_id, task_id, given_up_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, uid, tid, now)
+	return
+}
+
+// GetTaskGiveUps returns, for each user, which of the tasks they gave up on
+func GetTaskGiveUps(tx store.Transaction, tids []Id) (gave_up map[Id]map[Id]bool, err error) {
+	rows, err := tx.Query("SELECT user_id, task_id FROM oia_task_give_up WHERE task_id = ANY($1)", tids)
+	if err != nil {
+		return
+	}
+	gave_up = make(map[Id]map[Id]bool)
+	for rows.Next() {
+		var uid, tid Id
+		err = rows.Scan(&uid, &tid)
+		if err != nil {
+			return
+		}
+		if gave_up[uid] == nil {
+			gave_up[uid] = make(map[Id]bool)
+		}
+		gave_up[uid][tid] = true
+	}
+	return
+}
+
+// GetGiveUps returns the tasks a user gave up on
+func GetGiveUps(tx store.Transaction, uid Id) (tids []Id, err error) {
+	rows, err := tx.Query("SELECT task_id FROM oia_task_give_up WHERE user_id = $1 ORDER BY task_id", uid)
+	if err != nil {
+		return
+	}
+	tids = make([]Id, 0)
+	for rows.Next() {
+		var tid Id
+		err = rows.Scan(&tid)
+		if err != nil {
+			return
+		}
+		tids = append(tids, tid)
+	}
+	return
+}
@@ -0,0 +1,101 @@
+package oiajudge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+const DefaultDeadEventsLimit = 100
+
+type GetDeadEventsQuery struct {
+	Limit int64 `json:"limit"`
+}
+
+type GetDeadEventsResponse struct {
+	Events []bridge.DeadEvent `json:"events"`
+}
+
+func (s *Server) GetDeadEvents(ctx context.Context, q GetDeadEventsQuery) (r GetDeadEventsResponse, err error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultDeadEventsLimit
+	}
+	r.Events, err = s.Bridge.GetDeadEvents(ctx, limit)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type DeadEventQuery struct {
+	Id Id `json:"id"`
+}
+
+type GetDeadEventResponse struct {
+	Event bridge.DeadEvent `json:"event"`
+}
+
+func (s *Server) GetDeadEvent(ctx context.Context, q DeadEventQuery) (r GetDeadEventResponse, err error) {
+	event, err := s.Bridge.GetDeadEvent(ctx, q.Id)
+	if store.IsNoRows(err) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("dead event %d not found", q.Id),
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	r.Event = *event
+	return
+}
+
+type DeadEventResponse struct{}
+
+func (s *Server) ReplayDeadEvent(ctx context.Context, q DeadEventQuery) (r DeadEventResponse, err error) {
+	err = s.Bridge.ReplayDeadEvent(ctx, q.Id)
+	if store.IsNoRows(err) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("dead event %d not found", q.Id),
+		}
+		return
+	}
+	return
+}
+
+func (s *Server) DiscardDeadEvent(ctx context.Context, q DeadEventQuery) (r DeadEventResponse, err error) {
+	err = s.Bridge.DiscardDeadEvent(ctx, q.Id)
+	if store.IsNoRows(err) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("dead event %d not found", q.Id),
+		}
+		return
+	}
+	return
+}
+
+type GetEventStatsQuery struct{}
+
+type GetEventStatsResponse struct {
+	Queue bridge.EventStats `json:"queue"`
+	// Submission events that were skipped since the server started, because
+	// the submission didn't change
+	UnchangedSubmissions int64 `json:"unchanged_submissions"`
+}
+
+func (s *Server) GetEventStats(ctx context.Context, q GetEventStatsQuery) (r GetEventStatsResponse, err error) {
+	stats, err := s.Bridge.GetEventStats(ctx)
+	if err != nil {
+		return
+	}
+	r.Queue = *stats
+	r.UnchangedSubmissions = s.UnchangedSubmissions.Load()
+	return
+}
@@ -0,0 +1,602 @@
+package oiajudge
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+type GroupAssignment struct {
+	Id    Id     `json:"id"`
+	Title string `json:"title"`
+	Tasks []Id   `json:"tasks"`
+	// Assignments without a deadline are open indefinitely
+	Deadline *time.Time `json:"deadline"`
+}
+
+type Group struct {
+	Id      Id     `json:"id"`
+	Name    string `json:"name"`
+	OwnerId Id     `json:"owner_id"`
+	// Only visible to the owner of the group
+	InviteCode  string            `json:"invite_code,omitempty"`
+	Assignments []GroupAssignment `json:"assignments"`
+}
+
+type GetGroupsQuery struct {
+	UserId Id `json:"user_id"`
+}
+
+func (q GetGroupsQuery) Uid() Id {
+	return q.UserId
+}
+
+type GetGroupsResponse struct {
+	// Groups owned by the user
+	Owned []Group `json:"owned"`
+	// Groups the user is a member of
+	Joined []Group `json:"joined"`
+}
+
+func (s *Server) GetGroups(ctx context.Context, q GetGroupsQuery) (r GetGroupsResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.Owned, err = GetGroups(*tx, "SELECT id, name, owner_id, invite_code FROM oia_group WHERE owner_id = $1 ORDER BY id", q.UserId)
+	if err != nil {
+		return
+	}
+	r.Joined, err = GetGroups(*tx, `
+		SELECT id, name, owner_id, '' FROM oia_group
+		WHERE id IN (SELECT group_id FROM oia_group_member WHERE user_id = $1)
+		ORDER BY id`, q.UserId)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type CreateGroupQuery struct {
+	UserId Id     `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+func (q CreateGroupQuery) Uid() Id {
+	return q.UserId
+}
+
+type CreateGroupResponse struct {
+	GroupId    Id     `json:"group_id"`
+	InviteCode string `json:"invite_code"`
+}
+
+func (s *Server) CreateGroup(ctx context.Context, q CreateGroupQuery) (r CreateGroupResponse, err error) {
+	if strings.TrimSpace(q.Name) == "" {
+		err = &OiaError{
+			HttpCode: http.StatusBadRequest,
+			Message:  "group name is required",
+		}
+		return
+	}
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.InviteCode, err = MakeInviteCode()
+	if err != nil {
+		return
+	}
+	row := tx.QueryRow("INSERT INTO oia_group(name, owner_id, invite_code) VALUES ($1, $2, $3) RETURNING id",
+		q.Name, q.UserId, r.InviteCode)
+	err = row.Scan(&r.GroupId)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type JoinGroupQuery struct {
+	UserId     Id     `json:"user_id"`
+	InviteCode string `json:"invite_code"`
+}
+
+func (q JoinGroupQuery) Uid() Id {
+	return q.UserId
+}
+
+type JoinGroupResponse struct {
+	GroupId Id `json:"group_id"`
+}
+
+func (s *Server) JoinGroup(ctx context.Context, q JoinGroupQuery) (r JoinGroupResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	row := tx.QueryRow("SELECT id FROM oia_group WHERE invite_code = $1", strings.ToUpper(strings.TrimSpace(q.InviteCode)))
+	err = row.Scan(&r.GroupId)
+	if store.IsNoRows(err) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  "invalid invite code",
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("INSERT INTO oia_group_member(group_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", r.GroupId, q.UserId)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type LeaveGroupQuery struct {
+	UserId  Id `json:"user_id"`
+	GroupId Id `json:"group_id"`
+}
+
+func (q LeaveGroupQuery) Uid() Id {
+	return q.UserId
+}
+
+type LeaveGroupResponse struct{}
+
+func (s *Server) LeaveGroup(ctx context.Context, q LeaveGroupQuery) (r LeaveGroupResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	_, err = tx.Exec("DELETE FROM oia_group_member WHERE group_id = $1 AND user_id = $2", q.GroupId, q.UserId)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type CreateGroupAssignmentQuery struct {
+	UserId     Id              `json:"user_id"`
+	GroupId    Id              `json:"group_id"`
+	Assignment GroupAssignment `json:"assignment"`
+}
+
+func (q CreateGroupAssignmentQuery) Uid() Id {
+	return q.UserId
+}
+
+type CreateGroupAssignmentResponse struct {
+	AssignmentId Id `json:"assignment_id"`
+}
+
+func (s *Server) CreateGroupAssignment(ctx context.Context, q CreateGroupAssignmentQuery) (r CreateGroupAssignmentResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = CheckGroupOwner(*tx, q.GroupId, q.UserId)
+	if err != nil {
+		return
+	}
+	tasks, err := GetTasks(*tx)
+	if err != nil {
+		return
+	}
+	task_exists := make(map[Id]bool)
+	for _, task := range tasks {
+		task_exists[task.Id] = true
+	}
+	for _, tid := range q.Assignment.Tasks {
+		if !task_exists[tid] {
+			err = &OiaError{
+				HttpCode: http.StatusBadRequest,
+				Message:  fmt.Sprintf("unknown task %d", tid),
+			}
+			return
+		}
+	}
+	if q.Assignment.Tasks == nil {
+		q.Assignment.Tasks = []Id{}
+	}
+	row := tx.QueryRow("INSERT INTO oia_group_assignment(group_id, title, task_ids, deadline) VALUES ($1, $2, $3, $4) RETURNING id",
+		q.GroupId, q.Assignment.Title, q.Assignment.Tasks, q.Assignment.Deadline)
+	err = row.Scan(&r.AssignmentId)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type DeleteGroupAssignmentQuery struct {
+	UserId       Id `json:"user_id"`
+	GroupId      Id `json:"group_id"`
+	AssignmentId Id `json:"assignment_id"`
+}
+
+func (q DeleteGroupAssignmentQuery) Uid() Id {
+	return q.UserId
+}
+
+type DeleteGroupAssignmentResponse struct{}
+
+func (s *Server) DeleteGroupAssignment(ctx context.Context, q DeleteGroupAssignmentQuery) (r DeleteGroupAssignmentResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = CheckGroupOwner(*tx, q.GroupId, q.UserId)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("DELETE FROM oia_group_assignment WHERE id = $1 AND group_id = $2", q.AssignmentId, q.GroupId)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type GetGroupDashboardQuery struct {
+	UserId  Id `json:"user_id"`
+	GroupId Id `json:"group_id"`
+}
+
+func (q GetGroupDashboardQuery) Uid() Id {
+	return q.UserId
+}
+
+type GroupDashboardCell struct {
+	TaskId Id `json:"task_id"`
+	// Score and submissions up to the deadline of the task
+	Score          float64    `json:"score"`
+	Submissions    int64      `json:"submissions"`
+	LastSubmission *time.Time `json:"last_submission"`
+	// Score counting the submissions after the deadline too, and how many
+	// of them there are
+	LateScore       float64 `json:"late_score"`
+	LateSubmissions int64   `json:"late_submissions"`
+	// The user saw the editorial before solving the task
+	GaveUp bool `json:"gave_up"`
+}
+
+type GroupDashboardRow struct {
+	UserId   Id     `json:"user_id"`
+	Username string `json:"username"`
+	// Last submission to any task, not only the assigned ones
+	LastActivity *time.Time           `json:"last_activity"`
+	Cells        []GroupDashboardCell `json:"cells"`
+}
+
+type GroupDashboard struct {
+	Group Group `json:"group"`
+	// Columns of the grid, every task of every assignment in order
+	Tasks []Id `json:"tasks"`
+	// Deadline of each column, the latest one if the task is in many
+	// assignments. nil when any of them is open indefinitely
+	Deadlines []*time.Time        `json:"deadlines"`
+	Members   []GroupDashboardRow `json:"members"`
+}
+
+type GetGroupDashboardResponse struct {
+	Dashboard GroupDashboard `json:"dashboard"`
+}
+
+func (s *Server) GetGroupDashboard(ctx context.Context, q GetGroupDashboardQuery) (r GetGroupDashboardResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = CheckGroupOwner(*tx, q.GroupId, q.UserId)
+	if err != nil {
+		return
+	}
+	r.Dashboard, err = GetGroupDashboard(*tx, q.GroupId, s.GetTime())
+	if err != nil {
+		return
+	}
+	return
+}
+
+func ServeGroupDashboardCsv(w http.ResponseWriter, r *http.Request, server *Server) {
+	uid, err := strconv.ParseInt(r.URL.Query().Get("user_id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("user_id must be an integer"))
+		return
+	}
+	gid, err := strconv.ParseInt(r.URL.Query().Get("group_id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("group_id must be an integer"))
+		return
+	}
+	err = AuthenticateUser(server, r, uid)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	resp, err := server.GetGroupDashboard(r.Context(), GetGroupDashboardQuery{UserId: uid, GroupId: gid})
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	tasks, err := server.GetTasks(r.Context(), GetTasksQuery{})
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	names := make(map[Id]string)
+	for _, task := range tasks.Tasks {
+		names[task.Id] = task.Name
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"group-%d.csv\"", gid))
+	writer := csv.NewWriter(w)
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	header := []string{"username", "last_activity"}
+	for _, tid := range resp.Dashboard.Tasks {
+		name := names[tid]
+		header = append(header, name+" score", name+" submissions", name+" last_submission",
+			name+" late_score", name+" late_submissions")
+	}
+	writer.Write(header)
+	for _, member := range resp.Dashboard.Members {
+		line := []string{member.Username, formatTime(member.LastActivity)}
+		for _, cell := range member.Cells {
+			line = append(line,
+				strconv.FormatFloat(cell.Score, 'f', -1, 64),
+				strconv.FormatInt(cell.Submissions, 10),
+				formatTime(cell.LastSubmission),
+				strconv.FormatFloat(cell.LateScore, 'f', -1, 64),
+				strconv.FormatInt(cell.LateSubmissions, 10))
+		}
+		writer.Write(line)
+	}
+	writer.Flush()
+}
+
+func MakeInviteCode() (string, error) {
+	secret := make([]byte, 5)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(secret), nil
+}
+
+func CheckGroupOwner(tx store.Transaction, gid Id, uid Id) error {
+	row := tx.QueryRow("SELECT owner_id FROM oia_group WHERE id = $1", gid)
+	var owner Id
+	err := row.Scan(&owner)
+	if store.IsNoRows(err) {
+		return &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("group %d not found", gid),
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if owner != uid {
+		return &OiaError{
+			HttpCode: http.StatusForbidden,
+			Message:  "only the owner of the group can do this",
+		}
+	}
+	return nil
+}
+
+// GetGroups runs a query returning (id, name, owner_id, invite_code) for a
+// user and fills the assignments of every group.
+func GetGroups(tx store.Transaction, query string, uid Id) (groups []Group, err error) {
+	rows, err := tx.Query(query, uid)
+	if err != nil {
+		return
+	}
+	groups = make([]Group, 0)
+	for rows.Next() {
+		var group Group
+		err = rows.Scan(&group.Id, &group.Name, &group.OwnerId, &group.InviteCode)
+		if err != nil {
+			return
+		}
+		groups = append(groups, group)
+	}
+	for i := range groups {
+		groups[i].Assignments, err = GetGroupAssignments(tx, groups[i].Id)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func GetGroupAssignments(tx store.Transaction, gid Id) (assignments []GroupAssignment, err error) {
+	rows, err := tx.Query("SELECT id, title, task_ids, deadline FROM oia_group_assignment WHERE group_id = $1 ORDER BY id", gid)
+	if err != nil {
+		return
+	}
+	assignments = make([]GroupAssignment, 0)
+	for rows.Next() {
+		var assignment GroupAssignment
+		err = rows.Scan(&assignment.Id, &assignment.Title, &assignment.Tasks, &assignment.Deadline)
+		if err != nil {
+			return
+		}
+		assignments = append(assignments, assignment)
+	}
+	return
+}
+
+func GetGroupDashboard(tx store.Transaction, gid Id, now time.Time) (dashboard GroupDashboard, err error) {
+	row := tx.QueryRow("SELECT id, name, owner_id, invite_code FROM oia_group WHERE id = $1", gid)
+	err = row.Scan(&dashboard.Group.Id, &dashboard.Group.Name, &dashboard.Group.OwnerId, &dashboard.Group.InviteCode)
+	if err != nil {
+		return
+	}
+	dashboard.Group.Assignments, err = GetGroupAssignments(tx, gid)
+	if err != nil {
+		return
+	}
+
+	dashboard.Tasks = make([]Id, 0)
+	dashboard.Deadlines = make([]*time.Time, 0)
+	column := make(map[Id]int)
+	for _, assignment := range dashboard.Group.Assignments {
+		for _, tid := range assignment.Tasks {
+			i, ok := column[tid]
+			if !ok {
+				column[tid] = len(dashboard.Tasks)
+				dashboard.Tasks = append(dashboard.Tasks, tid)
+				dashboard.Deadlines = append(dashboard.Deadlines, assignment.Deadline)
+				continue
+			}
+			deadline := dashboard.Deadlines[i]
+			if assignment.Deadline == nil || (deadline != nil && assignment.Deadline.After(*deadline)) {
+				dashboard.Deadlines[i] = assignment.Deadline
+			}
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT oia_user.id, oia_user.username
+		FROM oia_group_member
+			INNER JOIN oia_user ON oia_user.id = oia_group_member.user_id
+		WHERE oia_group_member.group_id = $1
+		ORDER BY oia_user.username`, gid)
+	if err != nil {
+		return
+	}
+	dashboard.Members = make([]GroupDashboardRow, 0)
+	member_row := make(map[Id]int)
+	uids := make([]Id, 0)
+	for rows.Next() {
+		var member GroupDashboardRow
+		err = rows.Scan(&member.UserId, &member.Username)
+		if err != nil {
+			return
+		}
+		member.Cells = make([]GroupDashboardCell, len(dashboard.Tasks))
+		for i, tid := range dashboard.Tasks {
+			member.Cells[i].TaskId = tid
+		}
+		member_row[member.UserId] = len(dashboard.Members)
+		uids = append(uids, member.UserId)
+		dashboard.Members = append(dashboard.Members, member)
+	}
+
+	rows, err = tx.Query(`
+		SELECT user_id, MAX((details::jsonb->>'timestamp')::timestamptz)
+		FROM oia_submissions
+		WHERE user_id = ANY($1)
+		GROUP BY user_id`, uids)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var uid Id
+		var last *time.Time
+		err = rows.Scan(&uid, &last)
+		if err != nil {
+			return
+		}
+		dashboard.Members[member_row[uid]].LastActivity = last
+	}
+
+	// Submissions after the deadline don't count for the score, so it is
+	// calculated here instead of using oia_task_score. Submissions made
+	// during the freeze of a contest are left out until it ends.
+	frozen, err := GetFrozenSubmissions(tx, now)
+	if err != nil {
+		return
+	}
+	rows, err = tx.Query(`
+		SELECT id, user_id, task_id, (details::jsonb->>'timestamp')::timestamptz, subtask_details
+		FROM oia_submissions
+		WHERE user_id = ANY($1) AND task_id = ANY($2)`, uids, dashboard.Tasks)
+	if err != nil {
+		return
+	}
+	type cellScores struct {
+		on_time [][]float64
+		all     [][]float64
+	}
+	scores := make(map[*GroupDashboardCell]*cellScores)
+	for rows.Next() {
+		var sid, uid, tid Id
+		var timestamp *time.Time
+		var subtask_details *string
+		err = rows.Scan(&sid, &uid, &tid, &timestamp, &subtask_details)
+		if err != nil {
+			return
+		}
+		var subtasks []float64
+		if subtask_details != nil {
+			err = json.Unmarshal([]byte(*subtask_details), &subtasks)
+			if err != nil {
+				return
+			}
+		}
+		if _, ok := frozen[sid]; ok {
+			continue
+		}
+		i := column[tid]
+		cell := &dashboard.Members[member_row[uid]].Cells[i]
+		if scores[cell] == nil {
+			scores[cell] = &cellScores{}
+		}
+		scores[cell].all = append(scores[cell].all, subtasks)
+		deadline := dashboard.Deadlines[i]
+		if deadline != nil && (timestamp == nil || timestamp.After(*deadline)) {
+			cell.LateSubmissions++
+			continue
+		}
+		scores[cell].on_time = append(scores[cell].on_time, subtasks)
+		cell.Submissions++
+		if timestamp != nil && (cell.LastSubmission == nil || timestamp.After(*cell.LastSubmission)) {
+			cell.LastSubmission = timestamp
+		}
+	}
+	for cell, cell_scores := range scores {
+		cell.Score = BestSubtaskScore(cell_scores.on_time)
+		cell.LateScore = BestSubtaskScore(cell_scores.all)
+	}
+
+	rows, err = tx.Query(`
+		SELECT user_id, task_id FROM oia_task_give_up
+		WHERE user_id = ANY($1) AND task_id = ANY($2)`, uids, dashboard.Tasks)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var uid, tid Id
+		err = rows.Scan(&uid, &tid)
+		if err != nil {
+			return
+		}
+		dashboard.Members[member_row[uid]].Cells[column[tid]].GaveUp = true
+	}
+	return
+}
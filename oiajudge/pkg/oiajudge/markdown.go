@@ -0,0 +1,274 @@
+package oiajudge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Statements are rendered to HTML fragments, so they can be embedded in the
+// task page. Math is left as TeX inside
+//
+//	<span class="math inline">\(...\)</span>
+//	<span class="math display">\[...\]</span>
+//
+// for the frontend to typeset, and sample cases are written as
+//
+//	```sample
+//	input
+//	---
+//	output
+//	```
+//
+// which is rendered as
+//
+//	<div class="sample"><pre class="sample-input">...</pre><pre class="sample-output">...</pre></div>
+
+var KindMath = ast.NewNodeKind("Math")
+
+// mathNode is TeX between $ or $$. ```math blocks are also display math.
+type mathNode struct {
+	ast.BaseInline
+	Display bool
+	Tex     []byte
+}
+
+func (n *mathNode) Kind() ast.NodeKind {
+	return KindMath
+}
+
+func (n *mathNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Tex": string(n.Tex)}, nil)
+}
+
+type mathParser struct{}
+
+func (p mathParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+// Parse reads math that starts and ends in the same line. Like in pandoc,
+// inline math can't start or end with a space, so prices like $5 and $10
+// are left alone.
+func (p mathParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	delimiter := []byte("$")
+	if bytes.HasPrefix(line, []byte("$$")) {
+		delimiter = []byte("$$")
+	}
+	rest := line[len(delimiter):]
+	end := -1
+	for i := 0; i+len(delimiter) <= len(rest); i++ {
+		if rest[i] == '\\' {
+			i++
+			continue
+		}
+		if bytes.HasPrefix(rest[i:], delimiter) {
+			end = i
+			break
+		}
+	}
+	if end <= 0 {
+		return nil
+	}
+	tex := rest[:end]
+	display := len(delimiter) == 2
+	if !display && (tex[0] == ' ' || tex[len(tex)-1] == ' ') {
+		return nil
+	}
+	block.Advance(len(delimiter) + end + len(delimiter))
+	return &mathNode{Display: display, Tex: append([]byte{}, tex...)}
+}
+
+type statementHTMLRenderer struct {
+	html.Config
+}
+
+func (r *statementHTMLRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindMath, r.renderMath)
+	reg.Register(ast.KindFencedCodeBlock, r.renderFencedCodeBlock)
+}
+
+func writeMath(w util.BufWriter, tex []byte, display bool) {
+	if display {
+		_, _ = w.WriteString(`<span class="math display">\[`)
+		_, _ = w.Write(util.EscapeHTML(tex))
+		_, _ = w.WriteString(`\]</span>`)
+	} else {
+		_, _ = w.WriteString(`<span class="math inline">\(`)
+		_, _ = w.Write(util.EscapeHTML(tex))
+		_, _ = w.WriteString(`\)</span>`)
+	}
+}
+
+func (r *statementHTMLRenderer) renderMath(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*mathNode)
+		writeMath(w, n.Tex, n.Display)
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+var sampleSeparator = regexp.MustCompile(`(?m)^-{3,}[ \t]*\n`)
+
+func (r *statementHTMLRenderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.FencedCodeBlock)
+	var content []byte
+	for i := 0; i < n.Lines().Len(); i++ {
+		line := n.Lines().At(i)
+		content = append(content, line.Value(source)...)
+	}
+	switch string(n.Language(source)) {
+	case "math":
+		_, _ = w.WriteString("<p>")
+		writeMath(w, bytes.TrimSpace(content), true)
+		_, _ = w.WriteString("</p>\n")
+	case "sample":
+		parts := sampleSeparator.Split(string(content), 2)
+		_, _ = w.WriteString(`<div class="sample"><pre class="sample-input">`)
+		_, _ = w.Write(util.EscapeHTML([]byte(parts[0])))
+		_, _ = w.WriteString(`</pre>`)
+		if len(parts) == 2 {
+			_, _ = w.WriteString(`<pre class="sample-output">`)
+			_, _ = w.Write(util.EscapeHTML([]byte(parts[1])))
+			_, _ = w.WriteString(`</pre>`)
+		}
+		_, _ = w.WriteString("</div>\n")
+	default:
+		_, _ = w.WriteString("<pre><code")
+		if language := n.Language(source); language != nil {
+			_, _ = w.WriteString(` class="language-`)
+			_, _ = w.Write(util.EscapeHTML(language))
+			_, _ = w.WriteString(`"`)
+		}
+		_, _ = w.WriteString(">")
+		_, _ = w.Write(util.EscapeHTML(content))
+		_, _ = w.WriteString("</code></pre>\n")
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+type statementExtension struct{}
+
+func (e statementExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithInlineParsers(util.Prioritized(mathParser{}, 150)),
+		parser.WithASTTransformers(util.Prioritized(attachmentImages{}, 100)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&statementHTMLRenderer{Config: html.NewConfig()}, 100),
+	))
+}
+
+var attachmentBaseKey = parser.NewContextKey()
+
+// attachmentImages makes images with a relative path point to the
+// attachments of the task, e.g. ![](figure.png) shows the attachment
+// figure.png
+type attachmentImages struct{}
+
+func (t attachmentImages) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	base, ok := pc.Get(attachmentBaseKey).(string)
+	if !ok {
+		return
+	}
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		image, ok := node.(*ast.Image)
+		if !entering || !ok {
+			return ast.WalkContinue, nil
+		}
+		destination := string(image.Destination)
+		parsed, err := url.Parse(destination)
+		if err != nil || parsed.IsAbs() || parsed.Host != "" || strings.HasPrefix(destination, "/") || destination == "" {
+			return ast.WalkContinue, nil
+		}
+		image.Destination = []byte(base + url.QueryEscape(parsed.Path))
+		return ast.WalkContinue, nil
+	})
+}
+
+var statementMarkdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, statementExtension{}),
+	// Raw HTML is allowed since the output is sanitized anyway
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+var statementPolicy = func() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^math (inline|display)$`)).OnElements("span")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^sample$`)).OnElements("div")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^sample-(input|output)$`)).OnElements("pre")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+	return policy
+}()
+
+// RenderStatement renders a Markdown statement to sanitized HTML. Images
+// are served from the attachments of the task, under attachment_base, e.g.
+// /task/attachment?task_id=1&filename=
+func RenderStatement(markdown []byte, attachment_base string) (rendered []byte, err error) {
+	var buf bytes.Buffer
+	pc := parser.NewContext()
+	pc.Set(attachmentBaseKey, attachment_base)
+	err = statementMarkdown.Convert(markdown, &buf, parser.WithContext(pc))
+	if err != nil {
+		return
+	}
+	rendered = statementPolicy.SanitizeBytes(buf.Bytes())
+	return
+}
+
+// SanitizeStatement cleans up a statement that is already HTML
+func SanitizeStatement(statement []byte) []byte {
+	return statementPolicy.SanitizeBytes(statement)
+}
+
+// Rendered statements only change when the statement does, so they are kept
+// until there are too many of them
+const MaxCachedStatements = 512
+
+type statementCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte][]byte
+}
+
+func (c *statementCache) get(key [sha256.Size]byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rendered, ok := c.entries[key]
+	return rendered, ok
+}
+
+func (c *statementCache) put(key [sha256.Size]byte, rendered []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= MaxCachedStatements {
+		c.entries = make(map[[sha256.Size]byte][]byte)
+	}
+	c.entries[key] = rendered
+}
+
+func statementCacheKey(tid Id, statement []byte, format string) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00", tid, format)
+	h.Write(statement)
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS oia_problem_list (
+    id BIGSERIAL PRIMARY KEY,
+    title TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    -- Tasks in the order they should be solved
+    task_ids BIGINT[] NOT NULL DEFAULT ARRAY[]::BIGINT[],
+    -- Lists that should be completed before this one
+    prerequisites BIGINT[] NOT NULL DEFAULT ARRAY[]::BIGINT[]
+)
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS oia_group (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    owner_id BIGINT NOT NULL,
+    invite_code TEXT NOT NULL UNIQUE,
+    CONSTRAINT fk_owner_id
+        FOREIGN KEY(owner_id)
+            REFERENCES oia_user(id)
+)
+
+;;
+
+CREATE TABLE IF NOT EXISTS oia_group_member (
+    group_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    PRIMARY KEY (group_id, user_id),
+    CONSTRAINT fk_group_id
+        FOREIGN KEY(group_id)
+            REFERENCES oia_group(id)
+            ON DELETE CASCADE,
+    CONSTRAINT fk_user_id
+        FOREIGN KEY(user_id)
+            REFERENCES oia_user(id)
+)
+
+;;
+
+CREATE TABLE IF NOT EXISTS oia_group_assignment (
+    id BIGSERIAL PRIMARY KEY,
+    group_id BIGINT NOT NULL,
+    title TEXT NOT NULL,
+    task_ids BIGINT[] NOT NULL DEFAULT ARRAY[]::BIGINT[],
+    deadline TIMESTAMPTZ,
+    CONSTRAINT fk_group_id
+        FOREIGN KEY(group_id)
+            REFERENCES oia_group(id)
+            ON DELETE CASCADE
+)
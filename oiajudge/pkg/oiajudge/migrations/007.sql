@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS oia_virtual_contest (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    -- Edition being replayed, like `2023/selectivo`
+    name TEXT NOT NULL,
+    task_ids BIGINT[] NOT NULL,
+    start_time TIMESTAMPTZ NOT NULL,
+    end_time TIMESTAMPTZ NOT NULL,
+    CONSTRAINT fk_user_id
+        FOREIGN KEY(user_id)
+            REFERENCES oia_user(id)
+)
+
+;;
+
+CREATE TABLE IF NOT EXISTS oia_virtual_submission (
+    submission_id BIGINT PRIMARY KEY,
+    contest_id BIGINT NOT NULL,
+    -- The submission might not have reached oia_submissions yet
+    task_id BIGINT NOT NULL,
+    submitted_at TIMESTAMPTZ NOT NULL,
+    CONSTRAINT fk_contest_id
+        FOREIGN KEY(contest_id)
+            REFERENCES oia_virtual_contest(id)
+            ON DELETE CASCADE
+)
+
+;;
+
+-- Results of the real contest, imported by the admins
+CREATE TABLE IF NOT EXISTS oia_historic_result (
+    name TEXT NOT NULL,
+    contestant TEXT NOT NULL,
+    total REAL NOT NULL,
+    -- JSON object from task name to score
+    task_scores TEXT NOT NULL,
+    PRIMARY KEY (name, contestant)
+)
@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS oia_contest (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    task_ids BIGINT[] NOT NULL DEFAULT ARRAY[]::BIGINT[],
+    start_time TIMESTAMPTZ NOT NULL,
+    end_time TIMESTAMPTZ NOT NULL,
+    -- The scoreboard doesn't show submissions made after this time until the
+    -- contest ends. NULL if the scoreboard is never frozen
+    freeze_time TIMESTAMPTZ
+)
+
+;;
+
+CREATE TABLE IF NOT EXISTS oia_contest_participant (
+    contest_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    PRIMARY KEY (contest_id, user_id),
+    CONSTRAINT fk_contest_id
+        FOREIGN KEY(contest_id)
+            REFERENCES oia_contest(id)
+            ON DELETE CASCADE,
+    CONSTRAINT fk_user_id
+        FOREIGN KEY(user_id)
+            REFERENCES oia_user(id)
+)
+
+;;
+
+CREATE TABLE IF NOT EXISTS oia_contest_submission (
+    submission_id BIGINT PRIMARY KEY,
+    contest_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    task_id BIGINT NOT NULL,
+    submitted_at TIMESTAMPTZ NOT NULL,
+    CONSTRAINT fk_contest_id
+        FOREIGN KEY(contest_id)
+            REFERENCES oia_contest(id)
+            ON DELETE CASCADE
+)
@@ -0,0 +1,3 @@
+-- Tasks deleted in CMS are hidden instead of removed, so their submissions
+-- are kept, and they can be restored if they reappear
+ALTER TABLE oia_task ADD COLUMN IF NOT EXISTS deleted BOOLEAN NOT NULL DEFAULT false
@@ -0,0 +1,4 @@
+-- In seconds and bytes, 0 if there is no limit
+ALTER TABLE oia_task ADD COLUMN IF NOT EXISTS time_limit REAL NOT NULL DEFAULT 0;;
+
+ALTER TABLE oia_task ADD COLUMN IF NOT EXISTS memory_limit BIGINT NOT NULL DEFAULT 0
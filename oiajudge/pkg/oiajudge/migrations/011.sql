@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS oia_rejudge (
+    id BIGSERIAL PRIMARY KEY,
+    -- submission, task or user
+    kind TEXT NOT NULL,
+    target_id BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)
+
+;;
+
+CREATE TABLE IF NOT EXISTS oia_rejudge_submission (
+    rejudge_id BIGINT NOT NULL,
+    submission_id BIGINT NOT NULL,
+    -- Set when the submission is scored again
+    done BOOLEAN NOT NULL DEFAULT false,
+    PRIMARY KEY (rejudge_id, submission_id),
+    CONSTRAINT fk_rejudge_id
+        FOREIGN KEY(rejudge_id)
+            REFERENCES oia_rejudge(id)
+)
+
+;;
+
+CREATE INDEX IF NOT EXISTS oia_rejudge_submission_pending
+    ON oia_rejudge_submission(submission_id)
+    WHERE NOT done
+
+;;
+
+-- Scores of the affected users before the rejudge
+CREATE TABLE IF NOT EXISTS oia_rejudge_score (
+    rejudge_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    task_id BIGINT NOT NULL,
+    score REAL NOT NULL,
+    PRIMARY KEY (rejudge_id, user_id, task_id),
+    CONSTRAINT fk_rejudge_id
+        FOREIGN KEY(rejudge_id)
+            REFERENCES oia_rejudge(id)
+)
@@ -0,0 +1,2 @@
+ALTER TABLE oia_user
+ADD COLUMN IF NOT EXISTS last_user_test_ms BIGINT NOT NULL DEFAULT 0
@@ -0,0 +1,2 @@
+-- The CMS task type, e.g. Batch or OutputOnly
+ALTER TABLE oia_task ADD COLUMN IF NOT EXISTS task_type TEXT NOT NULL DEFAULT 'Batch'
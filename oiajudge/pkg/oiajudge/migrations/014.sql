@@ -0,0 +1,2 @@
+-- How submissions are compiled and evaluated, and the kits of the task
+ALTER TABLE oia_task ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{"kits": []}'
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS oia_task_statement (
+    task_id BIGINT NOT NULL,
+    language TEXT NOT NULL,
+    -- pdf, markdown, html or other
+    format TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    is_primary BOOLEAN NOT NULL DEFAULT false,
+    content BYTEA NOT NULL,
+    PRIMARY KEY (task_id, language, format),
+    CONSTRAINT fk_task_id
+        FOREIGN KEY(task_id)
+            REFERENCES oia_task(id)
+)
+
+;;
+
+-- The language of the old statements is unknown, they are replaced when
+-- the tasks are received again from the bridge
+INSERT INTO oia_task_statement(task_id, language, format, content_type, is_primary, content)
+SELECT id, '', 'pdf', 'application/pdf', true, statement
+FROM oia_task
+WHERE length(statement) > 0
+
+;;
+
+ALTER TABLE oia_task DROP COLUMN IF EXISTS statement
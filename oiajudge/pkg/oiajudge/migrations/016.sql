@@ -0,0 +1,14 @@
+-- Public testcases of the tasks, with only the beginning of long files
+CREATE TABLE IF NOT EXISTS oia_task_sample (
+    task_id BIGINT NOT NULL,
+    codename TEXT NOT NULL,
+    input BYTEA NOT NULL,
+    output BYTEA NOT NULL,
+    -- Sizes of the whole files
+    input_size BIGINT NOT NULL,
+    output_size BIGINT NOT NULL,
+    PRIMARY KEY (task_id, codename),
+    CONSTRAINT fk_task_id
+        FOREIGN KEY(task_id)
+            REFERENCES oia_task(id)
+)
@@ -0,0 +1,42 @@
+-- Every change to an editorial is a new version, the last one is shown
+CREATE TABLE IF NOT EXISTS oia_editorial (
+    task_id BIGINT NOT NULL,
+    version INTEGER NOT NULL,
+    -- Markdown, rendered like the statements
+    content TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (task_id, version),
+    CONSTRAINT fk_task_id
+        FOREIGN KEY(task_id)
+            REFERENCES oia_task(id)
+)
+
+;;
+
+CREATE TABLE IF NOT EXISTS oia_editorial_solution (
+    task_id BIGINT NOT NULL,
+    version INTEGER NOT NULL,
+    language TEXT NOT NULL,
+    filename TEXT NOT NULL,
+    source BYTEA NOT NULL,
+    PRIMARY KEY (task_id, version, language),
+    CONSTRAINT fk_editorial
+        FOREIGN KEY(task_id, version)
+            REFERENCES oia_editorial(task_id, version)
+)
+
+;;
+
+-- Users that saw the editorial of a task before solving it
+CREATE TABLE IF NOT EXISTS oia_task_give_up (
+    user_id BIGINT NOT NULL,
+    task_id BIGINT NOT NULL,
+    given_up_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, task_id),
+    CONSTRAINT fk_user_id
+        FOREIGN KEY(user_id)
+            REFERENCES oia_user(id),
+    CONSTRAINT fk_task_id
+        FOREIGN KEY(task_id)
+            REFERENCES oia_task(id)
+)
@@ -0,0 +1,12 @@
+-- When the results of the submission were discarded. Results read before
+-- that are the old ones, so they don't finish the rejudge
+ALTER TABLE oia_rejudge_submission ADD COLUMN IF NOT EXISTS invalidated_at TIMESTAMPTZ
+
+;;
+
+-- Rejudges made before this column existed count the results read after they
+-- were created
+UPDATE oia_rejudge_submission SET invalidated_at = oia_rejudge.created_at
+FROM oia_rejudge
+WHERE oia_rejudge.id = oia_rejudge_submission.rejudge_id
+    AND oia_rejudge_submission.invalidated_at IS NULL
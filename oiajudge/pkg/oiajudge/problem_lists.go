@@ -0,0 +1,467 @@
+package oiajudge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+type ProblemList struct {
+	Id          Id     `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// Tasks in the order they should be solved
+	Tasks []Id `json:"tasks"`
+	// Lists that should be completed before starting this one
+	Prerequisites []Id `json:"prerequisites"`
+}
+
+type GetProblemListsQuery struct{}
+
+type GetProblemListsResponse struct {
+	Lists []ProblemList `json:"lists"`
+}
+
+func (s *Server) GetProblemLists(ctx context.Context, q GetProblemListsQuery) (r GetProblemListsResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.Lists, err = GetProblemLists(*tx)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type GetProblemListsProgressQuery struct {
+	UserId Id `json:"user_id"`
+}
+
+func (q GetProblemListsProgressQuery) Uid() Id {
+	return q.UserId
+}
+
+type ProblemListTaskProgress struct {
+	TaskId   Id      `json:"task_id"`
+	Score    float64 `json:"score"`
+	MaxScore float64 `json:"max_score"`
+	Solved   bool    `json:"solved"`
+}
+
+type ProblemListProgress struct {
+	ListId   Id      `json:"list_id"`
+	Solved   int64   `json:"solved"`
+	Total    int64   `json:"total"`
+	Score    float64 `json:"score"`
+	MaxScore float64 `json:"max_score"`
+	// All the tasks in the list are solved
+	Completed bool `json:"completed"`
+	// All the prerequisites are completed
+	Unlocked bool                      `json:"unlocked"`
+	Tasks    []ProblemListTaskProgress `json:"tasks"`
+}
+
+type GetProblemListsProgressResponse struct {
+	Progress []ProblemListProgress `json:"progress"`
+}
+
+func (s *Server) GetProblemListsProgress(ctx context.Context, q GetProblemListsProgressQuery) (r GetProblemListsProgressResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	lists, err := GetProblemLists(*tx)
+	if err != nil {
+		return
+	}
+	tasks, err := GetTasks(*tx)
+	if err != nil {
+		return
+	}
+	scores, err := GetUserBaseScores(*tx, q.UserId)
+	if err != nil {
+		return
+	}
+	// The live score of frozen contest tasks would show the results hidden
+	// from the scoreboard
+	frozen, err := GetFrozenSubmissions(*tx, s.GetTime())
+	if err != nil {
+		return
+	}
+	unfrozen, err := GetUnfrozenBaseScores(*tx, frozen)
+	if err != nil {
+		return
+	}
+	for tid, score := range unfrozen[q.UserId] {
+		scores[tid] = score
+	}
+	max_scores := make(map[Id]float64)
+	for _, task := range tasks {
+		max_scores[task.Id] = task.MaxScore
+	}
+	// Deleted tasks are hidden from the lists until they are restored
+	deleted, err := GetDeletedTasks(*tx)
+	if err != nil {
+		return
+	}
+
+	completed := make(map[Id]bool)
+	r.Progress = make([]ProblemListProgress, 0, len(lists))
+	for _, list := range lists {
+		p := ProblemListProgress{
+			ListId: list.Id,
+			Tasks:  make([]ProblemListTaskProgress, 0, len(list.Tasks)),
+		}
+		for _, tid := range list.Tasks {
+			if deleted[tid] {
+				continue
+			}
+			p.Total += 1
+			// Tasks that weren't received from the bridge can't be solved
+			max_score, known := max_scores[tid]
+			t := ProblemListTaskProgress{
+				TaskId:   tid,
+				Score:    scores[tid],
+				MaxScore: max_score,
+				Solved:   known && max_score > 0 && scores[tid] >= max_score-1e-6,
+			}
+			if t.Solved {
+				p.Solved += 1
+			}
+			p.Score += t.Score
+			p.MaxScore += t.MaxScore
+			p.Tasks = append(p.Tasks, t)
+		}
+		p.Completed = p.Solved == p.Total
+		completed[list.Id] = p.Completed
+		r.Progress = append(r.Progress, p)
+	}
+	for i, list := range lists {
+		r.Progress[i].Unlocked = true
+		for _, prerequisite := range list.Prerequisites {
+			if !completed[prerequisite] {
+				r.Progress[i].Unlocked = false
+			}
+		}
+	}
+	return
+}
+
+type CreateProblemListQuery struct {
+	List ProblemList `json:"list"`
+}
+
+type CreateProblemListResponse struct {
+	ListId Id `json:"list_id"`
+}
+
+func (s *Server) CreateProblemList(ctx context.Context, q CreateProblemListQuery) (r CreateProblemListResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	lists, err := GetProblemLists(*tx)
+	if err != nil {
+		return
+	}
+	r.ListId, err = CreateProblemList(*tx, q.List)
+	if err != nil {
+		return
+	}
+	q.List.Id = r.ListId
+	err = ValidateProblemLists(*tx, append(lists, q.List))
+	if err != nil {
+		return
+	}
+	return
+}
+
+type UpdateProblemListQuery struct {
+	List ProblemList `json:"list"`
+}
+
+type UpdateProblemListResponse struct{}
+
+func (s *Server) UpdateProblemList(ctx context.Context, q UpdateProblemListQuery) (r UpdateProblemListResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = SaveProblemList(*tx, q.List, false)
+	if err != nil {
+		return
+	}
+	lists, err := GetProblemLists(*tx)
+	if err != nil {
+		return
+	}
+	err = ValidateProblemLists(*tx, lists)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type DeleteProblemListQuery struct {
+	ListId Id `json:"list_id"`
+}
+
+type DeleteProblemListResponse struct{}
+
+func (s *Server) DeleteProblemList(ctx context.Context, q DeleteProblemListQuery) (r DeleteProblemListResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = DeleteProblemList(*tx, q.ListId)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type ExportProblemListsQuery struct{}
+
+type ProblemListsExport struct {
+	Lists []ProblemList `json:"lists"`
+}
+
+func (s *Server) ExportProblemLists(ctx context.Context, q ExportProblemListsQuery) (r ProblemListsExport, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.Lists, err = GetProblemLists(*tx)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type ImportProblemListsQuery struct {
+	ProblemListsExport
+	// Delete the lists that are not part of the import
+	Replace bool `json:"replace"`
+}
+
+type ImportProblemListsResponse struct {
+	Imported int64 `json:"imported"`
+}
+
+// ImportProblemLists takes the output of ExportProblemLists. Lists are
+// matched by id, so importing an export into the same server is idempotent.
+func (s *Server) ImportProblemLists(ctx context.Context, q ImportProblemListsQuery) (r ImportProblemListsResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	if q.Replace {
+		_, err = tx.Exec("DELETE FROM oia_problem_list")
+		if err != nil {
+			return
+		}
+	}
+	for _, list := range q.Lists {
+		if list.Id <= 0 {
+			err = &OiaError{
+				HttpCode: http.StatusBadRequest,
+				Message:  fmt.Sprintf("list `%s` has no id", list.Title),
+			}
+			return
+		}
+		err = SaveProblemList(*tx, list, true)
+		if err != nil {
+			return
+		}
+		r.Imported += 1
+	}
+	_, err = tx.Exec("SELECT setval(pg_get_serial_sequence('oia_problem_list', 'id'), GREATEST((SELECT MAX(id) FROM oia_problem_list), 1))")
+	if err != nil {
+		return
+	}
+	lists, err := GetProblemLists(*tx)
+	if err != nil {
+		return
+	}
+	err = ValidateProblemLists(*tx, lists)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// ValidateProblemLists checks that every list references existing tasks and
+// lists, and that prerequisites don't form a cycle. Deleted tasks count as
+// existing, since they are kept in the lists in case they are restored.
+func ValidateProblemLists(tx store.Transaction, lists []ProblemList) error {
+	tasks, err := GetTasks(tx)
+	if err != nil {
+		return err
+	}
+	task_exists, err := GetDeletedTasks(tx)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		task_exists[task.Id] = true
+	}
+	by_id := make(map[Id]ProblemList)
+	for _, list := range lists {
+		by_id[list.Id] = list
+	}
+
+	var problems []string
+	for _, list := range lists {
+		if strings.TrimSpace(list.Title) == "" {
+			problems = append(problems, fmt.Sprintf("list %d has no title", list.Id))
+		}
+		seen := make(map[Id]bool)
+		for _, tid := range list.Tasks {
+			if !task_exists[tid] {
+				problems = append(problems, fmt.Sprintf("list %d references unknown task %d", list.Id, tid))
+			}
+			if seen[tid] {
+				problems = append(problems, fmt.Sprintf("list %d contains task %d twice", list.Id, tid))
+			}
+			seen[tid] = true
+		}
+		for _, prerequisite := range list.Prerequisites {
+			if _, ok := by_id[prerequisite]; !ok {
+				problems = append(problems, fmt.Sprintf("list %d requires unknown list %d", list.Id, prerequisite))
+			}
+		}
+	}
+
+	// Depth first search, a list that is reached again while it is still
+	// being visited closes a cycle
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[Id]int)
+	var visit func(id Id) bool
+	visit = func(id Id) bool {
+		switch state[id] {
+		case visiting:
+			return false
+		case visited:
+			return true
+		}
+		state[id] = visiting
+		for _, prerequisite := range by_id[id].Prerequisites {
+			if _, ok := by_id[prerequisite]; ok && !visit(prerequisite) {
+				return false
+			}
+		}
+		state[id] = visited
+		return true
+	}
+	for _, list := range lists {
+		if !visit(list.Id) {
+			problems = append(problems, fmt.Sprintf("prerequisites of list %d form a cycle", list.Id))
+			break
+		}
+	}
+
+	if len(problems) > 0 {
+		return &OiaError{
+			HttpCode: http.StatusBadRequest,
+			Message:  fmt.Sprintf("invalid problem lists: %s", strings.Join(problems, "; ")),
+		}
+	}
+	return nil
+}
+
+func GetProblemLists(tx store.Transaction) (lists []ProblemList, err error) {
+	rows, err := tx.Query("SELECT id, title, description, task_ids, prerequisites FROM oia_problem_list ORDER BY id")
+	if err != nil {
+		return
+	}
+	lists = make([]ProblemList, 0)
+	for rows.Next() {
+		var list ProblemList
+		err = rows.Scan(&list.Id, &list.Title, &list.Description, &list.Tasks, &list.Prerequisites)
+		if err != nil {
+			return
+		}
+		lists = append(lists, list)
+	}
+	return
+}
+
+func CreateProblemList(tx store.Transaction, list ProblemList) (id Id, err error) {
+	if list.Tasks == nil {
+		list.Tasks = []Id{}
+	}
+	if list.Prerequisites == nil {
+		list.Prerequisites = []Id{}
+	}
+	row := tx.QueryRow("INSERT INTO oia_problem_list(title, description, task_ids, prerequisites) VALUES ($1, $2, $3, $4) RETURNING id",
+		list.Title, list.Description, list.Tasks, list.Prerequisites)
+	err = row.Scan(&id)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// SaveProblemList overwrites an existing list. If upsert is set, lists that
+// don't exist are created with the given id.
+func SaveProblemList(tx store.Transaction, list ProblemList, upsert bool) (err error) {
+	if list.Tasks == nil {
+		list.Tasks = []Id{}
+	}
+	if list.Prerequisites == nil {
+		list.Prerequisites = []Id{}
+	}
+	if upsert {
+		_, err = tx.Exec(`
+			INSERT INTO oia_problem_list(id, title, description, task_ids, prerequisites)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT(id) DO UPDATE SET
+				title = EXCLUDED.title,
+				description = EXCLUDED.description,
+				task_ids = EXCLUDED.task_ids,
+				prerequisites = EXCLUDED.prerequisites`,
+			list.Id, list.Title, list.Description, list.Tasks, list.Prerequisites)
+		return
+	}
+	tag, err := tx.Exec("UPDATE oia_problem_list SET title = $2, description = $3, task_ids = $4, prerequisites = $5 WHERE id = $1",
+		list.Id, list.Title, list.Description, list.Tasks, list.Prerequisites)
+	if err != nil {
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("list %d not found", list.Id),
+		}
+	}
+	return
+}
+
+// DeleteProblemList removes a list, and drops it from the prerequisites of
+// the lists that depended on it.
+func DeleteProblemList(tx store.Transaction, id Id) (err error) {
+	_, err = tx.Exec("DELETE FROM oia_problem_list WHERE id = $1", id)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("UPDATE oia_problem_list SET prerequisites = array_remove(prerequisites, $1) WHERE $1 = ANY(prerequisites)", id)
+	if err != nil {
+		return
+	}
+	return
+}
@@ -0,0 +1,314 @@
+package oiajudge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+// Recommendations are ranked with a fixed linear formula so that a coach can
+// reproduce why a task was suggested from the components in the response:
+//
+//	rank = 3 * partial_credit + 2 * topic_weakness + 1 * difficulty_fit
+//
+// Ties are broken by task id, so the same data always yields the same list.
+const (
+	RecommendationPartialWeight    = 3.0
+	RecommendationWeaknessWeight   = 2.0
+	RecommendationDifficultyWeight = 1.0
+
+	DefaultRecommendationLimit = 10
+	TopicTagPrefix             = "tema:"
+
+	// Difficulty assumed for tasks nobody has tried yet
+	unknownTaskDifficulty = 0.5
+	// Level assumed for users that haven't fully solved any task
+	beginnerUserLevel = 0.25
+	// How much harder than the user's level we aim for
+	difficultyStretch = 0.1
+)
+
+type GetRecommendationsQuery struct {
+	UserId Id    `json:"user_id"`
+	Limit  int64 `json:"limit"`
+}
+
+func (q GetRecommendationsQuery) Uid() Id {
+	return q.UserId
+}
+
+type RecommendationComponents struct {
+	// Fraction of the task's score the user already has, 0 if untouched
+	PartialCredit float64 `json:"partial_credit"`
+	// 1 - the user's score fraction over the weakest topic of the task
+	TopicWeakness float64 `json:"topic_weakness"`
+	WeakestTopic  string  `json:"weakest_topic,omitempty"`
+	// 1 - |difficulty - target difficulty|
+	DifficultyFit    float64 `json:"difficulty_fit"`
+	Difficulty       float64 `json:"difficulty"`
+	TargetDifficulty float64 `json:"target_difficulty"`
+}
+
+type Recommendation struct {
+	Task       bridge.Task              `json:"task"`
+	Rank       float64                  `json:"rank"`
+	Components RecommendationComponents `json:"components"`
+	Reasons    []string                 `json:"reasons"`
+}
+
+type GetRecommendationsResponse struct {
+	Recommendations []Recommendation `json:"recommendations"`
+}
+
+func (s *Server) GetRecommendations(ctx context.Context, q GetRecommendationsQuery) (r GetRecommendationsResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	tasks, err := GetTasks(*tx)
+	if err != nil {
+		return
+	}
+	scores, err := GetUserBaseScores(*tx, q.UserId)
+	if err != nil {
+		return
+	}
+	// The live scores of frozen contest tasks would show the results hidden
+	// from the scoreboard
+	frozen, err := GetFrozenSubmissions(*tx, s.GetTime())
+	if err != nil {
+		return
+	}
+	unfrozen, err := GetUnfrozenBaseScores(*tx, frozen)
+	if err != nil {
+		return
+	}
+	for tid, score := range unfrozen[q.UserId] {
+		scores[tid] = score
+	}
+	subtasks, err := GetUserScoredSubtasks(*tx, q.UserId, frozen)
+	if err != nil {
+		return
+	}
+	solve_rates, err := GetTaskSolveRates(*tx, unfrozen)
+	if err != nil {
+		return
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultRecommendationLimit
+	}
+	r.Recommendations = RankRecommendations(tasks, scores, subtasks, solve_rates)
+	if int64(len(r.Recommendations)) > limit {
+		r.Recommendations = r.Recommendations[:limit]
+	}
+	return
+}
+
+func isSolved(task bridge.Task, base_score float64) bool {
+	return base_score >= task.MaxScore-1e-6
+}
+
+func taskTopics(task bridge.Task) (topics []string) {
+	for _, tag := range task.Tags {
+		if strings.HasPrefix(tag, TopicTagPrefix) {
+			topics = append(topics, strings.TrimPrefix(tag, TopicTagPrefix))
+		}
+	}
+	return
+}
+
+// RankRecommendations orders the unsolved tasks for a user. scores maps task
+// ids to the user's base score, scored_subtasks to the number of subtasks in
+// which the user got points, and solve_rates to the average score fraction of
+// everybody who tried the task.
+func RankRecommendations(tasks []bridge.Task, scores map[Id]float64, scored_subtasks map[Id]int, solve_rates map[Id]float64) []Recommendation {
+	difficulty := func(task bridge.Task) float64 {
+		rate, ok := solve_rates[task.Id]
+		if !ok {
+			return unknownTaskDifficulty
+		}
+		return 1 - rate
+	}
+
+	// Topic strength is the score fraction over all the tasks of the topic,
+	// so topics with many untouched tasks count as weak
+	topic_score := make(map[string]float64)
+	topic_max := make(map[string]float64)
+	solved_difficulty := float64(0)
+	solved := 0
+	for _, task := range tasks {
+		if task.MaxScore <= 0 {
+			continue
+		}
+		for _, topic := range taskTopics(task) {
+			topic_score[topic] += math.Min(scores[task.Id], task.MaxScore)
+			topic_max[topic] += task.MaxScore
+		}
+		if isSolved(task, scores[task.Id]) {
+			solved_difficulty += difficulty(task)
+			solved += 1
+		}
+	}
+	target := beginnerUserLevel
+	if solved > 0 {
+		target = solved_difficulty / float64(solved)
+	}
+	target = math.Min(target+difficultyStretch, 1)
+
+	res := make([]Recommendation, 0)
+	for _, task := range tasks {
+		if task.MaxScore <= 0 || isSolved(task, scores[task.Id]) {
+			continue
+		}
+		var c RecommendationComponents
+		var reasons []string
+
+		c.PartialCredit = scores[task.Id] / task.MaxScore
+		if c.PartialCredit > 0 {
+			reasons = append(reasons, fmt.Sprintf("you already have %.0f%% of the score, with points in %d subtask(s)", c.PartialCredit*100, scored_subtasks[task.Id]))
+		}
+
+		topics := taskTopics(task)
+		sort.Strings(topics)
+		for _, topic := range topics {
+			weakness := 1 - topic_score[topic]/topic_max[topic]
+			if weakness > c.TopicWeakness {
+				c.TopicWeakness = weakness
+				c.WeakestTopic = topic
+			}
+		}
+		if c.WeakestTopic != "" {
+			reasons = append(reasons, fmt.Sprintf("practices %s, where you have %.0f%% of the available score", c.WeakestTopic, (1-c.TopicWeakness)*100))
+		}
+
+		c.Difficulty = difficulty(task)
+		c.TargetDifficulty = target
+		c.DifficultyFit = 1 - math.Abs(c.Difficulty-target)
+		if _, ok := solve_rates[task.Id]; ok {
+			reasons = append(reasons, fmt.Sprintf("users who tried it got %.0f%% of the score on average, close to your level", (1-c.Difficulty)*100))
+		}
+
+		rank := RecommendationPartialWeight*c.PartialCredit +
+			RecommendationWeaknessWeight*c.TopicWeakness +
+			RecommendationDifficultyWeight*c.DifficultyFit
+		if reasons == nil {
+			reasons = []string{"not attempted yet"}
+		}
+		res = append(res, Recommendation{
+			Task:       task,
+			Rank:       rank,
+			Components: c,
+			Reasons:    reasons,
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Rank != res[j].Rank {
+			return res[i].Rank > res[j].Rank
+		}
+		return res[i].Task.Id < res[j].Task.Id
+	})
+	return res
+}
+
+func GetUserBaseScores(tx store.Transaction, uid Id) (scores map[Id]float64, err error) {
+	rows, err := tx.Query("SELECT task_id, base_score FROM oia_task_score WHERE user_id = $1", uid)
+	if err != nil {
+		return
+	}
+	scores = make(map[Id]float64)
+	for rows.Next() {
+		var tid Id
+		var score float64
+		err = rows.Scan(&tid, &score)
+		if err != nil {
+			return
+		}
+		scores[tid] = score
+	}
+	return
+}
+
+// GetUserScoredSubtasks returns, for each task, in how many subtasks the user
+// got a positive score in at least one submission. frozen submissions are
+// left out.
+func GetUserScoredSubtasks(tx store.Transaction, uid Id, frozen map[Id]Id) (res map[Id]int, err error) {
+	rows, err := tx.Query("SELECT id, task_id, subtask_details FROM oia_submissions WHERE user_id = $1", uid)
+	if err != nil {
+		return
+	}
+	best := make(map[Id][]float64)
+	for rows.Next() {
+		var sid Id
+		var tid Id
+		var json_arr string
+		err = rows.Scan(&sid, &tid, &json_arr)
+		if err != nil {
+			return
+		}
+		if _, ok := frozen[sid]; ok {
+			continue
+		}
+		subtask_scores := make([]float64, 0)
+		err = json.Unmarshal([]byte(json_arr), &subtask_scores)
+		if err != nil {
+			return
+		}
+		for len(best[tid]) < len(subtask_scores) {
+			best[tid] = append(best[tid], 0)
+		}
+		for i, v := range subtask_scores {
+			best[tid][i] = math.Max(best[tid][i], v)
+		}
+	}
+	res = make(map[Id]int)
+	for tid, v := range best {
+		for _, score := range v {
+			if score > 0 {
+				res[tid] += 1
+			}
+		}
+	}
+	return
+}
+
+// GetTaskSolveRates returns the average score fraction of the users that have
+// a score for each task. Tasks nobody tried are missing from the map. The
+// scores in unfrozen, indexed by user and task, replace the stored ones.
+func GetTaskSolveRates(tx store.Transaction, unfrozen map[Id]map[Id]float64) (rates map[Id]float64, err error) {
+	rows, err := tx.Query(`
+		SELECT oia_task_score.user_id, oia_task.id, oia_task_score.base_score, oia_task.max_score
+		FROM oia_task_score
+			INNER JOIN oia_task ON oia_task.id = oia_task_score.task_id
+		WHERE oia_task.max_score > 0 AND NOT oia_task.deleted`)
+	if err != nil {
+		return
+	}
+	total := make(map[Id]float64)
+	count := make(map[Id]int64)
+	for rows.Next() {
+		var uid, tid Id
+		var base_score, max_score float64
+		err = rows.Scan(&uid, &tid, &base_score, &max_score)
+		if err != nil {
+			return
+		}
+		if score, ok := unfrozen[uid][tid]; ok {
+			base_score = score
+		}
+		total[tid] += math.Min(base_score/max_score, 1)
+		count[tid] += 1
+	}
+	rates = make(map[Id]float64)
+	for tid := range total {
+		rates[tid] = total[tid] / float64(count[tid])
+	}
+	return
+}
@@ -0,0 +1,268 @@
+package oiajudge
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+const (
+	ReconcileBatchSize = 500
+	// How many ids of each kind of difference are listed in a report
+	ReconcileMaxIds = 100
+)
+
+// IdSample counts ids, and keeps the first ReconcileMaxIds of them
+type IdSample struct {
+	Count int64 `json:"count"`
+	Ids   []Id  `json:"ids"`
+}
+
+func (s *IdSample) add(id Id) {
+	s.Count += 1
+	if len(s.Ids) < ReconcileMaxIds {
+		s.Ids = append(s.Ids, id)
+	}
+}
+
+type ReconcileDiff struct {
+	Checked int64 `json:"checked"`
+	// Objects in CMS that the judge doesn't know about
+	MissingInJudge IdSample `json:"missing_in_judge"`
+	// Objects in the judge that don't exist in CMS anymore
+	MissingInCms IdSample `json:"missing_in_cms"`
+	// Objects whose copy in the judge is out of date
+	Changed IdSample `json:"changed"`
+}
+
+type ReconcileReport struct {
+	DryRun         bool          `json:"dry_run"`
+	StartedAt      time.Time     `json:"started_at"`
+	FinishedAt     time.Time     `json:"finished_at"`
+	Tasks          ReconcileDiff `json:"tasks"`
+	Submissions    ReconcileDiff `json:"submissions"`
+	Users          ReconcileDiff `json:"users"`
+	EnqueuedEvents int64         `json:"enqueued_events"`
+}
+
+type reconciler struct {
+	running sync.Mutex
+	last    *ReconcileReport
+	mu      sync.Mutex
+}
+
+// reconcileBatches walks the CMS objects in batches, and compares each batch
+// with the judge's objects in the same id range. on_diff is called for every
+// object missing on either side or changed.
+func reconcileBatches[T any](
+	diff *ReconcileDiff,
+	list func(after Id, limit int64) ([]T, error),
+	local func(after Id, upto Id) (map[Id]T, error),
+	id func(T) Id,
+	equal func(cms T, judge T) bool,
+	on_diff func(id Id) error,
+) error {
+	after := Id(0)
+	for {
+		batch, err := list(after, ReconcileBatchSize)
+		if err != nil {
+			return err
+		}
+		// The judge's objects after the last CMS object are in the last range
+		upto := Id(math.MaxInt64)
+		if len(batch) == ReconcileBatchSize {
+			upto = id(batch[len(batch)-1])
+		}
+		judge, err := local(after, upto)
+		if err != nil {
+			return err
+		}
+		for _, cms := range batch {
+			diff.Checked += 1
+			judge_object, ok := judge[id(cms)]
+			delete(judge, id(cms))
+			if !ok {
+				diff.MissingInJudge.add(id(cms))
+			} else if !equal(cms, judge_object) {
+				diff.Changed.add(id(cms))
+			} else {
+				continue
+			}
+			err = on_diff(id(cms))
+			if err != nil {
+				return err
+			}
+		}
+		orphans := make([]Id, 0, len(judge))
+		for orphan := range judge {
+			orphans = append(orphans, orphan)
+		}
+		sort.Slice(orphans, func(i, j int) bool {
+			return orphans[i] < orphans[j]
+		})
+		for _, orphan := range orphans {
+			diff.MissingInCms.add(orphan)
+			err = on_diff(orphan)
+			if err != nil {
+				return err
+			}
+		}
+		if upto == math.MaxInt64 {
+			return nil
+		}
+		after = upto
+	}
+}
+
+// Reconcile compares the tasks, submissions and users in CMS with the ones in
+// the judge, and enqueues events for the tasks and submissions that differ,
+// unless dry_run is set. Users are only reported.
+func (s *Server) Reconcile(ctx context.Context, dry_run bool) (report *ReconcileReport, err error) {
+	if !s.reconciler.running.TryLock() {
+		return nil, &OiaError{
+			HttpCode: http.StatusConflict,
+			Message:  "a reconciliation is already running",
+		}
+	}
+	defer s.reconciler.running.Unlock()
+
+	report = &ReconcileReport{DryRun: dry_run, StartedAt: time.Now()}
+	enqueue := func(event_type string) func(Id) error {
+		return func(id Id) error {
+			if dry_run {
+				return nil
+			}
+			report.EnqueuedEvents += 1
+			return s.Bridge.EnqueueEvent(ctx, event_type, id)
+		}
+	}
+
+	err = reconcileBatches(&report.Tasks,
+		func(after Id, limit int64) ([]bridge.TaskSummary, error) {
+			return s.Bridge.ListTasks(ctx, after, limit)
+		},
+		func(after Id, upto Id) (map[Id]bridge.TaskSummary, error) {
+			return inTx(ctx, &s.Db, func(tx store.Transaction) (map[Id]bridge.TaskSummary, error) {
+				return GetTaskSummaries(tx, after, upto)
+			})
+		},
+		func(t bridge.TaskSummary) Id { return t.Id },
+		func(cms, judge bridge.TaskSummary) bool { return cms == judge },
+		enqueue("task"))
+	if err != nil {
+		return
+	}
+
+	err = reconcileBatches(&report.Submissions,
+		func(after Id, limit int64) ([]bridge.SubmissionSummary, error) {
+			return s.Bridge.ListSubmissions(ctx, after, limit)
+		},
+		func(after Id, upto Id) (map[Id]bridge.SubmissionSummary, error) {
+			return inTx(ctx, &s.Db, func(tx store.Transaction) (map[Id]bridge.SubmissionSummary, error) {
+				return GetSubmissionSummaries(tx, after, upto)
+			})
+		},
+		func(t bridge.SubmissionSummary) Id { return t.Id },
+		func(cms, judge bridge.SubmissionSummary) bool {
+			return cms.UserId == judge.UserId &&
+				cms.ProblemId == judge.ProblemId &&
+				cms.SubmissionStatus == judge.SubmissionStatus &&
+				math.Abs(cms.Score-judge.Score) < 1e-6
+		},
+		enqueue("submission"))
+	if err != nil {
+		return
+	}
+
+	err = reconcileBatches(&report.Users,
+		func(after Id, limit int64) ([]bridge.UserSummary, error) {
+			return s.Bridge.ListUsers(ctx, after, limit)
+		},
+		func(after Id, upto Id) (map[Id]bridge.UserSummary, error) {
+			return inTx(ctx, &s.Db, func(tx store.Transaction) (map[Id]bridge.UserSummary, error) {
+				return GetUserSummaries(tx, after, upto)
+			})
+		},
+		func(t bridge.UserSummary) Id { return t.Id },
+		func(cms, judge bridge.UserSummary) bool { return cms == judge },
+		func(Id) error { return nil })
+	if err != nil {
+		return
+	}
+
+	report.FinishedAt = time.Now()
+	s.reconciler.mu.Lock()
+	s.reconciler.last = report
+	s.reconciler.mu.Unlock()
+	return
+}
+
+func inTx[T any](ctx context.Context, db *store.DBClient, f func(store.Transaction) (T, error)) (res T, err error) {
+	tx, err := db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	res, err = f(*tx)
+	return
+}
+
+func (s *Server) LastReconcileReport() *ReconcileReport {
+	s.reconciler.mu.Lock()
+	defer s.reconciler.mu.Unlock()
+	return s.reconciler.last
+}
+
+// RunReconciliation reconciles CMS and the judge every interval, until ctx is
+// done
+func (s *Server) RunReconciliation(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := s.Reconcile(ctx, false)
+		if err != nil {
+			log.Printf("Reconcile(): %s", err)
+			continue
+		}
+		log.Printf("Reconcile(): enqueued %d events. Tasks: %d missing, %d changed, %d orphans. Submissions: %d missing, %d changed, %d orphans. Users: %d missing, %d orphans",
+			report.EnqueuedEvents,
+			report.Tasks.MissingInJudge.Count, report.Tasks.Changed.Count, report.Tasks.MissingInCms.Count,
+			report.Submissions.MissingInJudge.Count, report.Submissions.Changed.Count, report.Submissions.MissingInCms.Count,
+			report.Users.MissingInJudge.Count, report.Users.MissingInCms.Count)
+	}
+}
+
+type ReconcileQuery struct {
+	// Only report the differences, without enqueuing events
+	DryRun bool `json:"dry_run"`
+}
+
+type ReconcileResponse struct {
+	Report *ReconcileReport `json:"report"`
+}
+
+func (s *Server) HandleReconcile(ctx context.Context, q ReconcileQuery) (r ReconcileResponse, err error) {
+	r.Report, err = s.Reconcile(ctx, q.DryRun)
+	return
+}
+
+type GetReconcileReportQuery struct{}
+
+// GetReconcileReport returns the report of the last reconciliation, which is
+// null if none finished since the server started
+func (s *Server) GetReconcileReport(ctx context.Context, q GetReconcileReportQuery) (r ReconcileResponse, err error) {
+	r.Report = s.LastReconcileReport()
+	return
+}
@@ -0,0 +1,297 @@
+package oiajudge
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+const (
+	RejudgeSubmission = "submission"
+	RejudgeTask       = "task"
+	RejudgeUser       = "user"
+)
+
+type RejudgeScoreChange struct {
+	UserId Id      `json:"user_id"`
+	TaskId Id      `json:"task_id"`
+	Before float64 `json:"before"`
+	After  float64 `json:"after"`
+}
+
+type Rejudge struct {
+	Id        Id        `json:"id"`
+	Kind      string    `json:"kind"`
+	TargetId  Id        `json:"target_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Total     int64     `json:"total"`
+	Done      int64     `json:"done"`
+	Finished  bool      `json:"finished"`
+	// Only once the rejudge is finished, for the users and tasks whose score
+	// changed
+	ScoreChanges []RejudgeScoreChange `json:"score_changes,omitempty"`
+}
+
+type RejudgeSubmissionQuery struct {
+	SubmissionId Id `json:"submission_id"`
+}
+
+type RejudgeTaskQuery struct {
+	TaskId Id `json:"task_id"`
+}
+
+type RejudgeUserQuery struct {
+	UserId Id `json:"user_id"`
+}
+
+type RejudgeResponse struct {
+	RejudgeId Id `json:"rejudge_id"`
+}
+
+func (s *Server) RejudgeSubmission(ctx context.Context, q RejudgeSubmissionQuery) (r RejudgeResponse, err error) {
+	r.RejudgeId, err = s.rejudge(ctx, RejudgeSubmission, q.SubmissionId, "SELECT id FROM oia_submissions WHERE id = $1")
+	return
+}
+
+func (s *Server) RejudgeTask(ctx context.Context, q RejudgeTaskQuery) (r RejudgeResponse, err error) {
+	r.RejudgeId, err = s.rejudge(ctx, RejudgeTask, q.TaskId, "SELECT id FROM oia_submissions WHERE task_id = $1")
+	return
+}
+
+func (s *Server) RejudgeUser(ctx context.Context, q RejudgeUserQuery) (r RejudgeResponse, err error) {
+	r.RejudgeId, err = s.rejudge(ctx, RejudgeUser, q.UserId, "SELECT id FROM oia_submissions WHERE user_id = $1")
+	return
+}
+
+// rejudge records the submissions selected by the query, and the scores of
+// their users, before asking the bridge to evaluate them again. The record is
+// committed first, so the submissions that are scored again right away are
+// already tracked by it, and it is deleted if the bridge fails.
+//
+// Events handled while the bridge discards the results may still read the
+// old ones, so submissions are only done with results read after the time
+// recorded once the bridge returns. The submissions are read again after
+// that time, in case they were already scored again.
+func (s *Server) rejudge(ctx context.Context, kind string, target_id Id, query string) (rid Id, err error) {
+	rid, ids, err := s.recordRejudge(ctx, kind, target_id, query)
+	if err != nil {
+		return
+	}
+	err = s.Bridge.RejudgeSubmissions(ctx, ids)
+	if err != nil {
+		delete_err := s.deleteRejudge(ctx, rid)
+		if delete_err != nil {
+			log.Printf("rejudge(): could not delete failed rejudge %d: %s", rid, delete_err)
+		}
+		rid = 0
+		return
+	}
+	err = s.markInvalidated(ctx, rid, time.Now())
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		err = s.Bridge.EnqueueEvent(ctx, "submission", id)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Server) recordRejudge(ctx context.Context, kind string, target_id Id, query string) (rid Id, ids []Id, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	rows, err := tx.Query(query, target_id)
+	if err != nil {
+		return
+	}
+	ids = make([]Id, 0)
+	for rows.Next() {
+		var id Id
+		err = rows.Scan(&id)
+		if err != nil {
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("no submissions to rejudge for %s %d", kind, target_id),
+		}
+		return
+	}
+	rid, err = CreateRejudge(*tx, kind, target_id, ids)
+	return
+}
+
+func (s *Server) markInvalidated(ctx context.Context, rid Id, at time.Time) (err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	_, err = tx.Exec("UPDATE oia_rejudge_submission SET invalidated_at = $2 WHERE rejudge_id = $1", rid, at)
+	return
+}
+
+func (s *Server) deleteRejudge(ctx context.Context, rid Id) (err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = DeleteRejudge(*tx, rid)
+	return
+}
+
+func CreateRejudge(tx store.Transaction, kind string, target_id Id, ids []Id) (rid Id, err error) {
+	err = tx.QueryRow("INSERT INTO oia_rejudge(kind, target_id) VALUES ($1, $2) RETURNING id", kind, target_id).Scan(&rid)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO oia_rejudge_submission(rejudge_id, submission_id)
+		SELECT $1, unnest($2::BIGINT[])`, rid, ids)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO oia_rejudge_score(rejudge_id, user_id, task_id, score)
+		SELECT $1, affected.user_id, affected.task_id, COALESCE(oia_task_score.score, 0)
+		FROM (SELECT DISTINCT user_id, task_id FROM oia_submissions WHERE id = ANY($2)) AS affected
+			LEFT JOIN oia_task_score
+				ON oia_task_score.user_id = affected.user_id
+				AND oia_task_score.task_id = affected.task_id`, rid, ids)
+	return
+}
+
+func DeleteRejudge(tx store.Transaction, rid Id) (err error) {
+	_, err = tx.Exec("DELETE FROM oia_rejudge_submission WHERE rejudge_id = $1", rid)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("DELETE FROM oia_rejudge_score WHERE rejudge_id = $1", rid)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("DELETE FROM oia_rejudge WHERE id = $1", rid)
+	return
+}
+
+// MarkRejudged is called for every stored submission with a final result, to
+// track the progress of the rejudges that include it. read_at is when the
+// result was read from the bridge.
+func MarkRejudged(tx store.Transaction, sid Id, read_at time.Time) (err error) {
+	_, err = tx.Exec(`
+		UPDATE oia_rejudge_submission SET done = true
+		WHERE submission_id = $1 AND NOT done AND invalidated_at < $2`, sid, read_at)
+	return
+}
+
+func GetRejudges(tx store.Transaction, query string, args ...any) (v []Rejudge, err error) {
+	rows, err := tx.Query(`
+		SELECT id, kind, target_id, created_at,
+			(SELECT count(*) FROM oia_rejudge_submission WHERE rejudge_id = oia_rejudge.id),
+			(SELECT count(*) FROM oia_rejudge_submission WHERE rejudge_id = oia_rejudge.id AND done)
+		FROM oia_rejudge `+query, args...)
+	if err != nil {
+		return
+	}
+	v = make([]Rejudge, 0)
+	for rows.Next() {
+		var rejudge Rejudge
+		err = rows.Scan(&rejudge.Id, &rejudge.Kind, &rejudge.TargetId, &rejudge.CreatedAt, &rejudge.Total, &rejudge.Done)
+		if err != nil {
+			return
+		}
+		rejudge.Finished = rejudge.Done == rejudge.Total
+		v = append(v, rejudge)
+	}
+	return
+}
+
+func GetRejudgeScoreChanges(tx store.Transaction, rid Id) (v []RejudgeScoreChange, err error) {
+	rows, err := tx.Query(`
+		SELECT oia_rejudge_score.user_id, oia_rejudge_score.task_id, oia_rejudge_score.score, COALESCE(oia_task_score.score, 0)
+		FROM oia_rejudge_score
+			LEFT JOIN oia_task_score
+				ON oia_task_score.user_id = oia_rejudge_score.user_id
+				AND oia_task_score.task_id = oia_rejudge_score.task_id
+		WHERE oia_rejudge_score.rejudge_id = $1
+		ORDER BY oia_rejudge_score.user_id, oia_rejudge_score.task_id`, rid)
+	if err != nil {
+		return
+	}
+	v = make([]RejudgeScoreChange, 0)
+	for rows.Next() {
+		var change RejudgeScoreChange
+		err = rows.Scan(&change.UserId, &change.TaskId, &change.Before, &change.After)
+		if err != nil {
+			return
+		}
+		if change.Before != change.After {
+			v = append(v, change)
+		}
+	}
+	return
+}
+
+type GetRejudgeQuery struct {
+	RejudgeId Id `json:"rejudge_id"`
+}
+
+type GetRejudgeResponse struct {
+	Rejudge Rejudge `json:"rejudge"`
+}
+
+func (s *Server) GetRejudge(ctx context.Context, q GetRejudgeQuery) (r GetRejudgeResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	rejudges, err := GetRejudges(*tx, "WHERE id = $1", q.RejudgeId)
+	if err != nil {
+		return
+	}
+	if len(rejudges) == 0 {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("rejudge %d not found", q.RejudgeId),
+		}
+		return
+	}
+	r.Rejudge = rejudges[0]
+	if r.Rejudge.Finished {
+		r.Rejudge.ScoreChanges, err = GetRejudgeScoreChanges(*tx, q.RejudgeId)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+type GetRejudgesQuery struct{}
+
+type GetRejudgesResponse struct {
+	Rejudges []Rejudge `json:"rejudges"`
+}
+
+func (s *Server) GetRejudges(ctx context.Context, q GetRejudgesQuery) (r GetRejudgesResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.Rejudges, err = GetRejudges(*tx, "ORDER BY id DESC")
+	return
+}
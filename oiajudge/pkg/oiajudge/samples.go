@@ -0,0 +1,89 @@
+package oiajudge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+// sampleFileUrl is where the whole input or output of a sample is downloaded
+func (s *Server) sampleFileUrl(tid Id, codename string, file string) string {
+	return fmt.Sprintf("%s/task/samples/download?task_id=%d&codename=%s&file=%s", s.Config.PublicUrl, tid, url.QueryEscape(codename), file)
+}
+
+// fillSampleUrls links the samples that were truncated to their whole files
+func (s *Server) fillSampleUrls(tid Id, samples []bridge.SampleTestcase) {
+	for i := range samples {
+		if samples[i].InputSize > int64(len(samples[i].Input)) {
+			samples[i].InputUrl = s.sampleFileUrl(tid, samples[i].Codename, "input")
+		}
+		if samples[i].OutputSize > int64(len(samples[i].Output)) {
+			samples[i].OutputUrl = s.sampleFileUrl(tid, samples[i].Codename, "output")
+		}
+	}
+}
+
+type GetTaskSamplesQuery struct {
+	Id Id `json:"task_id"`
+}
+
+type GetTaskSamplesResponse struct {
+	Samples []bridge.SampleTestcase `json:"samples"`
+}
+
+func (s *Server) GetTaskSamples(ctx context.Context, q GetTaskSamplesQuery) (r GetTaskSamplesResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	_, err = GetSingleTask(*tx, q.Id)
+	if store.IsNoRows(err) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("task %d not found", q.Id),
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = CheckTaskVisible(*tx, q.Id, s.GetTime())
+	if err != nil {
+		return
+	}
+	r.Samples, err = GetTaskSamples(*tx, q.Id)
+	if err != nil {
+		return
+	}
+	s.fillSampleUrls(q.Id, r.Samples)
+	return
+}
+
+// GetSampleFile returns the whole input or output of a sample
+func (s *Server) GetSampleFile(ctx context.Context, tid Id, codename string, file string) (content []byte, err error) {
+	if file != "input" && file != "output" {
+		err = &OiaError{
+			HttpCode: http.StatusBadRequest,
+			Message:  "file must be input or output",
+		}
+		return
+	}
+	err = s.CheckTaskVisible(ctx, tid)
+	if err != nil {
+		return
+	}
+	content, err = s.Bridge.GetSampleFile(ctx, tid, codename, file == "output")
+	if store.IsNoRows(err) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("task %d has no sample %s", tid, codename),
+		}
+		return
+	}
+	return
+}
@@ -2,12 +2,15 @@ package oiajudge
 
 import (
 	"context"
+	"crypto/subtle"
 	"embed"
 	"encoding/json"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -25,6 +28,13 @@ type Server struct {
 	Db     store.DBClient
 
 	MockTime atomic.Pointer[time.Time]
+
+	// Submission events that didn't change the stored submission
+	UnchangedSubmissions atomic.Int64
+
+	reconciler reconciler
+
+	renderedStatements statementCache
 }
 
 func WrongJsonInput(expected_type string, err error) *OiaError {
@@ -39,24 +49,25 @@ type Handler func(w http.ResponseWriter, r *http.Request)
 type Authenticator[Q any] func(Q, *http.Request) error
 type ApiFunction[Q any, R any] func(context.Context, Q) (R, error)
 
-func Outer[Q any, R any](auth Authenticator[Q], handler ApiFunction[Q, R]) Handler {
-	processError := func(w http.ResponseWriter, err error) {
-		if err == nil {
-			log.Fatalf("ERROR WAS NIL")
-		}
-		fmt.Printf("ERROR: %s\n\n", err)
-		var code int
-		var body []byte
-		if err2, ok := err.(*OiaError); ok {
-			code = err2.HttpCode
-			body = []byte(err2.Error())
-		} else {
-			code = http.StatusInternalServerError
-			body = []byte(fmt.Sprintf("Unexpected error: %s", err.Error()))
-		}
-		w.WriteHeader(code)
-		w.Write(body)
+func WriteError(w http.ResponseWriter, err error) {
+	if err == nil {
+		log.Fatalf("ERROR WAS NIL")
+	}
+	fmt.Printf("ERROR: %s\n\n", err)
+	var code int
+	var body []byte
+	if err2, ok := err.(*OiaError); ok {
+		code = err2.HttpCode
+		body = []byte(err2.Error())
+	} else {
+		code = http.StatusInternalServerError
+		body = []byte(fmt.Sprintf("Unexpected error: %s", err.Error()))
 	}
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func Outer[Q any, R any](auth Authenticator[Q], handler ApiFunction[Q, R]) Handler {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization")
@@ -64,7 +75,7 @@ func Outer[Q any, R any](auth Authenticator[Q], handler ApiFunction[Q, R]) Handl
 		var query Q
 		err := json.NewDecoder(r.Body).Decode(&query)
 		if err != nil {
-			processError(w, &OiaError{
+			WriteError(w, &OiaError{
 				HttpCode:      http.StatusBadRequest,
 				Message:       "could not parse json body",
 				InternalError: err,
@@ -73,22 +84,22 @@ func Outer[Q any, R any](auth Authenticator[Q], handler ApiFunction[Q, R]) Handl
 		}
 		err = auth(query, r)
 		if err != nil {
-			processError(w, err)
+			WriteError(w, err)
 			return
 		}
 		resp, err := handler(r.Context(), query)
 		if err != nil {
-			processError(w, err)
+			WriteError(w, err)
 			return
 		}
 		data, err := json.Marshal(resp)
 		if err != nil {
-			processError(w, err)
+			WriteError(w, err)
 			return
 		}
 		_, err = w.Write(data)
 		if err != nil {
-			processError(w, err)
+			WriteError(w, err)
 			return
 		}
 	}
@@ -98,30 +109,61 @@ func NoAuth[Q any, R any](server *Server, f ApiFunction[Q, R]) Handler {
 	return Outer(func(query Q, r *http.Request) error { return nil }, f)
 }
 
+// AuthenticateUser checks that the request carries a valid token for uid
+func AuthenticateUser(server *Server, r *http.Request, uid Id) error {
+	authHeader := r.Header.Get("Authorization")
+
+	malformedAuthError := &OiaError{
+		HttpCode: http.StatusBadRequest,
+		Message:  "Authorization header must be of the form `Bearer <token-id>:<token-value>`",
+	}
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return malformedAuthError
+	}
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	tx, err := server.Db.Tx(r.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.Close(&err)
+	err = CheckUserToken(*tx, uid, token)
+	if err != nil {
+		return &OiaError{
+			HttpCode:      http.StatusUnauthorized,
+			Message:       "Unauthorized",
+			InternalError: err,
+		}
+	}
+	return nil
+}
+
 func WithUserAuth[Q Authenticatable, R any](server *Server, f ApiFunction[Q, R]) Handler {
 	auth := func(query Q, r *http.Request) error {
-		uid := query.Uid()
-		authHeader := r.Header.Get("Authorization")
+		return AuthenticateUser(server, r, query.Uid())
+	}
+	return Outer(auth, f)
+}
 
-		malformedAuthError := &OiaError{
-			HttpCode: http.StatusBadRequest,
-			Message:  "Authorization header must be of the form `Bearer <token-id>:<token-value>`",
+func WithAdminAuth[Q any, R any](server *Server, f ApiFunction[Q, R]) Handler {
+	auth := func(query Q, r *http.Request) error {
+		if server.Config.AdminToken == "" {
+			return &OiaError{
+				HttpCode: http.StatusForbidden,
+				Message:  "admin APIs are disabled",
+			}
 		}
+		authHeader := r.Header.Get("Authorization")
 		if !strings.HasPrefix(authHeader, "Bearer ") {
-			return malformedAuthError
+			return &OiaError{
+				HttpCode: http.StatusBadRequest,
+				Message:  "Authorization header must be of the form `Bearer <admin-token>`",
+			}
 		}
 		token := strings.TrimPrefix(authHeader, "Bearer ")
-		tx, err := server.Db.Tx(r.Context())
-		if err != nil {
-			return err
-		}
-		defer tx.Close(&err)
-		err = CheckUserToken(*tx, uid, token)
-		if err != nil {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(server.Config.AdminToken)) == 0 {
 			return &OiaError{
-				HttpCode:      http.StatusUnauthorized,
-				Message:       "Unauthorized",
-				InternalError: err,
+				HttpCode: http.StatusUnauthorized,
+				Message:  "Unauthorized",
 			}
 		}
 		return nil
@@ -129,8 +171,31 @@ func WithUserAuth[Q Authenticatable, R any](server *Server, f ApiFunction[Q, R])
 	return Outer(auth, f)
 }
 
-func Health(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+type HealthResponse struct {
+	Status        string                     `json:"status"`
+	EventListener bridge.EventListenerStatus `json:"event_listener"`
+}
+
+// Health reports 503 while the judge isn't listening for CMS events, since
+// scores wouldn't be updated
+func Health(w http.ResponseWriter, r *http.Request, server *Server) {
+	resp := HealthResponse{
+		Status:        "ok",
+		EventListener: server.Bridge.GetEventListenerStatus(r.Context()),
+	}
+	code := http.StatusOK
+	if !resp.EventListener.Listening {
+		resp.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
 }
 
 func ServeStatement(w http.ResponseWriter, r *http.Request, server *Server) {
@@ -144,13 +209,73 @@ func ServeStatement(w http.ResponseWriter, r *http.Request, server *Server) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	statement, err := server.GetTaskStatement(r.Context(), tid)
+	// The languages can be given as ?lang=es,en, which takes precedence
+	// over the Accept-Language header
+	languages := ParseAcceptLanguage(r.URL.Query().Get("lang"))
+	if len(languages) == 0 {
+		languages = ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	}
+	statement, err := server.GetTaskStatement(r.Context(), tid, languages, r.URL.Query().Get("format"))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	// Statements are uploaded by task authors, so HTML ones can't run
+	// scripts with the origin of the judge
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", statement.ContentType)
+	if statement.Language != "" {
+		w.Header().Set("Content-Language", statement.Language)
+	}
+	w.Header().Set("Vary", "Accept-Language")
+	w.Write(statement.Content)
+}
+
+func ServeStatementHtml(w http.ResponseWriter, r *http.Request, server *Server) {
+	tid, err := strconv.ParseInt(mux.Vars(r)["tid"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	languages := ParseAcceptLanguage(r.URL.Query().Get("lang"))
+	if len(languages) == 0 {
+		languages = ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	}
+	statement, err := server.GetTaskStatementHtml(r.Context(), tid, languages)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", statement.ContentType)
+	if statement.Language != "" {
+		w.Header().Set("Content-Language", statement.Language)
+	}
+	w.Header().Set("Vary", "Accept-Language")
+	w.Write(statement.Content)
+}
+
+func ServeSampleFile(w http.ResponseWriter, r *http.Request, server *Server) {
+	tid, err := strconv.ParseInt(r.URL.Query().Get("task_id"), 10, 64)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("task_id must be an integer"))
+		return
+	}
+	codename := r.URL.Query().Get("codename")
+	file := r.URL.Query().Get("file")
+	content, err := server.GetSampleFile(r.Context(), tid, codename, file)
+	if err != nil {
+		WriteError(w, err)
 		return
 	}
-	w.Write(statement)
-	w.Header().Add("Content-Type", "application/pdf")
+	extension := ".in"
+	if file == "output" {
+		extension = ".out"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": codename + extension}))
+	w.Write(content)
 }
 
 func ServeAttachment(w http.ResponseWriter, r *http.Request, server *Server) {
@@ -176,13 +301,19 @@ func ServeAttachment(w http.ResponseWriter, r *http.Request, server *Server) {
 	}
 	attachment, err := server.GetAttachment(r.Context(), tid, filename)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		// pass the error onto the caller
-		w.Write([]byte(err.Error()))
+		WriteError(w, err)
 		return
 	}
+	content_type := mime.TypeByExtension(path.Ext(filename))
+	if content_type == "" {
+		content_type = http.DetectContentType(attachment)
+	}
+	w.Header().Set("Content-Type", content_type)
+	// Attachments are uploaded by problem setters, but may be opened
+	// directly, so scripts in them (e.g. in SVG images) must not run
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Write(attachment)
-	w.Header().Add("Content-Type", "application/zip")
 }
 
 func (server *Server) MakeServer() http.Handler {
@@ -204,21 +335,78 @@ func (server *Server) MakeServer() http.Handler {
 	r.HandleFunc("/user/create", NoAuth(server, server.CreateUser)).Methods("POST")
 	r.HandleFunc("/user/login", NoAuth(server, server.UserLogin)).Methods("POST")
 	r.HandleFunc("/user/get", WithUserAuth(server, server.GetUser)).Methods("POST")
+	r.HandleFunc("/user/recommendations", WithUserAuth(server, server.GetRecommendations)).Methods("POST")
 	r.HandleFunc("/submissions/get", NoAuth(server, server.GetSubmissions)).Methods("POST")
 	r.HandleFunc("/submissions/get/single", NoAuth(server, server.GetSubmission)).Methods("POST")
 	r.HandleFunc("/submission/create", WithUserAuth(server, server.MakeSubmission)).Methods("POST")
+	r.HandleFunc("/usertest/create", WithUserAuth(server, server.MakeUserTest)).Methods("POST")
+	r.HandleFunc("/usertest/get", WithUserAuth(server, server.GetUserTest)).Methods("POST")
 	r.HandleFunc("/task/get", NoAuth(server, server.GetTasks)).Methods("POST")
 	r.HandleFunc("/task/get/single", NoAuth(server, server.GetSingleTask)).Methods("POST")
+	r.HandleFunc("/task/samples", NoAuth(server, server.GetTaskSamples)).Methods("POST")
+	r.HandleFunc("/task/editorial", WithUserAuth(server, server.GetEditorial)).Methods("POST")
+	r.HandleFunc("/task/giveup", WithUserAuth(server, server.GiveUpTask)).Methods("POST")
+	r.HandleFunc("/lists/get", NoAuth(server, server.GetProblemLists)).Methods("POST")
+	r.HandleFunc("/lists/progress", WithUserAuth(server, server.GetProblemListsProgress)).Methods("POST")
+	r.HandleFunc("/group/get", WithUserAuth(server, server.GetGroups)).Methods("POST")
+	r.HandleFunc("/group/create", WithUserAuth(server, server.CreateGroup)).Methods("POST")
+	r.HandleFunc("/group/join", WithUserAuth(server, server.JoinGroup)).Methods("POST")
+	r.HandleFunc("/group/leave", WithUserAuth(server, server.LeaveGroup)).Methods("POST")
+	r.HandleFunc("/group/assignment/create", WithUserAuth(server, server.CreateGroupAssignment)).Methods("POST")
+	r.HandleFunc("/group/assignment/delete", WithUserAuth(server, server.DeleteGroupAssignment)).Methods("POST")
+	r.HandleFunc("/group/dashboard", WithUserAuth(server, server.GetGroupDashboard)).Methods("POST")
+	r.HandleFunc("/virtual/start", WithUserAuth(server, server.StartVirtualContest)).Methods("POST")
+	r.HandleFunc("/virtual/finish", WithUserAuth(server, server.FinishVirtualContest)).Methods("POST")
+	r.HandleFunc("/virtual/get", WithUserAuth(server, server.GetVirtualContest)).Methods("POST")
+	r.HandleFunc("/virtual/scoreboard", NoAuth(server, server.GetVirtualScoreboard)).Methods("POST")
+	r.HandleFunc("/contest/get", NoAuth(server, server.GetContests)).Methods("POST")
+	r.HandleFunc("/contest/scoreboard", NoAuth(server, server.GetContestScoreboard)).Methods("POST")
 	r.HandleFunc("/token/validate", WithUserAuth(server, server.ValidateToken)).Methods("POST")
 
 	r.HandleFunc("/task/statement/{tid}", func(w http.ResponseWriter, r *http.Request) {
 		ServeStatement(w, r, server)
 	}).Methods("GET")
+	r.HandleFunc("/task/statement/{tid}/html", func(w http.ResponseWriter, r *http.Request) {
+		ServeStatementHtml(w, r, server)
+	}).Methods("GET")
+	r.HandleFunc("/task/samples/download", func(w http.ResponseWriter, r *http.Request) {
+		ServeSampleFile(w, r, server)
+	}).Methods("GET")
 	r.HandleFunc("/task/attachment", func(w http.ResponseWriter, r *http.Request) {
 		ServeAttachment(w, r, server)
 	}).Methods("GET")
+	r.HandleFunc("/group/dashboard/csv", func(w http.ResponseWriter, r *http.Request) {
+		ServeGroupDashboardCsv(w, r, server)
+	}).Methods("GET")
 
-	r.HandleFunc("/health", Health).Methods("GET")
+	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		Health(w, r, server)
+	}).Methods("GET")
+
+	// Admin APIs
+	r.HandleFunc("/admin/lists/create", WithAdminAuth(server, server.CreateProblemList)).Methods("POST")
+	r.HandleFunc("/admin/lists/update", WithAdminAuth(server, server.UpdateProblemList)).Methods("POST")
+	r.HandleFunc("/admin/lists/delete", WithAdminAuth(server, server.DeleteProblemList)).Methods("POST")
+	r.HandleFunc("/admin/lists/export", WithAdminAuth(server, server.ExportProblemLists)).Methods("POST")
+	r.HandleFunc("/admin/lists/import", WithAdminAuth(server, server.ImportProblemLists)).Methods("POST")
+	r.HandleFunc("/admin/historic/import", WithAdminAuth(server, server.ImportHistoricResults)).Methods("POST")
+	r.HandleFunc("/admin/contest/save", WithAdminAuth(server, server.SaveContest)).Methods("POST")
+	r.HandleFunc("/admin/contest/participants", WithAdminAuth(server, server.SetContestParticipants)).Methods("POST")
+	r.HandleFunc("/admin/contest/scoreboard", WithAdminAuth(server, server.GetUnfrozenContestScoreboard)).Methods("POST")
+	r.HandleFunc("/admin/editorial/save", WithAdminAuth(server, server.SaveEditorial)).Methods("POST")
+	r.HandleFunc("/admin/editorial/history", WithAdminAuth(server, server.GetEditorialHistory)).Methods("POST")
+	r.HandleFunc("/admin/rejudge/submission", WithAdminAuth(server, server.RejudgeSubmission)).Methods("POST")
+	r.HandleFunc("/admin/rejudge/task", WithAdminAuth(server, server.RejudgeTask)).Methods("POST")
+	r.HandleFunc("/admin/rejudge/user", WithAdminAuth(server, server.RejudgeUser)).Methods("POST")
+	r.HandleFunc("/admin/rejudge/get", WithAdminAuth(server, server.GetRejudge)).Methods("POST")
+	r.HandleFunc("/admin/rejudge/list", WithAdminAuth(server, server.GetRejudges)).Methods("POST")
+	r.HandleFunc("/admin/reconcile", WithAdminAuth(server, server.HandleReconcile)).Methods("POST")
+	r.HandleFunc("/admin/reconcile/last", WithAdminAuth(server, server.GetReconcileReport)).Methods("POST")
+	r.HandleFunc("/admin/events/stats", WithAdminAuth(server, server.GetEventStats)).Methods("POST")
+	r.HandleFunc("/admin/events/dead/list", WithAdminAuth(server, server.GetDeadEvents)).Methods("POST")
+	r.HandleFunc("/admin/events/dead/get", WithAdminAuth(server, server.GetDeadEvent)).Methods("POST")
+	r.HandleFunc("/admin/events/dead/replay", WithAdminAuth(server, server.ReplayDeadEvent)).Methods("POST")
+	r.HandleFunc("/admin/events/dead/discard", WithAdminAuth(server, server.DiscardDeadEvent)).Methods("POST")
 
 	// Debug APIs
 	if server.Config.Debug {
@@ -232,14 +420,6 @@ func (server *Server) MakeServer() http.Handler {
 //go:embed migrations
 var migrations embed.FS
 
-func GetenvIntWithDefault(env string, def int64) int64 {
-	res, err := strconv.ParseInt(os.Getenv(env), 10, 64)
-	if err != nil {
-		return def
-	}
-	return res
-}
-
 func RunServer(ctx context.Context, bridge bridge.Bridge) error {
 	port_string := os.Getenv("OIAJ_SERVER_PORT")
 	port, err := strconv.ParseInt(port_string, 10, 64)
@@ -249,8 +429,12 @@ func RunServer(ctx context.Context, bridge bridge.Bridge) error {
 	config := Config{
 		OiaDbConnectionString: os.Getenv("OIAJ_DB_CONNECTION_STRING"),
 		OiaServerPort:         port,
-		SubmissionCooldown:    time.Millisecond * time.Duration(GetenvIntWithDefault("OIAJ_SUBMISSION_COOLDOWN_MS", 60*1000)),
+		SubmissionCooldown:    time.Millisecond * time.Duration(utils.GetenvIntWithDefault("OIAJ_SUBMISSION_COOLDOWN_MS", 60*1000)),
+		UserTestCooldown:      time.Millisecond * time.Duration(utils.GetenvIntWithDefault("OIAJ_USER_TEST_COOLDOWN_MS", 10*1000)),
 		Debug:                 os.Getenv("OIAJ_DEBUG") != "",
+		AdminToken:            os.Getenv("OIAJ_ADMIN_TOKEN"),
+		ReconcileInterval:     time.Millisecond * time.Duration(utils.GetenvIntWithDefault("OIAJ_RECONCILE_INTERVAL_MS", 60*60*1000)),
+		PublicUrl:             strings.TrimSuffix(os.Getenv("OIAJ_PUBLIC_URL"), "/"),
 	}
 
 	sql, err := utils.ExtractEmbeddedFsIntoFileMap(migrations, "migrations")
@@ -269,6 +453,9 @@ func RunServer(ctx context.Context, bridge bridge.Bridge) error {
 	}
 
 	bridge.HandleEvents(context.Background(), server.HandleEvents)
+	if config.ReconcileInterval > 0 {
+		go server.RunReconciliation(context.Background(), config.ReconcileInterval)
+	}
 
 	handler := server.MakeServer()
 	url := fmt.Sprintf(":%d", config.OiaServerPort)
@@ -0,0 +1,246 @@
+package oiajudge
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+const (
+	// Same as the default limit of CMS
+	MaxSubmissionSize = 100_000
+	MaxSourceFileSize = MaxSubmissionSize
+
+	// Outputs are usually much bigger than source code
+	MaxOutputFileSize = 10 << 20
+	MaxOutputsSize    = 50 << 20
+	// Entries of a zip file with outputs, including directories
+	MaxOutputsEntries = 1000
+
+	// Submission formats use %l where the extension of the language goes
+	LanguageTemplate = ".%l"
+)
+
+// Extensions accepted for the language placeholder. Only C++ is supported by
+// the bridge.
+var LanguageExtensions = []string{".cpp", ".cc", ".cxx", ".c++", ".C"}
+
+// UnpackOutputs extracts the outputs of a submission to an output only task
+// from a zip archive. Directories inside the archive are ignored, so the
+// outputs may be in a folder. Dotfiles and the metadata macOS adds under
+// __MACOSX/ are skipped, other files not in the submission format are
+// reported without being read. Unpacking stops as soon as the archive has
+// too many entries or too many bytes in total.
+func UnpackOutputs(archive []byte, format []string) (outputs map[string][]byte, problems []string) {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("the outputs are not a valid zip file: %s", err))
+		return
+	}
+	expected := make(map[string]bool)
+	for _, filename := range format {
+		expected[filename] = true
+	}
+	outputs = make(map[string][]byte)
+	total := 0
+	for i, file := range reader.File {
+		if i >= MaxOutputsEntries {
+			problems = append(problems, fmt.Sprintf("the zip file has more than %d entries", MaxOutputsEntries))
+			return
+		}
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		filename := path.Base(file.Name)
+		if strings.HasPrefix(file.Name, "__MACOSX/") || strings.HasPrefix(filename, ".") {
+			continue
+		}
+		if !expected[filename] {
+			problems = append(problems, fmt.Sprintf("unexpected file %s, expected %s", file.Name, strings.Join(format, ", ")))
+			continue
+		}
+		if _, ok := outputs[filename]; ok {
+			problems = append(problems, fmt.Sprintf("file %s appears twice in the zip file", filename))
+			continue
+		}
+		// The sizes in the zip headers can't be trusted
+		var content io.ReadCloser
+		content, err = file.Open()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("can't unpack %s: %s", file.Name, err))
+			continue
+		}
+		var data []byte
+		data, err = io.ReadAll(io.LimitReader(content, MaxOutputFileSize+1))
+		content.Close()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("can't unpack %s: %s", file.Name, err))
+			continue
+		}
+		if len(data) > MaxOutputFileSize {
+			problems = append(problems, fmt.Sprintf("file %s has more than %d bytes", filename, MaxOutputFileSize))
+			continue
+		}
+		total += len(data)
+		if total > MaxOutputsSize {
+			problems = append(problems, fmt.Sprintf("the outputs have more than %d bytes in total", MaxOutputsSize))
+			return
+		}
+		outputs[filename] = data
+	}
+	return
+}
+
+// NormalizeSources checks the files of a submission against the submission
+// format of the task. Files may be named after the format, like envido.%l, or
+// with a language extension, like envido.cpp. The returned files are always
+// named after the format. problems lists everything wrong with the files.
+//
+// Submissions to output only tasks may leave out some outputs, which are
+// scored as wrong, and outputs may be empty.
+func NormalizeSources(task_type string, format []string, sources map[string][]byte) (normalized map[string][]byte, problems []string) {
+	output_only := task_type == bridge.TASK_TYPE_OUTPUT_ONLY
+	max_file_size, max_size := MaxSourceFileSize, MaxSubmissionSize
+	if output_only {
+		max_file_size, max_size = MaxOutputFileSize, MaxOutputsSize
+	}
+	expected := make(map[string]bool)
+	for _, filename := range format {
+		expected[filename] = true
+	}
+	filenames := make([]string, 0, len(sources))
+	for filename := range sources {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	normalized = make(map[string][]byte)
+	given_as := make(map[string]string)
+	total := 0
+	for _, filename := range filenames {
+		content := sources[filename]
+		target := filename
+		if !expected[target] {
+			for _, ext := range LanguageExtensions {
+				if strings.HasSuffix(filename, ext) && expected[strings.TrimSuffix(filename, ext)+LanguageTemplate] {
+					target = strings.TrimSuffix(filename, ext) + LanguageTemplate
+					break
+				}
+			}
+		}
+		if !expected[target] {
+			problems = append(problems, fmt.Sprintf("unexpected file %s, expected %s", filename, strings.Join(format, ", ")))
+			continue
+		}
+		if other, ok := given_as[target]; ok {
+			problems = append(problems, fmt.Sprintf("files %s and %s are both %s", other, filename, target))
+			continue
+		}
+		given_as[target] = filename
+
+		total += len(content)
+		switch {
+		case len(content) == 0 && !output_only:
+			problems = append(problems, fmt.Sprintf("file %s is empty", filename))
+		case len(content) > max_file_size:
+			problems = append(problems, fmt.Sprintf("file %s has %d bytes, the limit is %d", filename, len(content), max_file_size))
+		}
+		if strings.HasSuffix(target, LanguageTemplate) {
+			if bytes.IndexByte(content, 0) >= 0 {
+				problems = append(problems, fmt.Sprintf("file %s is binary, it should be source code", filename))
+			} else if !utf8.Valid(content) {
+				problems = append(problems, fmt.Sprintf("file %s is not valid UTF-8", filename))
+			}
+		}
+		normalized[target] = content
+	}
+	if output_only {
+		if len(sources) == 0 {
+			problems = append(problems, "no outputs were sent")
+		}
+	} else {
+		for _, filename := range format {
+			if _, ok := given_as[filename]; !ok {
+				problems = append(problems, fmt.Sprintf("missing file %s", filename))
+			}
+		}
+	}
+	if total > max_size {
+		problems = append(problems, fmt.Sprintf("the files have %d bytes in total, the limit is %d", total, max_size))
+	}
+	return
+}
+
+// GetSubmissionTask returns the task that is being submitted to
+func (s *Server) GetSubmissionTask(ctx context.Context, tid Id) (task bridge.Task, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	task, err = GetSingleTask(*tx, tid)
+	if store.IsNoRows(err) {
+		// The task may not have been received from the bridge yet
+		var bridge_task *bridge.Task
+		bridge_task, err = s.Bridge.GetTask(ctx, tid)
+		if err == nil && bridge_task.Deleted {
+			err = &OiaError{
+				HttpCode: http.StatusNotFound,
+				Message:  fmt.Sprintf("task %d not found", tid),
+			}
+		}
+		if err != nil {
+			return
+		}
+		task = *bridge_task
+	}
+	return
+}
+
+// ValidateSources returns the files of a submission to the task named after
+// its submission format, or an error listing what is wrong with them. Outputs
+// of output only tasks may also be sent as a zip file.
+func ValidateSources(task bridge.Task, sources map[string][]byte, outputs []byte) (normalized map[string][]byte, err error) {
+	var problems []string
+	if len(outputs) > 0 {
+		if task.TaskType != bridge.TASK_TYPE_OUTPUT_ONLY {
+			problems = append(problems, fmt.Sprintf("task %s takes source code, not outputs", task.Name))
+		} else {
+			var unpacked map[string][]byte
+			unpacked, problems = UnpackOutputs(outputs, task.SubmissionFormat)
+			merged := make(map[string][]byte)
+			for filename, content := range sources {
+				merged[filename] = content
+			}
+			for filename, content := range unpacked {
+				if _, ok := merged[filename]; ok {
+					problems = append(problems, fmt.Sprintf("file %s was sent both inside and outside the zip file", filename))
+					continue
+				}
+				merged[filename] = content
+			}
+			sources = merged
+		}
+	}
+	if len(problems) == 0 {
+		normalized, problems = NormalizeSources(task.TaskType, task.SubmissionFormat, sources)
+	}
+	if len(problems) > 0 {
+		err = &OiaError{
+			HttpCode: http.StatusBadRequest,
+			Message:  "invalid files: " + strings.Join(problems, "; "),
+		}
+		return
+	}
+	return
+}
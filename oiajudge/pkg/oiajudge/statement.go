@@ -0,0 +1,187 @@
+package oiajudge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+)
+
+// Formats served when the client doesn't ask for one, most preferred first.
+// PDF comes first because it was the only format before.
+var StatementFormatPreference = []string{bridge.STATEMENT_PDF, bridge.STATEMENT_HTML, bridge.STATEMENT_MARKDOWN, bridge.STATEMENT_OTHER}
+
+// ParseAcceptLanguage returns the languages of an Accept-Language header,
+// most preferred first. Languages with q=0 are dropped.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		language string
+		q        float64
+	}
+	var languages []weighted
+	for _, part := range strings.Split(header, ",") {
+		language, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		language = strings.TrimSpace(language)
+		if language == "" || language == "*" {
+			continue
+		}
+		q := 1.0
+		params = strings.TrimSpace(params)
+		if strings.HasPrefix(params, "q=") {
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		languages = append(languages, weighted{language, q})
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].q > languages[j].q
+	})
+	res := make([]string, 0, len(languages))
+	for _, language := range languages {
+		res = append(res, language.language)
+	}
+	return res
+}
+
+// languageRank is the position of the first preferred language that matches
+// the statement language, or len(languages) if none does. es-AR matches es
+// and the other way around.
+func languageRank(language string, languages []string) int {
+	base := func(l string) string {
+		b, _, _ := strings.Cut(strings.ToLower(l), "-")
+		return b
+	}
+	for i, preferred := range languages {
+		if strings.EqualFold(preferred, language) || base(preferred) == base(language) {
+			return i
+		}
+	}
+	return len(languages)
+}
+
+func formatRank(format string) int {
+	for i, preferred := range StatementFormatPreference {
+		if preferred == format {
+			return i
+		}
+	}
+	return len(StatementFormatPreference)
+}
+
+// SelectStatement picks the statement that best matches the preferred
+// languages. If format isn't empty only statements in that format are
+// considered. Ties are broken by primary statements, and then by format.
+func SelectStatement(statements []bridge.TaskStatement, languages []string, format string) (statement bridge.TaskStatement, ok bool) {
+	candidates := make([]bridge.TaskStatement, 0, len(statements))
+	for _, statement := range statements {
+		if format == "" || statement.Format == format {
+			candidates = append(candidates, statement)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if ra, rb := languageRank(a.Language, languages), languageRank(b.Language, languages); ra != rb {
+			return ra < rb
+		}
+		if a.Primary != b.Primary {
+			return a.Primary
+		}
+		return formatRank(a.Format) < formatRank(b.Format)
+	})
+	return candidates[0], true
+}
+
+// GetTaskStatement returns the statement of a task that best matches the
+// preferred languages and the format, see SelectStatement
+func (s *Server) GetTaskStatement(ctx context.Context, tid Id, languages []string, format string) (statement bridge.TaskStatement, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = CheckTaskVisible(*tx, tid, s.GetTime())
+	if err != nil {
+		return
+	}
+	statements, err := GetTaskStatements(*tx, tid)
+	if err != nil {
+		return
+	}
+	statement, ok := SelectStatement(statements, languages, format)
+	if !ok {
+		message := fmt.Sprintf("task %d has no statement", tid)
+		if format != "" {
+			message = fmt.Sprintf("task %d has no %s statement", tid, format)
+		}
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  message,
+		}
+		return
+	}
+	return
+}
+
+// GetTaskStatementHtml returns the statement of a task as sanitized HTML,
+// rendering it if it is written in Markdown. The statement is picked like
+// in GetTaskStatement, among the ones that can be shown as HTML.
+func (s *Server) GetTaskStatementHtml(ctx context.Context, tid Id, languages []string) (statement bridge.TaskStatement, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	err = CheckTaskVisible(*tx, tid, s.GetTime())
+	if err != nil {
+		return
+	}
+	statements, err := GetTaskStatements(*tx, tid)
+	if err != nil {
+		return
+	}
+	textual := make([]bridge.TaskStatement, 0, len(statements))
+	for _, statement := range statements {
+		if statement.Format == bridge.STATEMENT_HTML || statement.Format == bridge.STATEMENT_MARKDOWN {
+			textual = append(textual, statement)
+		}
+	}
+	statement, ok := SelectStatement(textual, languages, "")
+	if !ok {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("task %d has no html or markdown statement", tid),
+		}
+		return
+	}
+
+	key := statementCacheKey(tid, statement.Content, statement.Format)
+	rendered, ok := s.renderedStatements.get(key)
+	if !ok {
+		if statement.Format == bridge.STATEMENT_MARKDOWN {
+			attachment_base := fmt.Sprintf("%s/task/attachment?task_id=%d&filename=", s.Config.PublicUrl, tid)
+			rendered, err = RenderStatement(statement.Content, attachment_base)
+			if err != nil {
+				return
+			}
+		} else {
+			rendered = SanitizeStatement(statement.Content)
+		}
+		s.renderedStatements.put(key, rendered)
+	}
+	statement.Format = bridge.STATEMENT_HTML
+	statement.ContentType = "text/html; charset=utf-8"
+	statement.Content = rendered
+	return
+}
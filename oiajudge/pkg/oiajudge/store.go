@@ -159,6 +159,25 @@ func CreateSubmission(tx store.Transaction, submission bridge.Submission) error
 	return nil
 }
 
+// SubmissionUnchanged checks if the stored submission is the same as the one
+// received from the bridge
+func SubmissionUnchanged(tx store.Transaction, submission bridge.Submission) (bool, error) {
+	data, err := json.Marshal(submission)
+	if err != nil {
+		return false, err
+	}
+	row := tx.QueryRow("SELECT details FROM oia_submissions WHERE id = $1", submission.Id)
+	var details string
+	err = row.Scan(&details)
+	if store.IsNoRows(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return details == string(data), nil
+}
+
 func GetAllScores(tx store.Transaction, uid Id, tid Id) (v [][]float64, err error) {
 	rows, err := tx.Query("SELECT subtask_details from oia_submissions WHERE user_id = $1 AND task_id = $2", uid, tid)
 	if err != nil {
@@ -225,21 +244,108 @@ func IncrementUserScore(tx store.Transaction, uid Id, delta float64) error {
 
 func SaveTask(tx store.Transaction, task bridge.Task) (err error) {
 	_, err = tx.Exec(`
-		INSERT INTO oia_task(id, title, name, statement, max_score, multiplier, submission_format, tags, attachments)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO oia_task(id, title, name, max_score, multiplier, submission_format, tags, attachments, time_limit, memory_limit, task_type, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 		ON CONFLICT(id) DO UPDATE SET
 			title = EXCLUDED.title,
 			name = EXCLUDED.name,
-			statement = EXCLUDED.statement,
 			max_score = EXCLUDED.max_score,
 			multiplier = EXCLUDED.multiplier,
 			tags = EXCLUDED.tags,
 			submission_format = EXCLUDED.submission_format,
-			attachments = EXCLUDED.attachments;`,
-		task.Id, task.Title, task.Name, task.Statement, task.MaxScore, task.Multiplier, task.SubmissionFormat, task.Tags, task.Attachments)
+			attachments = EXCLUDED.attachments,
+			time_limit = EXCLUDED.time_limit,
+			memory_limit = EXCLUDED.memory_limit,
+			task_type = EXCLUDED.task_type,
+			metadata = EXCLUDED.metadata;`,
+		task.Id, task.Title, task.Name, task.MaxScore, task.Multiplier, task.SubmissionFormat, task.Tags, task.Attachments, task.TimeLimit, task.MemoryLimit, task.TaskType, task.Metadata)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("DELETE FROM oia_task_statement WHERE task_id = $1", task.Id)
+	if err != nil {
+		return
+	}
+	for _, statement := range task.Statements {
+		_, err = tx.Exec(`
+			INSERT INTO oia_task_statement(task_id, language, format, content_type, is_primary, content)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			task.Id, statement.Language, statement.Format, statement.ContentType, statement.Primary, statement.Content)
+		if err != nil {
+			return
+		}
+	}
+	_, err = tx.Exec("DELETE FROM oia_task_sample WHERE task_id = $1", task.Id)
+	if err != nil {
+		return
+	}
+	for _, sample := range task.Samples {
+		_, err = tx.Exec(`
+			INSERT INTO oia_task_sample(task_id, codename, input, output, input_size, output_size)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			task.Id, sample.Codename, sample.Input, sample.Output, sample.InputSize, sample.OutputSize)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// DeleteTask hides a task, and takes its score away from the users. The
+// scores for the task are kept, so they can be given back if it is restored.
+func DeleteTask(tx store.Transaction, tid Id) (err error) {
+	tag, err := tx.Exec("UPDATE oia_task SET deleted = true WHERE id = $1 AND NOT deleted", tid)
+	if err != nil || tag.RowsAffected() == 0 {
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE oia_user SET score = oia_user.score - oia_task_score.score
+		FROM oia_task_score
+		WHERE oia_task_score.task_id = $1 AND oia_task_score.user_id = oia_user.id`, tid)
+	return
+}
+
+// RestoreTask shows a deleted task again, giving back its score to the users.
+// Only tasks restored in CMS keep their id: a task that is imported again gets
+// a new one, and is a different task for the judge. Its old submissions and
+// scores stay with the deleted task.
+func RestoreTask(tx store.Transaction, tid Id) (err error) {
+	tag, err := tx.Exec("UPDATE oia_task SET deleted = false WHERE id = $1 AND deleted", tid)
+	if err != nil || tag.RowsAffected() == 0 {
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE oia_user SET score = oia_user.score + oia_task_score.score
+		FROM oia_task_score
+		WHERE oia_task_score.task_id = $1 AND oia_task_score.user_id = oia_user.id`, tid)
+	return
+}
+
+// GetDeletedTasks returns the ids of the tasks deleted in CMS
+func GetDeletedTasks(tx store.Transaction) (deleted map[Id]bool, err error) {
+	rows, err := tx.Query("SELECT id FROM oia_task WHERE deleted")
 	if err != nil {
 		return
 	}
+	deleted = make(map[Id]bool)
+	for rows.Next() {
+		var tid Id
+		err = rows.Scan(&tid)
+		if err != nil {
+			return
+		}
+		deleted[tid] = true
+	}
+	return
+}
+
+// IsTaskDeleted returns whether the task was deleted. Unknown tasks are not
+// deleted.
+func IsTaskDeleted(tx store.Transaction, tid Id) (deleted bool, err error) {
+	err = tx.QueryRow("SELECT deleted FROM oia_task WHERE id = $1", tid).Scan(&deleted)
+	if store.IsNoRows(err) {
+		return false, nil
+	}
 	return
 }
 
@@ -285,35 +391,179 @@ func GetSubmission(tx store.Transaction, sid Id) (submission bridge.Submission,
 }
 
 func GetTasks(tx store.Transaction) (tasks []bridge.Task, err error) {
-	row, err := tx.Query("SELECT id, name, title, max_score, multiplier, submission_format, tags, attachments FROM oia_task")
+	row, err := tx.Query("SELECT id, name, title, max_score, multiplier, submission_format, tags, attachments, time_limit, memory_limit, task_type, metadata FROM oia_task WHERE NOT deleted")
 	if err != nil {
 		return
 	}
 	for row.Next() {
 		var task bridge.Task
-		err = row.Scan(&task.Id, &task.Name, &task.Title, &task.MaxScore, &task.Multiplier, &task.SubmissionFormat, &task.Tags, &task.Attachments)
+		err = row.Scan(&task.Id, &task.Name, &task.Title, &task.MaxScore, &task.Multiplier, &task.SubmissionFormat, &task.Tags, &task.Attachments, &task.TimeLimit, &task.MemoryLimit, &task.TaskType, &task.Metadata)
 		if err != nil {
 			return
 		}
 		tasks = append(tasks, task)
 	}
+	statements, err := getStatementVariants(tx, nil)
+	if err != nil {
+		return
+	}
+	for i := range tasks {
+		tasks[i].Statements = statements[tasks[i].Id]
+		if tasks[i].Statements == nil {
+			tasks[i].Statements = make([]bridge.TaskStatement, 0)
+		}
+	}
 	return
 }
 
 func GetSingleTask(tx store.Transaction, tid Id) (task bridge.Task, err error) {
-	row := tx.QueryRow("SELECT id, name, title, max_score, multiplier, submission_format, tags, attachments FROM oia_task WHERE id = $1", tid)
-	err = row.Scan(&task.Id, &task.Name, &task.Title, &task.MaxScore, &task.Multiplier, &task.SubmissionFormat, &task.Tags, &task.Attachments)
+	row := tx.QueryRow("SELECT id, name, title, max_score, multiplier, submission_format, tags, attachments, time_limit, memory_limit, task_type, metadata FROM oia_task WHERE id = $1 AND NOT deleted", tid)
+	err = row.Scan(&task.Id, &task.Name, &task.Title, &task.MaxScore, &task.Multiplier, &task.SubmissionFormat, &task.Tags, &task.Attachments, &task.TimeLimit, &task.MemoryLimit, &task.TaskType, &task.Metadata)
+	if err != nil {
+		return
+	}
+	statements, err := getStatementVariants(tx, &tid)
+	if err != nil {
+		return
+	}
+	task.Statements = statements[tid]
+	if task.Statements == nil {
+		task.Statements = make([]bridge.TaskStatement, 0)
+	}
+	return
+}
+
+// getStatementVariants lists the statements of a task, or of every task if
+// tid is nil, without their content
+func getStatementVariants(tx store.Transaction, tid *Id) (res map[Id][]bridge.TaskStatement, err error) {
+	rows, err := tx.Query(`
+		SELECT task_id, language, format, content_type, is_primary
+		FROM oia_task_statement
+		WHERE $1::bigint IS NULL OR task_id = $1
+		ORDER BY task_id, language, format`, tid)
+	if err != nil {
+		return
+	}
+	res = make(map[Id][]bridge.TaskStatement)
+	for rows.Next() {
+		var task_id Id
+		var statement bridge.TaskStatement
+		err = rows.Scan(&task_id, &statement.Language, &statement.Format, &statement.ContentType, &statement.Primary)
+		if err != nil {
+			return
+		}
+		res[task_id] = append(res[task_id], statement)
+	}
+	return
+}
+
+// GetTaskSamples returns the public testcases of a task
+func GetTaskSamples(tx store.Transaction, tid Id) (samples []bridge.SampleTestcase, err error) {
+	rows, err := tx.Query(`
+		SELECT codename, input, output, input_size, output_size
+		FROM oia_task_sample
+		WHERE task_id = $1
+		ORDER BY codename`, tid)
+	if err != nil {
+		return
+	}
+	samples = make([]bridge.SampleTestcase, 0)
+	for rows.Next() {
+		var sample bridge.SampleTestcase
+		err = rows.Scan(&sample.Codename, &sample.Input, &sample.Output, &sample.InputSize, &sample.OutputSize)
+		if err != nil {
+			return
+		}
+		samples = append(samples, sample)
+	}
+	return
+}
+
+// GetTaskStatements returns every statement of a task, with their content
+func GetTaskStatements(tx store.Transaction, tid Id) (statements []bridge.TaskStatement, err error) {
+	rows, err := tx.Query(`
+		SELECT language, format, content_type, is_primary, content
+		FROM oia_task_statement
+		WHERE task_id = $1
+		ORDER BY language, format`, tid)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var statement bridge.TaskStatement
+		err = rows.Scan(&statement.Language, &statement.Format, &statement.ContentType, &statement.Primary, &statement.Content)
+		if err != nil {
+			return
+		}
+		statements = append(statements, statement)
+	}
+	return
+}
+
+func GetTaskSummaries(tx store.Transaction, after Id, upto Id) (res map[Id]bridge.TaskSummary, err error) {
+	rows, err := tx.Query("SELECT id, name, title FROM oia_task WHERE id > $1 AND id <= $2 AND NOT deleted", after, upto)
 	if err != nil {
 		return
 	}
+	res = make(map[Id]bridge.TaskSummary)
+	for rows.Next() {
+		var task bridge.TaskSummary
+		err = rows.Scan(&task.Id, &task.Name, &task.Title)
+		if err != nil {
+			return
+		}
+		res[task.Id] = task
+	}
 	return
 }
 
-func GetTaskStatement(tx store.Transaction, tid Id) (statement []byte, err error) {
-	row := tx.QueryRow("SELECT statement FROM oia_task WHERE id = $1", tid)
-	err = row.Scan(&statement)
+func GetSubmissionSummaries(tx store.Transaction, after Id, upto Id) (res map[Id]bridge.SubmissionSummary, err error) {
+	rows, err := tx.Query(`
+		SELECT
+			id,
+			user_id,
+			task_id,
+			details::jsonb->>'submission_status',
+			COALESCE((details::jsonb->'result'->'score'->>'score')::float8, 0)
+		FROM oia_submissions
+		WHERE id > $1 AND id <= $2
+			-- Submissions of deleted tasks are kept on purpose
+			AND NOT EXISTS (SELECT 1 FROM oia_task WHERE oia_task.id = task_id AND deleted)`, after, upto)
 	if err != nil {
 		return
 	}
+	res = make(map[Id]bridge.SubmissionSummary)
+	for rows.Next() {
+		var submission bridge.SubmissionSummary
+		err = rows.Scan(&submission.Id, &submission.UserId, &submission.ProblemId, &submission.SubmissionStatus, &submission.Score)
+		if err != nil {
+			return
+		}
+		res[submission.Id] = submission
+	}
+	return
+}
+
+func GetUserSummaries(tx store.Transaction, after Id, upto Id) (res map[Id]bridge.UserSummary, err error) {
+	rows, err := tx.Query("SELECT id, username FROM oia_user WHERE id > $1 AND id <= $2", after, upto)
+	if err != nil {
+		return
+	}
+	res = make(map[Id]bridge.UserSummary)
+	for rows.Next() {
+		var user bridge.UserSummary
+		err = rows.Scan(&user.Id, &user.Username)
+		if err != nil {
+			return
+		}
+		res[user.Id] = user
+	}
+	return
+}
+
+// GetSubmissionOwner returns the user and task of a stored submission
+func GetSubmissionOwner(tx store.Transaction, sid Id) (uid Id, tid Id, err error) {
+	row := tx.QueryRow("SELECT user_id, task_id FROM oia_submissions WHERE id = $1", sid)
+	err = row.Scan(&uid, &tid)
 	return
 }
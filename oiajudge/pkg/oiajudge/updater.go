@@ -4,16 +4,15 @@ import (
 	"context"
 	"log"
 	"math"
+	"time"
 
 	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
 	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
 )
 
-func (s *Server) recalculateUserScoreForTask(tx store.Transaction, uid Id, tid Id) error {
-	scores, err := GetAllScores(tx, uid, tid)
-	if err != nil {
-		return err
-	}
+// BestSubtaskScore takes the subtask scores of many submissions, and adds up
+// the best score obtained on each subtask
+func BestSubtaskScore(scores [][]float64) float64 {
 	by_subtask := make([]float64, 0)
 	for _, v := range scores {
 		for len(by_subtask) < len(v) {
@@ -27,6 +26,21 @@ func (s *Server) recalculateUserScoreForTask(tx store.Transaction, uid Id, tid I
 	for _, v := range by_subtask {
 		base_score += v
 	}
+	return base_score
+}
+
+// isFinalStatus returns whether a submission won't change anymore, unless it
+// is rejudged
+func isFinalStatus(status bridge.SubmissionStatus) bool {
+	return status == bridge.SCORED || status == bridge.COMPILATION_FAILED
+}
+
+func (s *Server) recalculateUserScoreForTask(tx store.Transaction, uid Id, tid Id) error {
+	scores, err := GetAllScores(tx, uid, tid)
+	if err != nil {
+		return err
+	}
+	base_score := BestSubtaskScore(scores)
 	previous_score, err := GetUserTaskScore(tx, uid, tid)
 	if err != nil {
 		return err
@@ -35,6 +49,14 @@ func (s *Server) recalculateUserScoreForTask(tx store.Transaction, uid Id, tid I
 	if err != nil {
 		return err
 	}
+	// The score of deleted tasks doesn't count until they are restored
+	deleted, err := IsTaskDeleted(tx, tid)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		return nil
+	}
 	err = IncrementUserScore(tx, uid, score-previous_score)
 	if err != nil {
 		return err
@@ -43,6 +65,7 @@ func (s *Server) recalculateUserScoreForTask(tx store.Transaction, uid Id, tid I
 }
 
 func (s *Server) handleSubmission(ctx context.Context, submission_id Id) error {
+	read_at := time.Now()
 	submission, err := s.Bridge.GetSubmission(ctx, submission_id)
 	if err != nil {
 		return err
@@ -52,10 +75,50 @@ func (s *Server) handleSubmission(ctx context.Context, submission_id Id) error {
 		return err
 	}
 	defer tx.Close(&err)
+	if submission.Deleted {
+		// The bridge doesn't know the user and task of deleted submissions
+		submission.UserId, submission.ProblemId, err = GetSubmissionOwner(*tx, submission.Id)
+		if store.IsNoRows(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Submissions deleted along with their task are kept for history
+		var task *bridge.Task
+		task, err = s.Bridge.GetTask(ctx, submission.ProblemId)
+		if err != nil {
+			return err
+		}
+		if task.Deleted {
+			return nil
+		}
+	} else {
+		// Many events are produced for every submission, most of them
+		// while it is being evaluated
+		var unchanged bool
+		unchanged, err = SubmissionUnchanged(*tx, *submission)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			s.UnchangedSubmissions.Add(1)
+			if isFinalStatus(submission.SubmissionStatus) {
+				return MarkRejudged(*tx, submission.Id, read_at)
+			}
+			return nil
+		}
+	}
 	err = CreateSubmission(*tx, *submission)
 	if err != nil {
 		return err
 	}
+	if submission.Deleted || isFinalStatus(submission.SubmissionStatus) {
+		err = MarkRejudged(*tx, submission.Id, read_at)
+		if err != nil {
+			return err
+		}
+	}
 	err = s.recalculateUserScoreForTask(*tx, submission.UserId, submission.ProblemId)
 	if err != nil {
 		return err
@@ -73,6 +136,13 @@ func (s *Server) handleTask(ctx context.Context, task_id Id) error {
 		return err
 	}
 	defer tx.Close(&err)
+	if task.Deleted {
+		return DeleteTask(*tx, task_id)
+	}
+	err = RestoreTask(*tx, task_id)
+	if err != nil {
+		return err
+	}
 	err = SaveTask(*tx, *task)
 	if err != nil {
 		return err
@@ -0,0 +1,147 @@
+package oiajudge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+const (
+	MaxUserTestInput  = 1 << 20
+	MaxUserTestOutput = 64 << 10
+)
+
+type MakeUserTestQuery struct {
+	Task Id `json:"task_id"`
+	User Id `json:"user_id"`
+
+	Sources map[string][]byte `json:"sources"`
+	Input   []byte            `json:"input"`
+}
+
+func (q MakeUserTestQuery) Uid() Id {
+	return q.User
+}
+
+type MakeUserTestResponse struct {
+	UserTest Id `json:"user_test"`
+}
+
+// MakeUserTest runs the sources on the given input. User tests have their own
+// cooldown, so they don't delay the next submission.
+func (s *Server) MakeUserTest(ctx context.Context, q MakeUserTestQuery) (r MakeUserTestResponse, err error) {
+	if len(q.Input) > MaxUserTestInput {
+		err = &OiaError{
+			HttpCode: http.StatusRequestEntityTooLarge,
+			Message:  fmt.Sprintf("the input can't be longer than %d bytes", MaxUserTestInput),
+		}
+		return
+	}
+	task, err := s.GetSubmissionTask(ctx, q.Task)
+	if err != nil {
+		return
+	}
+	switch task.TaskType {
+	case bridge.TASK_TYPE_BATCH, bridge.TASK_TYPE_COMMUNICATION:
+	case bridge.TASK_TYPE_OUTPUT_ONLY:
+		err = &OiaError{
+			HttpCode: http.StatusBadRequest,
+			Message:  fmt.Sprintf("task %s is output only, there is no program to test", task.Name),
+		}
+		return
+	default:
+		err = &OiaError{
+			HttpCode: http.StatusBadRequest,
+			Message:  fmt.Sprintf("task %s is %s, which doesn't support user tests", task.Name, task.TaskType),
+		}
+		return
+	}
+	q.Sources, err = ValidateSources(task, q.Sources, nil)
+	if err != nil {
+		return
+	}
+	_, err = s.CheckContestWindow(ctx, q.User, q.Task)
+	if err != nil {
+		return
+	}
+	err = CanUserTest(s, ctx, q.User)
+	if err != nil {
+		return
+	}
+	r.UserTest, err = s.Bridge.MakeUserTest(ctx, q.User, q.Task, q.Sources, q.Input)
+	return
+}
+
+func CanUserTest(s *Server, ctx context.Context, uid Id) (err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+
+	now := s.GetTime()
+	last_test, err := LastUserTest(*tx, uid)
+	if err != nil {
+		return
+	}
+	if last_test.Add(s.Config.UserTestCooldown).After(now) {
+		err = fmt.Errorf("wait %v before retrying", last_test.Add(s.Config.UserTestCooldown).Sub(now))
+		err = &OiaError{
+			HttpCode:      http.StatusTooManyRequests,
+			Message:       err.Error(),
+			InternalError: err,
+		}
+		return
+	}
+	err = SetUserTest(*tx, uid, now)
+	return
+}
+
+func LastUserTest(tx store.Transaction, uid Id) (t time.Time, err error) {
+	row := tx.QueryRow("SELECT last_user_test_ms FROM oia_user WHERE id = $1", uid)
+	var unixms int64
+	err = row.Scan(&unixms)
+	if err != nil {
+		return
+	}
+	t = time.UnixMilli(unixms)
+	return
+}
+
+func SetUserTest(tx store.Transaction, uid Id, t time.Time) error {
+	_, err := tx.Exec("UPDATE oia_user SET last_user_test_ms = $1 WHERE id = $2", t.UnixMilli(), uid)
+	return err
+}
+
+type GetUserTestQuery struct {
+	UserId     Id `json:"user_id"`
+	UserTestId Id `json:"user_test_id"`
+}
+
+func (q GetUserTestQuery) Uid() Id {
+	return q.UserId
+}
+
+type GetUserTestResponse struct {
+	UserTest bridge.UserTest `json:"user_test"`
+}
+
+func (s *Server) GetUserTest(ctx context.Context, q GetUserTestQuery) (r GetUserTestResponse, err error) {
+	test, err := s.Bridge.GetUserTest(ctx, q.UserTestId, MaxUserTestOutput)
+	if store.IsNoRows(err) || (err == nil && test.UserId != q.UserId) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("user test %d not found", q.UserTestId),
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	r.UserTest = *test
+	return
+}
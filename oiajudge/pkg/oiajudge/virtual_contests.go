@@ -0,0 +1,591 @@
+package oiajudge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/carlosmiguelsoto/oiajudge/pkg/bridge"
+	"github.com/carlosmiguelsoto/oiajudge/pkg/store"
+)
+
+const (
+	DefaultVirtualContestDuration = 3 * time.Hour
+	YearTagPrefix                 = "año:"
+	CertamenTagPrefix             = "certamen:"
+)
+
+// EditionName identifies an edition of the olympiad, like `2023/selectivo`.
+// Virtual contests and historic results of the same edition share the name.
+func EditionName(year, certamen string) string {
+	return strings.ToLower(fmt.Sprintf("%s/%s", strings.TrimSpace(year), strings.TrimSpace(certamen)))
+}
+
+// EditionTasks returns the tasks tagged with both the year and the certamen
+func EditionTasks(tasks []bridge.Task, year, certamen string) (res []bridge.Task) {
+	for _, task := range tasks {
+		has_year, has_certamen := false, false
+		for _, tag := range task.Tags {
+			has_year = has_year || strings.EqualFold(tag, YearTagPrefix+strings.TrimSpace(year))
+			has_certamen = has_certamen || strings.EqualFold(tag, CertamenTagPrefix+strings.TrimSpace(certamen))
+		}
+		if has_year && has_certamen {
+			res = append(res, task)
+		}
+	}
+	return
+}
+
+type ContestSubmission struct {
+	SubmissionId Id
+	UserId       Id
+	TaskId       Id
+	SubmittedAt  time.Time
+	// Empty if the submission wasn't received from the bridge yet
+	Status   bridge.SubmissionStatus
+	Subtasks []float64
+}
+
+func (s ContestSubmission) Pending() bool {
+	return s.Status != bridge.SCORED && s.Status != bridge.COMPILATION_FAILED
+}
+
+type ContestTaskResult struct {
+	TaskId      Id      `json:"task_id"`
+	Score       float64 `json:"score"`
+	MaxScore    float64 `json:"max_score"`
+	Submissions int64   `json:"submissions"`
+	// Submissions that are still being evaluated
+	Pending int64 `json:"pending"`
+	// Whether the user gave up on the task to see its editorial
+	GaveUp bool `json:"gave_up"`
+}
+
+// MarkGiveUps flags the results of the tasks the user gave up on
+func MarkGiveUps(results []ContestTaskResult, gave_up map[Id]bool) {
+	for i := range results {
+		results[i].GaveUp = gave_up[results[i].TaskId]
+	}
+}
+
+// ScoreContest computes the results of a single user over the contest tasks,
+// taking the best score of every subtask like the archive does.
+func ScoreContest(tasks []bridge.Task, submissions []ContestSubmission) (results []ContestTaskResult, total float64) {
+	by_task := make(map[Id][][]float64)
+	results = make([]ContestTaskResult, 0, len(tasks))
+	index := make(map[Id]int)
+	for _, task := range tasks {
+		index[task.Id] = len(results)
+		results = append(results, ContestTaskResult{TaskId: task.Id, MaxScore: task.MaxScore})
+	}
+	for _, submission := range submissions {
+		i, ok := index[submission.TaskId]
+		if !ok {
+			continue
+		}
+		results[i].Submissions += 1
+		if submission.Pending() {
+			results[i].Pending += 1
+			continue
+		}
+		by_task[submission.TaskId] = append(by_task[submission.TaskId], submission.Subtasks)
+	}
+	for i := range results {
+		results[i].Score = BestSubtaskScore(by_task[results[i].TaskId])
+		total += results[i].Score
+	}
+	return
+}
+
+type VirtualContest struct {
+	Id        Id        `json:"id"`
+	UserId    Id        `json:"user_id"`
+	Name      string    `json:"name"`
+	Tasks     []Id      `json:"tasks"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+type HistoricComparison struct {
+	// Position the user would have had in the real contest
+	Rank        int64 `json:"rank"`
+	Contestants int64 `json:"contestants"`
+}
+
+type VirtualContestResult struct {
+	Contest  VirtualContest      `json:"contest"`
+	Running  bool                `json:"running"`
+	Tasks    []ContestTaskResult `json:"tasks"`
+	Total    float64             `json:"total"`
+	MaxTotal float64             `json:"max_total"`
+	// Nil if no historic results were imported for this edition
+	Historic *HistoricComparison `json:"historic"`
+}
+
+type StartVirtualContestQuery struct {
+	UserId   Id     `json:"user_id"`
+	Year     string `json:"year"`
+	Certamen string `json:"certamen"`
+	// Defaults to DefaultVirtualContestDuration
+	DurationMinutes int64 `json:"duration_minutes"`
+}
+
+func (q StartVirtualContestQuery) Uid() Id {
+	return q.UserId
+}
+
+type StartVirtualContestResponse struct {
+	Contest VirtualContest `json:"contest"`
+}
+
+func (s *Server) StartVirtualContest(ctx context.Context, q StartVirtualContestQuery) (r StartVirtualContestResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	now := s.GetTime()
+	active, err := GetActiveVirtualContest(*tx, q.UserId, now)
+	if err != nil {
+		return
+	}
+	if active != nil {
+		err = &OiaError{
+			HttpCode: http.StatusConflict,
+			Message:  fmt.Sprintf("virtual contest %d is still running", active.Id),
+		}
+		return
+	}
+	tasks, err := GetTasks(*tx)
+	if err != nil {
+		return
+	}
+	edition := EditionTasks(tasks, q.Year, q.Certamen)
+	if len(edition) == 0 {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("no tasks tagged with %s%s and %s%s", YearTagPrefix, q.Year, CertamenTagPrefix, q.Certamen),
+		}
+		return
+	}
+	duration := DefaultVirtualContestDuration
+	if q.DurationMinutes > 0 {
+		duration = time.Duration(q.DurationMinutes) * time.Minute
+	}
+	contest := VirtualContest{
+		UserId:    q.UserId,
+		Name:      EditionName(q.Year, q.Certamen),
+		StartTime: now,
+		EndTime:   now.Add(duration),
+	}
+	for _, task := range edition {
+		contest.Tasks = append(contest.Tasks, task.Id)
+	}
+	row := tx.QueryRow(`
+		INSERT INTO oia_virtual_contest(user_id, name, task_ids, start_time, end_time)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		contest.UserId, contest.Name, contest.Tasks, contest.StartTime, contest.EndTime)
+	err = row.Scan(&contest.Id)
+	if err != nil {
+		return
+	}
+	r.Contest = contest
+	return
+}
+
+type FinishVirtualContestQuery struct {
+	UserId    Id `json:"user_id"`
+	ContestId Id `json:"contest_id"`
+}
+
+func (q FinishVirtualContestQuery) Uid() Id {
+	return q.UserId
+}
+
+type FinishVirtualContestResponse struct{}
+
+// FinishVirtualContest ends a running virtual contest before its time is up
+func (s *Server) FinishVirtualContest(ctx context.Context, q FinishVirtualContestQuery) (r FinishVirtualContestResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	now := s.GetTime()
+	_, err = tx.Exec("UPDATE oia_virtual_contest SET end_time = $3 WHERE id = $1 AND user_id = $2 AND end_time > $3",
+		q.ContestId, q.UserId, now)
+	if err != nil {
+		return
+	}
+	return
+}
+
+type GetVirtualContestQuery struct {
+	UserId    Id `json:"user_id"`
+	ContestId Id `json:"contest_id"`
+}
+
+func (q GetVirtualContestQuery) Uid() Id {
+	return q.UserId
+}
+
+type GetVirtualContestResponse struct {
+	Result VirtualContestResult `json:"result"`
+}
+
+func (s *Server) GetVirtualContest(ctx context.Context, q GetVirtualContestQuery) (r GetVirtualContestResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	contest, err := GetVirtualContest(*tx, q.ContestId)
+	if err != nil {
+		return
+	}
+	if contest.UserId != q.UserId {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("virtual contest %d not found", q.ContestId),
+		}
+		return
+	}
+	historic, err := GetHistoricTotals(*tx, contest.Name)
+	if err != nil {
+		return
+	}
+	r.Result, err = ScoreVirtualContest(*tx, contest, historic, s.GetTime())
+	if err != nil {
+		return
+	}
+	return
+}
+
+type GetVirtualScoreboardQuery struct {
+	Year     string `json:"year"`
+	Certamen string `json:"certamen"`
+}
+
+type VirtualScoreboardEntry struct {
+	Username string               `json:"username"`
+	Result   VirtualContestResult `json:"result"`
+}
+
+type HistoricResult struct {
+	Contestant string             `json:"contestant"`
+	Total      float64            `json:"total"`
+	TaskScores map[string]float64 `json:"task_scores"`
+}
+
+type GetVirtualScoreboardResponse struct {
+	Name string `json:"name"`
+	// Finished virtual contests, best first
+	Virtual []VirtualScoreboardEntry `json:"virtual"`
+	// Results of the real contest, best first
+	Historic []HistoricResult `json:"historic"`
+}
+
+func (s *Server) GetVirtualScoreboard(ctx context.Context, q GetVirtualScoreboardQuery) (r GetVirtualScoreboardResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.Name = EditionName(q.Year, q.Certamen)
+	now := s.GetTime()
+	r.Historic, err = GetHistoricResults(*tx, r.Name)
+	if err != nil {
+		return
+	}
+	historic := make([]float64, 0, len(r.Historic))
+	for _, h := range r.Historic {
+		historic = append(historic, h.Total)
+	}
+
+	rows, err := tx.Query(`
+		SELECT oia_virtual_contest.id, oia_user.username
+		FROM oia_virtual_contest
+			INNER JOIN oia_user ON oia_user.id = oia_virtual_contest.user_id
+		WHERE name = $1 AND end_time <= $2
+		ORDER BY oia_virtual_contest.id`, r.Name, now)
+	if err != nil {
+		return
+	}
+	ids := make([]Id, 0)
+	usernames := make([]string, 0)
+	for rows.Next() {
+		var id Id
+		var username string
+		err = rows.Scan(&id, &username)
+		if err != nil {
+			return
+		}
+		ids = append(ids, id)
+		usernames = append(usernames, username)
+	}
+	r.Virtual = make([]VirtualScoreboardEntry, 0, len(ids))
+	for i, id := range ids {
+		var contest VirtualContest
+		contest, err = GetVirtualContest(*tx, id)
+		if err != nil {
+			return
+		}
+		var result VirtualContestResult
+		result, err = ScoreVirtualContest(*tx, contest, historic, now)
+		if err != nil {
+			return
+		}
+		r.Virtual = append(r.Virtual, VirtualScoreboardEntry{Username: usernames[i], Result: result})
+	}
+	sort.SliceStable(r.Virtual, func(i, j int) bool {
+		return r.Virtual[i].Result.Total > r.Virtual[j].Result.Total
+	})
+	return
+}
+
+type ImportHistoricResultsQuery struct {
+	Year     string           `json:"year"`
+	Certamen string           `json:"certamen"`
+	Results  []HistoricResult `json:"results"`
+}
+
+type ImportHistoricResultsResponse struct {
+	Name     string `json:"name"`
+	Imported int64  `json:"imported"`
+}
+
+// ImportHistoricResults replaces the real scoreboard of an edition. If a
+// result has no total, the task scores are added up.
+func (s *Server) ImportHistoricResults(ctx context.Context, q ImportHistoricResultsQuery) (r ImportHistoricResultsResponse, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	r.Name = EditionName(q.Year, q.Certamen)
+	_, err = tx.Exec("DELETE FROM oia_historic_result WHERE name = $1", r.Name)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, result := range q.Results {
+		if seen[result.Contestant] {
+			err = &OiaError{
+				HttpCode: http.StatusBadRequest,
+				Message:  fmt.Sprintf("contestant %s appears more than once", result.Contestant),
+			}
+			return
+		}
+		seen[result.Contestant] = true
+		if result.TaskScores == nil {
+			result.TaskScores = make(map[string]float64)
+		}
+		if result.Total == 0 {
+			for _, score := range result.TaskScores {
+				result.Total += score
+			}
+		}
+		var task_scores []byte
+		task_scores, err = json.Marshal(result.TaskScores)
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec("INSERT INTO oia_historic_result(name, contestant, total, task_scores) VALUES ($1, $2, $3, $4)",
+			r.Name, result.Contestant, result.Total, string(task_scores))
+		if err != nil {
+			return
+		}
+		r.Imported += 1
+	}
+	return
+}
+
+// GetVirtualContestForTask returns the virtual contest the user is taking,
+// if it has the task
+func (s *Server) GetVirtualContestForTask(ctx context.Context, uid Id, tid Id) (contest *VirtualContest, err error) {
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	active, err := GetActiveVirtualContest(*tx, uid, s.GetTime())
+	if err != nil || active == nil {
+		return
+	}
+	for _, contest_task := range active.Tasks {
+		if contest_task == tid {
+			return active, nil
+		}
+	}
+	return
+}
+
+// RegisterVirtualSubmission makes the submission count towards the virtual
+// contest the user is taking, if any.
+func (s *Server) RegisterVirtualSubmission(ctx context.Context, contest *VirtualContest, tid Id, sid Id) (err error) {
+	if contest == nil {
+		return
+	}
+	tx, err := s.Db.Tx(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Close(&err)
+	_, err = tx.Exec("INSERT INTO oia_virtual_submission(submission_id, contest_id, task_id, submitted_at) VALUES ($1, $2, $3, $4)",
+		sid, contest.Id, tid, s.GetTime())
+	return
+}
+
+func ScoreVirtualContest(tx store.Transaction, contest VirtualContest, historic []float64, now time.Time) (result VirtualContestResult, err error) {
+	result.Contest = contest
+	result.Running = !now.Before(contest.StartTime) && now.Before(contest.EndTime)
+	tasks, err := GetTasks(tx)
+	if err != nil {
+		return
+	}
+	by_id := make(map[Id]bridge.Task)
+	for _, task := range tasks {
+		by_id[task.Id] = task
+	}
+	contest_tasks := make([]bridge.Task, 0, len(contest.Tasks))
+	for _, tid := range contest.Tasks {
+		task, ok := by_id[tid]
+		if !ok {
+			task = bridge.Task{Id: tid}
+		}
+		contest_tasks = append(contest_tasks, task)
+		result.MaxTotal += task.MaxScore
+	}
+	submissions, err := GetContestSubmissions(tx, `
+		SELECT oia_virtual_submission.submission_id, oia_virtual_contest.user_id, oia_virtual_submission.task_id,
+			oia_virtual_submission.submitted_at, oia_submissions.details, oia_submissions.subtask_details
+		FROM oia_virtual_submission
+			INNER JOIN oia_virtual_contest ON oia_virtual_contest.id = oia_virtual_submission.contest_id
+			LEFT JOIN oia_submissions ON oia_submissions.id = oia_virtual_submission.submission_id
+		WHERE oia_virtual_submission.contest_id = $1`, contest.Id)
+	if err != nil {
+		return
+	}
+	result.Tasks, result.Total = ScoreContest(contest_tasks, submissions)
+	gave_up, err := GetTaskGiveUps(tx, contest.Tasks)
+	if err != nil {
+		return
+	}
+	MarkGiveUps(result.Tasks, gave_up[contest.UserId])
+	if len(historic) > 0 {
+		result.Historic = &HistoricComparison{Rank: 1, Contestants: int64(len(historic))}
+		for _, total := range historic {
+			if total > result.Total+1e-6 {
+				result.Historic.Rank += 1
+			}
+		}
+	}
+	return
+}
+
+// GetContestSubmissions runs a query returning (submission id, user id,
+// task id, submission time, details, subtask details), where the last two
+// come from a LEFT JOIN with oia_submissions.
+func GetContestSubmissions(tx store.Transaction, query string, args ...any) (submissions []ContestSubmission, err error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var submission ContestSubmission
+		var details *string
+		var subtask_details *string
+		err = rows.Scan(&submission.SubmissionId, &submission.UserId, &submission.TaskId, &submission.SubmittedAt, &details, &subtask_details)
+		if err != nil {
+			return
+		}
+		if details != nil {
+			var parsed bridge.Submission
+			err = json.Unmarshal([]byte(*details), &parsed)
+			if err != nil {
+				return
+			}
+			submission.Status = parsed.SubmissionStatus
+		}
+		if subtask_details != nil {
+			err = json.Unmarshal([]byte(*subtask_details), &submission.Subtasks)
+			if err != nil {
+				return
+			}
+		}
+		submissions = append(submissions, submission)
+	}
+	return
+}
+
+func GetVirtualContest(tx store.Transaction, id Id) (contest VirtualContest, err error) {
+	row := tx.QueryRow("SELECT id, user_id, name, task_ids, start_time, end_time FROM oia_virtual_contest WHERE id = $1", id)
+	err = row.Scan(&contest.Id, &contest.UserId, &contest.Name, &contest.Tasks, &contest.StartTime, &contest.EndTime)
+	if store.IsNoRows(err) {
+		err = &OiaError{
+			HttpCode: http.StatusNotFound,
+			Message:  fmt.Sprintf("virtual contest %d not found", id),
+		}
+		return
+	}
+	return
+}
+
+// GetActiveVirtualContest returns nil if the user isn't taking a virtual
+// contest at the given time
+func GetActiveVirtualContest(tx store.Transaction, uid Id, now time.Time) (*VirtualContest, error) {
+	row := tx.QueryRow(`
+		SELECT id FROM oia_virtual_contest
+		WHERE user_id = $1 AND start_time <= $2 AND end_time > $2
+		ORDER BY id DESC LIMIT 1`, uid, now)
+	var id Id
+	err := row.Scan(&id)
+	if store.IsNoRows(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	contest, err := GetVirtualContest(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &contest, nil
+}
+
+func GetHistoricResults(tx store.Transaction, name string) (results []HistoricResult, err error) {
+	rows, err := tx.Query("SELECT contestant, total, task_scores FROM oia_historic_result WHERE name = $1 ORDER BY total DESC, contestant", name)
+	if err != nil {
+		return
+	}
+	results = make([]HistoricResult, 0)
+	for rows.Next() {
+		var result HistoricResult
+		var task_scores string
+		err = rows.Scan(&result.Contestant, &result.Total, &task_scores)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal([]byte(task_scores), &result.TaskScores)
+		if err != nil {
+			return
+		}
+		results = append(results, result)
+	}
+	return
+}
+
+func GetHistoricTotals(tx store.Transaction, name string) (totals []float64, err error) {
+	results, err := GetHistoricResults(tx, name)
+	if err != nil {
+		return
+	}
+	for _, result := range results {
+		totals = append(totals, result.Total)
+	}
+	return
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	listenerBackoffMin = 100 * time.Millisecond
+	listenerBackoffMax = 30 * time.Second
+)
+
+type ListenerState string
+
+const (
+	ListenerConnecting ListenerState = "connecting"
+	ListenerListening  ListenerState = "listening"
+	ListenerStopped    ListenerState = "stopped"
+)
+
+type ListenerStatus struct {
+	State ListenerState
+	// When the listener entered its current state
+	Since      time.Time
+	Reconnects int64
+	LastError  string
+}
+
+// Listener receives the notifications of a Postgres channel on a dedicated
+// connection, which is reopened whenever it breaks. Notifications sent while
+// the connection was down are lost, so after every reconnection an empty
+// notification is delivered to let the receiver catch up.
+type Listener struct {
+	Notifications chan string
+
+	channel string
+	mu      sync.Mutex
+	status  ListenerStatus
+}
+
+func (l *Listener) Status() ListenerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status
+}
+
+func (l *Listener) setState(state ListenerState, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.status.State != state {
+		l.status.State = state
+		l.status.Since = time.Now()
+	}
+	if err != nil {
+		l.status.LastError = err.Error()
+	}
+}
+
+func (l *Listener) connect(ctx context.Context, db *DBClient) (conn *pgxpool.Conn, err error) {
+	conn, err = db.pool.Acquire(ctx)
+	if err != nil {
+		return
+	}
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{l.channel}.Sanitize())
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+	return
+}
+
+// wait delivers notifications until the connection breaks or ctx is done
+func (l *Listener) wait(ctx context.Context, conn *pgxpool.Conn) error {
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		select {
+		case l.Notifications <- notification.Payload:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *Listener) run(ctx context.Context, db *DBClient, conn *pgxpool.Conn) {
+	defer close(l.Notifications)
+	defer l.setState(ListenerStopped, nil)
+	for {
+		l.setState(ListenerListening, nil)
+		err := l.wait(ctx, conn)
+		// The connection may be broken, and it is still listening otherwise,
+		// so it is closed instead of going back to the pool
+		conn.Conn().Close(context.Background())
+		conn.Release()
+		if ctx.Err() != nil {
+			return
+		}
+		l.setState(ListenerConnecting, err)
+		log.Printf("Listener(%s): lost connection: %s. Reconnecting", l.channel, err)
+
+		backoff := listenerBackoffMin
+		for {
+			conn, err = l.connect(ctx, db)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			l.setState(ListenerConnecting, err)
+			log.Printf("Listener(%s): couldn't listen: %s. Retrying in %s", l.channel, err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff *= 2
+			if backoff > listenerBackoffMax {
+				backoff = listenerBackoffMax
+			}
+		}
+		l.mu.Lock()
+		l.status.Reconnects += 1
+		l.mu.Unlock()
+		select {
+		case l.Notifications <- "":
+		case <-ctx.Done():
+			conn.Conn().Close(context.Background())
+			conn.Release()
+			return
+		}
+	}
+}
+
+// ListenOn starts listening on the given channel until ctx is done. It fails
+// only if the first connection can't be made.
+func (db *DBClient) ListenOn(ctx context.Context, channel string) (*Listener, error) {
+	l := &Listener{
+		Notifications: make(chan string),
+		channel:       channel,
+		status:        ListenerStatus{State: ListenerConnecting, Since: time.Now()},
+	}
+	conn, err := l.connect(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	go l.run(ctx, db, conn)
+	return l, nil
+}
@@ -25,9 +25,6 @@ type Transaction struct {
 
 func (db *DBClient) Tx(ctx context.Context) (*Transaction, error) {
 	conn, err := db.pool.Acquire(ctx)
-	if err != nil {
-		return nil, nil
-	}
 	if err != nil {
 		return nil, err
 	}
@@ -39,29 +36,6 @@ func (db *DBClient) Tx(ctx context.Context) (*Transaction, error) {
 	return &Transaction{Ctx: ctx, Tx: tx, Conn: conn}, nil
 }
 
-func (db *DBClient) ListenOn(ctx context.Context, channel string) (chan string, error) {
-	conn, err := db.pool.Acquire(ctx)
-	if err != nil {
-		return nil, err
-	}
-	_, err = conn.Exec(ctx, "LISTEN event_queue")
-	if err != nil {
-		return nil, err
-	}
-	notifications := make(chan string)
-	go func() {
-		for {
-			notification, err := conn.Conn().WaitForNotification(ctx)
-			if err != nil {
-				break
-			}
-			notifications <- notification.Payload
-		}
-		conn.Release()
-	}()
-	return notifications, nil
-}
-
 func (tx *Transaction) Close(func_error *error) (err error) {
 	if tx == nil {
 		return nil
@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+)
+
+func GetenvIntWithDefault(env string, def int64) int64 {
+	res, err := strconv.ParseInt(os.Getenv(env), 10, 64)
+	if err != nil {
+		return def
+	}
+	return res
+}
@@ -29,4 +29,5 @@ Config.env = {
     "OIAJ_SERVER_PORT": "1367",
     "OIAJ_CMS_BRIDGE_ADDRESS": "http://localhost:1366",
     "OIAJ_DEBUG": "true",
+    "OIAJ_ADMIN_TOKEN": "admin-token",
 }
@@ -46,6 +46,10 @@ class OiaService:
     def set_access_token(self, token):
         self.token = token
 
+    def admin_post(self, url, *args, **kwargs):
+        headers = {"Authorization": f"Bearer {Config.env['OIAJ_ADMIN_TOKEN']}"}
+        return requests.post(f"{self.url()}{url}", *args, headers=headers, **kwargs)
+
     def stop(self, extra_envs=None, old_version=False):
         utils.run('screen -S oiajudge -X quit')
 
@@ -80,6 +84,16 @@ class DatabaseService:
             "PGPASSWORD": "postgres"
         })
 
+    def execute(self, sql):
+        utils.run(f'psql -U postgres -d postgres -h db -c {utils.esc(sql)}', env={
+            "PGPASSWORD": "postgres"
+        })
+
+    def query(self, sql):
+        return utils.output(f'psql -U postgres -d postgres -h db -t -A -c {utils.esc(sql)}', env={
+            "PGPASSWORD": "postgres"
+        }).strip()
+
     def populate_with_contests(self, contests):
         Database.clear()
         Cms.init_db()
@@ -1,5 +1,9 @@
 import base64
+import io
+import json
+import time
 import unittest
+import zipfile
 
 from oia.services import Database, Cms, Oia, All
 from oia.config import Config
@@ -162,11 +166,193 @@ class OiaTests(unittest.TestCase):
         submission = Oia.post('/submissions/get', json={"user_id": uid, "task_id": 1}).json()["submissions"][0]
 
         self.assertEqual(submission["result"]["score"], {"score": 2, "max_score": 2})
+        for testcase in submission["result"]["testcases"]:
+            self.assertEqual(testcase["verdict"], "ok")
+
+        # Scored submissions have no progress
+        single = Oia.post('/submissions/get/single', json={"submission_id": submission["id"]}).json()["submission"]
+        self.assertNotIn("progress", single)
 
         resp = Oia.post(f'/user/get', json={"user_id": uid}).json()
         # max_score * score_multiplier
         self.assertEqual(resp["score"], 8)
 
+        # the submission goes through many states, each one producing events
+        stats = Oia.admin_post('/admin/events/stats', json={}).json()
+        self.assertGreater(stats["queue"]["processed"], 0)
+        self.assertEqual(stats["queue"]["dead"], 0)
+
+        # Everything is up to date, so the reconciliation finds no differences
+        report = Oia.admin_post('/admin/reconcile', json={"dry_run": True}).json()["report"]
+        for kind in ["tasks", "submissions", "users"]:
+            self.assertEqual(report[kind]["missing_in_judge"]["count"], 0)
+            self.assertEqual(report[kind]["missing_in_cms"]["count"], 0)
+            self.assertEqual(report[kind]["changed"]["count"], 0)
+        self.assertEqual(report["submissions"]["checked"], 1)
+
+    def test_submission_progress(self):
+        Database.populate_with_contests(["envido"])
+        # CMS isn't started, so the submissions stay pending
+        Oia.start(extra_envs={"OIAJ_SUBMISSION_COOLDOWN_MS": 0})
+
+        with open(Config.TASK_PATH / 'envido.cpp', "rb") as f:
+            source = f.read()
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+        sids = []
+        for _ in range(2):
+            sids.append(Oia.post(f'/submission/create', json={
+                "task_id": 1,
+                "user_id": uid,
+                "sources": {
+                    "envido.%l": base64.b64encode(source).decode('utf-8')
+                }
+            }, can_fail=False).json()["submission"])
+
+        def submissions_ready():
+            submissions = Oia.post('/submissions/get', json={"user_id": uid, "task_id": 1}).json()["submissions"]
+            return len(submissions) == 2
+        utils.wait_for(submissions_ready)
+
+        total = int(Database.query("SELECT count(*) FROM testcases WHERE dataset_id = (SELECT active_dataset_id FROM tasks WHERE id = 1)"))
+        self.assertGreater(total, 0)
+        for position, sid in enumerate(sids, start=1):
+            single = Oia.post('/submissions/get/single', json={"submission_id": sid}).json()["submission"]
+            self.assertNotEqual(single["submission_status"], "scored")
+            self.assertEqual(single["progress"]["queue_position"], position)
+            self.assertEqual(single["progress"]["evaluated_testcases"], 0)
+            self.assertEqual(single["progress"]["total_testcases"], total)
+            # Nothing was evaluated, so there is no throughput to estimate from
+            self.assertNotIn("eta_seconds", single["progress"])
+
+    def test_event_workers(self):
+        Database.populate_with_contests(["envido"])
+        Cms.start()
+        Oia.start(extra_envs={"OIAJ_SUBMISSION_COOLDOWN_MS": 0, "OIAJ_EVENT_WORKERS": 4})
+
+        sources = {}
+        for name in ["envido.cpp", "envido_compilation_error.cpp"]:
+            with open(Config.TASK_PATH / name, "rb") as f:
+                sources[name] = base64.b64encode(f.read()).decode('utf-8')
+
+        users = []
+        for username in ["first", "second"]:
+            resp = Oia.post(f'/user/create', json={
+                "username": username,
+                "password": "test_pass",
+                "school": "escuela",
+                "email": f"{username}@lala.com",
+                "name": username,
+            }).json()
+            users.append(resp)
+
+        # the events of each user are handled in order by the same worker,
+        # while different users are handled in parallel
+        plans = [
+            ["envido.cpp", "envido_compilation_error.cpp", "envido.cpp"],
+            ["envido_compilation_error.cpp", "envido_compilation_error.cpp"],
+        ]
+        for user, plan in zip(users, plans):
+            Oia.set_access_token(user["token"])
+            for name in plan:
+                Oia.post(f'/submission/create', json={
+                    "task_id": 1,
+                    "user_id": user["user_id"],
+                    "sources": {"envido.%l": sources[name]},
+                }, can_fail=False)
+
+        def all_final():
+            for user, plan in zip(users, plans):
+                submissions = Oia.post('/submissions/get', json={"user_id": user["user_id"], "task_id": 1}).json()["submissions"]
+                if len(submissions) != len(plan):
+                    return False
+                for submission in submissions:
+                    if submission["submission_status"] not in ["scored", "compilation_failed"]:
+                        return False
+            return True
+        utils.wait_for(all_final)
+
+        for user, plan in zip(users, plans):
+            submissions = Oia.post('/submissions/get', json={"user_id": user["user_id"], "task_id": 1}).json()["submissions"]
+            statuses = sorted(submission["submission_status"] for submission in submissions)
+            expected = sorted("scored" if name == "envido.cpp" else "compilation_failed" for name in plan)
+            self.assertEqual(statuses, expected)
+        for user, score in zip(users, [8, 0]):
+            Oia.set_access_token(user["token"])
+            self.assertEqual(Oia.post(f'/user/get', json={"user_id": user["user_id"]}).json()["score"], score)
+
+        stats = Oia.admin_post('/admin/events/stats', json={}).json()
+        self.assertEqual(stats["queue"]["dead"], 0)
+        report = Oia.admin_post('/admin/reconcile', json={"dry_run": True}).json()["report"]
+        self.assertEqual(report["submissions"]["changed"]["count"], 0)
+        self.assertEqual(report["submissions"]["checked"], 5)
+
+    def test_reconcile(self):
+        Database.populate_with_contests(["envido"])
+        Cms.start()
+        Oia.start()
+
+        with open(Config.TASK_PATH / 'envido.cpp', "rb") as f:
+            source = f.read()
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+        sid = Oia.post(f'/submission/create', json={
+            "task_id": 1,
+            "user_id": uid,
+            "sources": {
+                "envido.%l": base64.b64encode(source).decode('utf-8')
+            }
+        }, can_fail=False).json()["submission"]
+
+        def submission_ready():
+            submissions = Oia.post('/submissions/get', json={"user_id": uid, "task_id": 1}).json()["submissions"]
+            return len(submissions) > 0 and submissions[0]["submission_status"] == "scored"
+        utils.wait_for(submission_ready)
+
+        # the judge misses some changes: a stale task, a lost submission and
+        # one that doesn't exist in CMS
+        Database.execute("UPDATE oia_task SET title = 'Desactualizado'")
+        Database.execute("INSERT INTO oia_submissions(id, user_id, task_id, details, subtask_details) SELECT 99999, user_id, task_id, details, subtask_details FROM oia_submissions")
+        Database.execute(f"DELETE FROM oia_submissions WHERE id = {sid}")
+
+        report = Oia.admin_post('/admin/reconcile', json={"dry_run": True}).json()["report"]
+        self.assertTrue(report["dry_run"])
+        self.assertEqual(report["tasks"]["changed"], {"count": 1, "ids": [1]})
+        self.assertEqual(report["submissions"]["missing_in_judge"], {"count": 1, "ids": [sid]})
+        self.assertEqual(report["submissions"]["missing_in_cms"], {"count": 1, "ids": [99999]})
+        self.assertEqual(report["users"]["missing_in_judge"]["count"], 0)
+        self.assertEqual(report["enqueued_events"], 0)
+        # a dry run doesn't fix anything
+        self.assertEqual(Oia.post('/task/get', json={}).json()["tasks"][0]["title"], "Desactualizado")
+
+        report = Oia.admin_post('/admin/reconcile', json={}).json()["report"]
+        self.assertFalse(report["dry_run"])
+        self.assertEqual(report["enqueued_events"], 3)
+        self.assertEqual(Oia.admin_post('/admin/reconcile/last', json={}).json()["report"], report)
+
+        # the enqueued events bring the judge up to date
+        def reconciled():
+            report = Oia.admin_post('/admin/reconcile', json={"dry_run": True}).json()["report"]
+            return report["tasks"]["changed"]["count"] == 0 and report["submissions"]["missing_in_judge"]["count"] == 0
+        utils.wait_for(reconciled)
+        self.assertNotEqual(Oia.post('/task/get', json={}).json()["tasks"][0]["title"], "Desactualizado")
+        single = Oia.post('/submissions/get/single', json={"submission_id": sid}).json()["submission"]
+        self.assertEqual(single["submission_status"], "scored")
+
     def test_submission_frutales(self):
         Database.populate_with_contests(["frutales"])
         Oia.start()
@@ -203,6 +389,13 @@ class OiaTests(unittest.TestCase):
         print(submission)
 
         self.assertEqual(submission["result"]["score"], {"score": 95, "max_score": 100})
+        verdicts = [testcase["verdict"] for testcase in submission["result"]["testcases"]]
+        self.assertIn("ok", verdicts)
+        self.assertTrue(any(verdict != "ok" for verdict in verdicts))
+
+        task = Oia.post('/task/get/single', json={"task_id": 1}).json()["task"]
+        self.assertEqual(task["time_limit"], 0.5)
+        self.assertEqual(task["memory_limit"], 512 * 1024 * 1024)
 
         resp = Oia.post(f'/user/get', json={"user_id": uid}).json()
         # max_score * score_multiplier
@@ -221,11 +414,628 @@ class OiaTests(unittest.TestCase):
         self.assertEqual(task["max_score"], 2)
         self.assertEqual(task["tags"], ['año:2023', 'certamen:selectivo'])
         self.assertEqual(task["submission_format"], ["envido.%l"])
+        self.assertEqual(task["metadata"]["compilation"], "grader")
+        self.assertEqual(task["metadata"]["kits"], [
+            {"language": "cpp", "attachment": "envido-cpp.zip"},
+            {"language": "java", "attachment": "envido-java.zip"},
+        ])
+
+        self.assertEqual(task["statements"], [
+            {"language": "ar", "format": "pdf", "content_type": "application/pdf", "primary": True},
+        ])
 
-        task_statement = Oia.get(f'/task/statement/{task["id"]}').content
+        resp = Oia.get(f'/task/statement/{task["id"]}?lang=en')
+        self.assertEqual(resp.headers["Content-Type"], "application/pdf")
+        self.assertEqual(resp.headers["Content-Language"], "ar")
 
         actual_statement = (Config.TASK_PATH / 'envido' / 'envido.pdf').read_bytes()
-        self.assertEqual(task_statement, actual_statement)
+        self.assertEqual(resp.content, actual_statement)
+
+        resp = Oia.get(f'/task/statement/{task["id"]}?format=markdown')
+        self.assertEqual(resp.status_code, 404)
+
+    def test_markdown_statement(self):
+        Database.populate_with_contests(["envido"])
+        statement = "# Envido\n\nSea $a_i$ el valor.\n\n<script>alert(1)</script>\n\n![figura](figura.png)\n"
+        Database.execute(f"""
+            INSERT INTO fsobjects (digest, loid, description)
+            VALUES ('markdown-statement', lo_from_bytea(0, convert_to('{statement}', 'UTF8')), 'Markdown statement');
+            INSERT INTO statements (task_id, language, digest) VALUES (1, 'es.md', 'markdown-statement');
+            -- Looks like HTML, but the suffix says it is Markdown
+            INSERT INTO fsobjects (digest, loid, description)
+            VALUES ('html-like-statement', lo_from_bytea(0, convert_to('<h1>Envido</h1>', 'UTF8')), 'Markdown statement');
+            INSERT INTO statements (task_id, language, digest) VALUES (1, 'en.md', 'html-like-statement');
+        """)
+        Oia.start()
+
+        def statements_ready():
+            tasks = Oia.post('/task/get', json={}).json()["tasks"]
+            return tasks is not None and len(tasks[0]["statements"]) == 3
+        utils.wait_for(statements_ready)
+        statements = Oia.post('/task/get', json={}).json()["tasks"][0]["statements"]
+        self.assertIn({"language": "en", "format": "markdown", "content_type": "text/markdown; charset=utf-8", "primary": False}, statements)
+
+        resp = Oia.get('/task/statement/1?lang=en&format=markdown')
+        self.assertEqual(resp.status_code, 200)
+        self.assertEqual(resp.headers["Content-Type"], "text/markdown; charset=utf-8")
+        self.assertEqual(resp.headers["Content-Security-Policy"], "sandbox")
+        self.assertEqual(resp.headers["X-Content-Type-Options"], "nosniff")
+
+        resp = Oia.get('/task/statement/1/html?lang=es')
+        self.assertEqual(resp.status_code, 200)
+        self.assertEqual(resp.headers["Content-Language"], "es")
+        self.assertIn('<span class="math inline">\\(a_i\\)</span>', resp.text)
+        self.assertIn('/task/attachment?task_id=1&amp;filename=figura.png', resp.text)
+        self.assertNotIn('<script>', resp.text)
+
+        # The PDF is still the default statement
+        resp = Oia.get('/task/statement/1')
+        self.assertEqual(resp.headers["Content-Type"], "application/pdf")
+
+    def test_task_samples(self):
+        Database.populate_with_contests(["envido"])
+        Database.execute("UPDATE testcases SET public = true WHERE codename = 'E01'")
+        # A sample too big to be sent whole with the task
+        big_input = "1 " * 5000
+        Database.execute(f"""
+            INSERT INTO fsobjects (digest, loid, description)
+            VALUES ('big-sample-input', lo_from_bytea(0, convert_to('{big_input}', 'UTF8')), 'Big sample input');
+            INSERT INTO fsobjects (digest, loid, description)
+            VALUES ('big-sample-output', lo_from_bytea(0, convert_to('2', 'UTF8')), 'Big sample output');
+            INSERT INTO testcases (dataset_id, codename, public, input, output)
+            SELECT active_dataset_id, 'E99', true, 'big-sample-input', 'big-sample-output' FROM tasks WHERE id = 1;
+        """)
+        Oia.start()
+
+        def samples_ready():
+            resp = Oia.post('/task/samples', json={"task_id": 1})
+            return resp.status_code == 200 and len(resp.json()["samples"]) == 2
+        utils.wait_for(samples_ready)
+
+        with zipfile.ZipFile(Config.TASK_PATH / 'envido' / 'casos.zip') as cases:
+            expected_input = cases.read('E01.in')
+
+        sample, big_sample = Oia.post('/task/samples', json={"task_id": 1}).json()["samples"]
+        self.assertEqual(sample["codename"], "E01")
+        self.assertEqual(base64.b64decode(sample["input"]), expected_input)
+        self.assertEqual(sample["input_size"], len(expected_input))
+        self.assertNotIn("input_url", sample)
+
+        # Only the first 4 KiB of the input are sent, with where to download
+        # the whole file
+        self.assertEqual(big_sample["codename"], "E99")
+        self.assertEqual(base64.b64decode(big_sample["input"]), big_input[:4096].encode())
+        self.assertEqual(big_sample["input_size"], len(big_input))
+        self.assertTrue(big_sample["input_url"].endswith('/task/samples/download?task_id=1&codename=E99&file=input'))
+        self.assertEqual(base64.b64decode(big_sample["output"]), b"2")
+        self.assertNotIn("output_url", big_sample)
+
+        task = Oia.post('/task/get/single', json={"task_id": 1}).json()["task"]
+        self.assertEqual(task["samples"], [sample, big_sample])
+
+        resp = Oia.get('/task/samples/download?task_id=1&codename=E01&file=input')
+        self.assertEqual(resp.content, expected_input)
+        resp = Oia.get('/task/samples/download?task_id=1&codename=E99&file=input')
+        self.assertEqual(resp.content, big_input.encode())
+
+        # Only public testcases can be downloaded
+        resp = Oia.get('/task/samples/download?task_id=1&codename=E02&file=input')
+        self.assertEqual(resp.status_code, 404)
+
+    def test_editorial(self):
+        Database.populate_with_contests(["envido"])
+        Oia.start()
+
+        def task_ready():
+            tasks = Oia.post('/task/get', json={}).json()["tasks"]
+            return tasks is not None
+        utils.wait_for(task_ready)
+
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+
+        # There is nothing to give up on yet
+        resp = Oia.post('/task/giveup', json={"user_id": uid, "task_id": 1})
+        self.assertEqual(resp.status_code, 404)
+
+        for content in ["Primera versión", "Se suman los valores $a_i$"]:
+            resp = Oia.admin_post('/admin/editorial/save', json={
+                "task_id": 1,
+                "content": content,
+                "solutions": [{
+                    "language": "cpp",
+                    "filename": "envido.cpp",
+                    "source": base64.b64encode(b"int main() {}").decode('utf-8'),
+                }],
+            })
+            self.assertEqual(resp.status_code, 200)
+        self.assertEqual(resp.json()["version"], 2)
+
+        history = Oia.admin_post('/admin/editorial/history', json={"task_id": 1}).json()["versions"]
+        self.assertEqual([editorial["version"] for editorial in history], [2, 1])
+
+        resp = Oia.post('/task/editorial', json={"user_id": uid, "task_id": 1})
+        self.assertEqual(resp.status_code, 403)
+
+        resp = Oia.post('/task/giveup', json={"user_id": uid, "task_id": 1})
+        self.assertEqual(resp.status_code, 200)
+
+        editorial = Oia.post('/task/editorial', json={"user_id": uid, "task_id": 1}).json()["editorial"]
+        self.assertEqual(editorial["version"], 2)
+        self.assertIn('<span class="math inline">', editorial["html"])
+        self.assertEqual(editorial["solutions"][0]["filename"], "envido.cpp")
+
+        resp = Oia.post('/user/get', json={"user_id": uid}).json()
+        self.assertEqual(resp["gave_up"], [1])
+
+    def test_submission_validation(self):
+        Database.populate_with_contests(["envido"])
+        Oia.start()
+
+        with open(Config.TASK_PATH / 'envido.cpp', "rb") as f:
+            source = f.read()
+
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+
+        def submit(sources):
+            return Oia.post('/submission/create', json={
+                "task_id": 1,
+                "user_id": uid,
+                "sources": {k: base64.b64encode(v).decode('utf-8') for k, v in sources.items()},
+            })
+
+        resp = submit({"solution.py": source})
+        self.assertEqual(resp.status_code, 400)
+        self.assertIn("unexpected file solution.py", resp.text)
+        self.assertIn("missing file envido.%l", resp.text)
+
+        resp = submit({"envido.%l": b"\x00\x01\x02"})
+        self.assertEqual(resp.status_code, 400)
+        self.assertIn("binary", resp.text)
+
+        resp = submit({"envido.%l": source, "envido.cpp": source})
+        self.assertEqual(resp.status_code, 400)
+
+        # Invalid submissions don't count for the cooldown, and the language
+        # extension can be used instead of %l
+        resp = submit({"envido.cpp": source})
+        self.assertEqual(resp.status_code, 200)
+
+    def test_output_only_submission(self):
+        Database.populate_with_contests(["envido"])
+        Database.execute("UPDATE datasets SET task_type = 'OutputOnly', task_type_parameters = '[]'")
+        Database.execute("UPDATE tasks SET submission_format = ARRAY['output_E01.txt', 'output_E02.txt']")
+        Oia.start()
+
+        def task_ready():
+            tasks = Oia.post('/task/get', json={}).json()["tasks"]
+            return tasks is not None
+        utils.wait_for(task_ready)
+        task = Oia.post('/task/get', json={}).json()["tasks"][0]
+        self.assertEqual(task["task_type"], "OutputOnly")
+
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+
+        def submit(outputs):
+            archive = io.BytesIO()
+            with zipfile.ZipFile(archive, 'w') as z:
+                for filename, content in outputs.items():
+                    z.writestr(filename, content)
+            return Oia.post('/submission/create', json={
+                "task_id": 1,
+                "user_id": uid,
+                "outputs": base64.b64encode(archive.getvalue()).decode('utf-8'),
+            })
+
+        resp = submit({"E01.out": b"1\n"})
+        self.assertEqual(resp.status_code, 400)
+        self.assertIn("unexpected file E01.out", resp.text)
+
+        resp = submit({f"extra/{i}.txt": b"" for i in range(1001)})
+        self.assertEqual(resp.status_code, 400)
+        self.assertIn("more than 1000 entries", resp.text)
+
+        resp = Oia.post('/usertest/create', json={
+            "task_id": 1,
+            "user_id": uid,
+            "sources": {"output_E01.txt": base64.b64encode(b"1\n").decode('utf-8')},
+            "input": "",
+        })
+        self.assertEqual(resp.status_code, 400)
+
+        # Outputs may be in a folder, some of them may be missing, and the
+        # metadata added by macOS is skipped
+        resp = submit({
+            "outputs/output_E01.txt": b"1\n",
+            "outputs/.DS_Store": b"\0",
+            "__MACOSX/outputs/._output_E01.txt": b"\0",
+        })
+        self.assertEqual(resp.status_code, 200)
+
+    def test_user_test(self):
+        Database.populate_with_contests(["envido"])
+        Cms.start()
+        Oia.start()
+
+        with open(Config.TASK_PATH / 'envido.cpp', "rb") as f:
+            source = f.read()
+        with zipfile.ZipFile(Config.TASK_PATH / 'envido' / 'casos.zip') as cases:
+            test_input = cases.read('E01.in')
+
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+        sources = {"envido.%l": base64.b64encode(source).decode('utf-8')}
+        resp = Oia.post('/usertest/create', json={
+            "task_id": 1,
+            "user_id": uid,
+            "sources": sources,
+            "input": base64.b64encode(test_input).decode('utf-8'),
+        })
+        self.assertEqual(resp.status_code, 200)
+        test_id = resp.json()["user_test"]
+
+        # User tests have their own cooldown
+        resp = Oia.post('/usertest/create', json={
+            "task_id": 1,
+            "user_id": uid,
+            "sources": sources,
+            "input": base64.b64encode(test_input).decode('utf-8'),
+        })
+        self.assertEqual(resp.status_code, 429)
+        resp = Oia.post('/submission/create', json={"task_id": 1, "user_id": uid, "sources": sources})
+        self.assertEqual(resp.status_code, 200)
+
+        def test_ready():
+            test = Oia.post('/usertest/get', json={"user_id": uid, "user_test_id": test_id}).json()["user_test"]
+            return test["status"] in ["evaluated", "compilation_failed"]
+        utils.wait_for(test_ready)
+
+        test = Oia.post('/usertest/get', json={"user_id": uid, "user_test_id": test_id}).json()["user_test"]
+        # envido is compiled with the grader of the task
+        self.assertEqual(test["status"], "evaluated", test.get("compilation_message"))
+        self.assertGreater(len(base64.b64decode(test["output"])), 0)
+        self.assertFalse(test["output_truncated"])
+
+        # Task types CMS can't test are rejected before reaching it
+        Database.execute("""
+            UPDATE datasets SET task_type = 'TwoSteps', task_type_parameters = '["diff"]';
+            SELECT enqueue_event(1, 'task');
+        """)
+
+        def task_updated():
+            task = Oia.post('/task/get/single', json={"task_id": 1}).json()["task"]
+            return task["task_type"] == "TwoSteps"
+        utils.wait_for(task_updated)
+        resp = Oia.post('/usertest/create', json={
+            "task_id": 1,
+            "user_id": uid,
+            "sources": sources,
+            "input": base64.b64encode(test_input).decode('utf-8'),
+        })
+        self.assertEqual(resp.status_code, 400)
+        self.assertIn("doesn't support user tests", resp.text)
+
+    def test_rejudge(self):
+        Database.populate_with_contests(["envido"])
+        Cms.start()
+        Oia.start()
+
+        with open(Config.TASK_PATH / 'envido.cpp', "rb") as f:
+            source = f.read()
+
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+        resp = Oia.post(f'/submission/create', json={
+            "task_id": 1,
+            "user_id": uid,
+            "sources": {
+                "envido.%l": base64.b64encode(source).decode('utf-8')
+            }
+        })
+        self.assertEqual(resp.status_code, 200)
+
+        def submission_ready():
+            submissions = Oia.post('/submissions/get', json={"user_id": uid, "task_id": 1}).json()["submissions"]
+            return len(submissions) > 0 and submissions[0]["submission_status"] == "scored"
+        utils.wait_for(submission_ready)
+
+        resp = Oia.admin_post('/admin/rejudge/user', json={"user_id": 12345})
+        self.assertEqual(resp.status_code, 404)
+
+        rejudge_id = Oia.admin_post('/admin/rejudge/task', json={"task_id": 1}).json()["rejudge_id"]
+        rejudge = Oia.admin_post('/admin/rejudge/get', json={"rejudge_id": rejudge_id}).json()["rejudge"]
+        self.assertEqual(rejudge["total"], 1)
+
+        def rejudge_finished():
+            return Oia.admin_post('/admin/rejudge/get', json={"rejudge_id": rejudge_id}).json()["rejudge"]["finished"]
+        utils.wait_for(rejudge_finished)
+
+        # The same source gets the same score
+        rejudge = Oia.admin_post('/admin/rejudge/get', json={"rejudge_id": rejudge_id}).json()["rejudge"]
+        self.assertNotIn("score_changes", rejudge)
+        resp = Oia.post(f'/user/get', json={"user_id": uid}).json()
+        self.assertEqual(resp["score"], 8)
+
+    def test_score_types(self):
+        # frutales has 16 testcases, caso001 to caso016
+        with open(Config.TASK_PATH / 'frutales.cpp', "rb") as f:
+            source = f.read()
+        cases = [
+            ("GroupMin", [[40, 5], [60, 11]], 100),
+            ("GroupMul", [[30, ".*00[1-5]"], [70, ".*0(0[6-9]|1)"]], 100),
+            ("GroupThreshold", [[25, 8, 0.5], [25, 8, 1.0]], 50),
+        ]
+        for score_type, parameters, max_score in cases:
+            with self.subTest(score_type=score_type):
+                All.down()
+                Database.populate_with_contests(["frutales"])
+                Database.execute(f"UPDATE datasets SET score_type = '{score_type}', score_type_parameters = '{json.dumps(parameters)}'")
+                Oia.start()
+
+                def task_ready():
+                    tasks = Oia.post('/task/get', json={}).json()["tasks"]
+                    return tasks is not None
+                utils.wait_for(task_ready)
+                task = Oia.post('/task/get', json={}).json()["tasks"][0]
+                self.assertEqual(task["max_score"], max_score)
+
+                Cms.start()
+                resp = Oia.post(f'/user/create', json={
+                    "username": "test_user",
+                    "password": "test_pass",
+                    "school": "escuela",
+                    "email": "lala@lala.com",
+                    "name": "Carlos",
+                }).json()
+                uid = resp["user_id"]
+                Oia.set_access_token(resp["token"])
+                Oia.post(f'/submission/create', json={
+                    "task_id": 1,
+                    "user_id": uid,
+                    "sources": {
+                        "frutales.%l": base64.b64encode(source).decode('utf-8')
+                    }
+                }, can_fail=False)
+
+                def submission_ready():
+                    submissions = Oia.post('/submissions/get', json={"user_id": uid, "task_id": 1}).json()["submissions"]
+                    return len(submissions) > 0 and submissions[0]["submission_status"] == "scored"
+                utils.wait_for(submission_ready)
+                result = Oia.post('/submissions/get', json={"user_id": uid, "task_id": 1}).json()["submissions"][0]["result"]
+                self.assertEqual(result["score"]["max_score"], max_score)
+                self.assertEqual(result["score"]["score"], sum(subtask["score"]["score"] for subtask in result["subtasks"]))
+                self.assertEqual(len(result["testcases"]), 16)
+
+                if score_type == "GroupThreshold":
+                    # The testcases the solution gets right have outcome 1,
+                    # which is above the 0.5 threshold of the first group, so
+                    # that group can't be passed
+                    self.assertEqual(result["subtasks"][0]["score"]["score"], 0)
+                    self.assertLessEqual(result["score"]["score"], 25)
+                    for testcase in result["testcases"]:
+                        self.assertIn(testcase["score"]["score"], [0, 1])
+                        if testcase["verdict"] == "ok":
+                            self.assertEqual(testcase["score"]["score"], 1)
+                        if testcase["verdict"] == "wrong_answer":
+                            self.assertEqual(testcase["score"]["score"], 0)
+                    first_group = [testcase for testcase in result["testcases"] if testcase["testcase"] <= "caso008"]
+                    self.assertTrue(any(testcase["verdict"] == "wrong_answer" for testcase in first_group))
+
+    def test_active_dataset_swap(self):
+        Database.populate_with_contests(["envido"])
+        Cms.start()
+        Oia.start()
+
+        with open(Config.TASK_PATH / 'envido.cpp', "rb") as f:
+            source = f.read()
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+        sid = Oia.post(f'/submission/create', json={
+            "task_id": 1,
+            "user_id": uid,
+            "sources": {
+                "envido.%l": base64.b64encode(source).decode('utf-8')
+            }
+        }, can_fail=False).json()["submission"]
+
+        def submission_score():
+            submission = Oia.post('/submissions/get/single', json={"submission_id": sid}).json()["submission"]
+            if submission["submission_status"] != "scored":
+                return None
+            return submission["result"]["score"]["score"]
+        utils.wait_for(lambda: submission_score() == 2)
+
+        # A copy of the active dataset, already evaluated, but scored with
+        # Sum, becomes the active one. The copy keeps the embedded data of
+        # the task, e.g. the multiplier, in its description
+        Database.execute("""
+            CREATE TEMP TABLE old AS SELECT active_dataset_id AS id FROM tasks WHERE id = 1;
+            CREATE TEMP TABLE ds AS SELECT * FROM datasets WHERE id = (SELECT id FROM old);
+            UPDATE ds SET id = nextval(pg_get_serial_sequence('datasets', 'id')),
+                description = (description::jsonb || '{"copy": true}')::text,
+                score_type = 'Sum', score_type_parameters = '5';
+            INSERT INTO datasets SELECT * FROM ds;
+            INSERT INTO testcases(dataset_id, codename, public, input, output)
+                SELECT ds.id, codename, public, input, output FROM testcases, ds
+                WHERE testcases.dataset_id = (SELECT id FROM old);
+            CREATE TEMP TABLE sr AS SELECT * FROM submission_results WHERE dataset_id = (SELECT id FROM old);
+            UPDATE sr SET dataset_id = (SELECT id FROM ds);
+            INSERT INTO submission_results SELECT * FROM sr;
+            CREATE TEMP TABLE ev AS SELECT * FROM evaluations WHERE dataset_id = (SELECT id FROM old);
+            UPDATE ev SET id = nextval(pg_get_serial_sequence('evaluations', 'id')),
+                dataset_id = (SELECT id FROM ds),
+                testcase_id = (
+                    SELECT copied.id FROM testcases original
+                        INNER JOIN testcases copied ON copied.codename = original.codename
+                    WHERE original.id = ev.testcase_id AND copied.dataset_id = (SELECT id FROM ds));
+            INSERT INTO evaluations SELECT * FROM ev;
+            UPDATE tasks SET active_dataset_id = (SELECT id FROM ds) WHERE id = 1;
+        """)
+
+        def max_score():
+            return Oia.post('/task/get', json={}).json()["tasks"][0]["max_score"]
+        utils.wait_for(lambda: max_score() != 2)
+        self.assertEqual(max_score() % 5, 0)
+        utils.wait_for(lambda: submission_score() == max_score())
+        self.assertEqual(Oia.post(f'/user/get', json={"user_id": uid}).json()["score"], max_score() * 4)
+
+        # and back to the original one
+        Database.execute("UPDATE tasks SET active_dataset_id = (SELECT MIN(id) FROM datasets WHERE task_id = 1) WHERE id = 1")
+        utils.wait_for(lambda: submission_score() == 2)
+        utils.wait_for(lambda: max_score() == 2)
+        self.assertEqual(Oia.post(f'/user/get', json={"user_id": uid}).json()["score"], 8)
+
+    def test_unknown_score_type(self):
+        Database.populate_with_contests(["frutales"])
+        Database.execute("UPDATE datasets SET score_type = 'GroupUnknown'")
+        Oia.start()
+
+        # The task event fails instead of saving a wrong max score
+        def task_failed():
+            stats = Oia.admin_post('/admin/events/stats', json={}).json()
+            return stats["queue"]["retrying"] > 0 or stats["queue"]["dead"] > 0
+        utils.wait_for(task_failed)
+        self.assertIsNone(Oia.post('/task/get', json={}).json()["tasks"])
+
+    def test_dead_events(self):
+        Database.populate_with_contests(["frutales"])
+        Database.execute("UPDATE datasets SET score_type = 'GroupUnknown'")
+        Oia.start(extra_envs={"OIAJ_EVENT_MAX_ATTEMPTS": 1})
+
+        def dead_events():
+            return Oia.admin_post('/admin/events/dead/list', json={}).json()["events"]
+        utils.wait_for(lambda: len(dead_events()) == 1)
+        event = dead_events()[0]
+        self.assertEqual(event["event_type"], "task")
+        self.assertEqual(event["attempts"], 1)
+        self.assertNotEqual(event["last_error"], "")
+        resp = Oia.admin_post('/admin/events/dead/get', json={"id": event["id"]})
+        self.assertEqual(resp.json()["event"], event)
+
+        # a replayed event is handled again, and fails again
+        resp = Oia.admin_post('/admin/events/dead/replay', json={"id": event["id"]})
+        self.assertEqual(resp.status_code, 200)
+        self.assertEqual(Oia.admin_post('/admin/events/dead/get', json={"id": event["id"]}).status_code, 404)
+        utils.wait_for(lambda: len(dead_events()) == 1)
+        replayed = dead_events()[0]
+        self.assertNotEqual(replayed["id"], event["id"])
+        self.assertEqual(replayed["object_id"], event["object_id"])
+
+        resp = Oia.admin_post('/admin/events/dead/discard', json={"id": replayed["id"]})
+        self.assertEqual(resp.status_code, 200)
+        self.assertEqual(dead_events(), [])
+        resp = Oia.admin_post('/admin/events/dead/discard', json={"id": replayed["id"]})
+        self.assertEqual(resp.status_code, 404)
+        resp = Oia.admin_post('/admin/events/dead/replay', json={"id": replayed["id"]})
+        self.assertEqual(resp.status_code, 404)
+
+    def test_event_lease_renewal(self):
+        Database.populate_with_contests(["envido"])
+        Oia.start(extra_envs={"OIAJ_EVENT_LEASE_MS": 300, "OIAJ_EVENT_BATCH_SIZE": 1000})
+        utils.wait_for(lambda: Oia.post('/task/get', json={}).json()["tasks"] is not None)
+
+        # Events of unknown submissions are handled one at a time, so most of
+        # the batch waits for longer than the lease
+        Database.execute("SELECT enqueue_event(i, 'submission') FROM generate_series(100000, 102000) i")
+        time.sleep(1)
+        expired = Database.query("SELECT COUNT(*) FROM event_queue WHERE claimed_by IS NOT NULL AND claimed_until < now()")
+        self.assertEqual(expired, "0")
+
+        def queue_empty():
+            return Oia.admin_post('/admin/events/stats', json={}).json()["queue"]["pending"] == 0
+        utils.wait_for(queue_empty)
+        stats = Oia.admin_post('/admin/events/stats', json={}).json()
+        self.assertEqual(stats["queue"]["retrying"], 0)
+        self.assertEqual(stats["queue"]["dead"], 0)
+
+    def test_event_listener_reconnect(self):
+        Database.populate_with_contests(["envido"])
+        # The server uses its own role, so the database can refuse its
+        # connections without locking out the tests
+        Database.execute("""DO $$ BEGIN
+            IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'oia_listener') THEN
+                CREATE ROLE oia_listener SUPERUSER PASSWORD 'oia_listener';
+            END IF;
+        END $$""")
+        Database.execute("ALTER ROLE oia_listener LOGIN")
+        Oia.start(extra_envs={
+            "OIAJ_DB_CONNECTION_STRING": "postgresql://oia_listener:oia_listener@db:5432/postgres",
+            # only notifications can bring new events
+            "OIAJ_EVENT_POLL_INTERVAL_MS": 60 * 60 * 1000,
+        })
+        utils.wait_for(lambda: Oia.get('/health').status_code == 200)
+        health = Oia.get('/health').json()
+        self.assertEqual(health["status"], "ok")
+        self.assertEqual(health["event_listener"]["reconnects"], 0)
+        utils.wait_for(lambda: Oia.post('/task/get', json={}).json()["tasks"] is not None)
+
+        # while the connection is down the server is unhealthy
+        Database.execute("ALTER ROLE oia_listener NOLOGIN")
+        Database.execute("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = 'oia_listener'")
+        utils.wait_for(lambda: Oia.get('/health').status_code == 503)
+        health = Oia.get('/health').json()
+        self.assertEqual(health["status"], "unavailable")
+        self.assertEqual(health["event_listener"]["state"], "connecting")
+        self.assertFalse(health["event_listener"]["listening"])
+        self.assertNotEqual(health["event_listener"]["last_error"], "")
+
+        Database.execute("ALTER ROLE oia_listener LOGIN")
+        utils.wait_for(lambda: Oia.get('/health').status_code == 200)
+        health = Oia.get('/health').json()
+        self.assertTrue(health["event_listener"]["listening"])
+        self.assertEqual(health["event_listener"]["reconnects"], 1)
+
+        # notifications arrive again after reconnecting
+        Database.execute("UPDATE tasks SET title = 'Envido reconectado'")
+
+        def task_updated():
+            tasks = Oia.post('/task/get', json={}).json()["tasks"]
+            return tasks[0]["title"] == "Envido reconectado"
+        utils.wait_for(task_updated)
 
     def test_submission_envido_compilation_error(self):
         Database.populate_with_contests(["envido"])
@@ -261,3 +1071,441 @@ class OiaTests(unittest.TestCase):
 
         submission = Oia.post('/submissions/get', json={"user_id": uid, "task_id": 1}).json()["submissions"][0]
         self.assertIn('envido.cpp:6:1: error:', submission['compilation_message'])
+
+    def test_recommendations(self):
+        Database.populate_with_contests(["envido", "frutales"])
+        Oia.start()
+
+        def tasks_ready():
+            tasks = Oia.post('/task/get', json={}).json()["tasks"]
+            return tasks is not None and len(tasks) == 2
+        utils.wait_for(tasks_ready)
+
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+
+        recommendations = Oia.post('/user/recommendations', json={"user_id": uid}).json()["recommendations"]
+        # frutales trains topics the user hasn't touched, envido has no topics
+        self.assertEqual([r["task"]["name"] for r in recommendations], ["frutales", "envido"])
+        self.assertEqual(recommendations[0]["components"]["topic_weakness"], 1)
+        self.assertEqual(recommendations[1]["components"]["topic_weakness"], 0)
+
+        recommendations = Oia.post('/user/recommendations', json={"user_id": uid, "limit": 1}).json()["recommendations"]
+        self.assertEqual(len(recommendations), 1)
+
+    def test_problem_lists(self):
+        Database.populate_with_contests(["envido", "frutales"])
+        Oia.start()
+
+        def tasks_ready():
+            tasks = Oia.post('/task/get', json={}).json()["tasks"]
+            return tasks is not None and len(tasks) == 2
+        utils.wait_for(tasks_ready)
+
+        # admin APIs need the admin token
+        resp = Oia.post('/admin/lists/create', json={"list": {"title": "Basics", "tasks": [1]}})
+        self.assertEqual(resp.status_code, 400)
+
+        basics = Oia.admin_post('/admin/lists/create', json={
+            "list": {"title": "Basics", "description": "Start here", "tasks": [1]}
+        }).json()["list_id"]
+        advanced = Oia.admin_post('/admin/lists/create', json={
+            "list": {"title": "Advanced", "tasks": [2, 1], "prerequisites": [basics]}
+        }).json()["list_id"]
+
+        # unknown tasks and cycles are rejected
+        resp = Oia.admin_post('/admin/lists/create', json={"list": {"title": "Bad", "tasks": [42]}})
+        self.assertEqual(resp.status_code, 400)
+        resp = Oia.admin_post('/admin/lists/update', json={
+            "list": {"id": basics, "title": "Basics", "tasks": [1], "prerequisites": [advanced]}
+        })
+        self.assertEqual(resp.status_code, 400)
+
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+        progress = Oia.post('/lists/progress', json={"user_id": uid}).json()["progress"]
+        self.assertEqual([(p["list_id"], p["solved"], p["total"], p["unlocked"]) for p in progress],
+                         [(basics, 0, 1, True), (advanced, 0, 2, False)])
+
+        exported = Oia.admin_post('/admin/lists/export', json={}).json()
+        Oia.admin_post('/admin/lists/delete', json={"list_id": basics})
+        self.assertEqual(len(Oia.post('/lists/get', json={}).json()["lists"]), 1)
+        resp = Oia.admin_post('/admin/lists/import', json={**exported, "replace": True})
+        self.assertEqual(resp.json()["imported"], 2)
+        self.assertEqual(Oia.post('/lists/get', json={}).json(), exported)
+
+    def test_task_delete_restore(self):
+        Database.populate_with_contests(["envido"])
+        Cms.start()
+        Oia.start()
+
+        with open(Config.TASK_PATH / 'envido.cpp', "rb") as f:
+            source = f.read()
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+        Oia.post(f'/submission/create', json={
+            "task_id": 1,
+            "user_id": uid,
+            "sources": {
+                "envido.%l": base64.b64encode(source).decode('utf-8')
+            }
+        }, can_fail=False)
+
+        def user_score():
+            return Database.query(f"SELECT score FROM oia_user WHERE id = {uid}")
+        utils.wait_for(lambda: user_score() == "8")
+        basics = Oia.admin_post('/admin/lists/create', json={
+            "list": {"title": "Basics", "tasks": [1]}
+        }).json()["list_id"]
+
+        # Moving the task away without firing triggers or cascades looks like
+        # a deletion to the bridge, and moving it back like a restore
+        def move_task(from_id, to_id):
+            Database.execute(f"SET session_replication_role = replica; UPDATE tasks SET id = {to_id} WHERE id = {from_id}")
+            Database.execute("SELECT enqueue_event(1, 'task')")
+
+        move_task(1, 1000)
+        utils.wait_for(lambda: user_score() == "0")
+        self.assertIsNone(Oia.post('/task/get', json={}).json()["tasks"])
+        # lists with deleted tasks can still be changed, and the deleted
+        # tasks aren't shown in the progress
+        resp = Oia.admin_post('/admin/lists/update', json={
+            "list": {"id": basics, "title": "Basics again", "tasks": [1]}
+        })
+        self.assertEqual(resp.status_code, 200)
+        progress = Oia.post('/lists/progress', json={"user_id": uid}).json()["progress"]
+        self.assertEqual([(p["solved"], p["total"], p["tasks"]) for p in progress], [(0, 0, [])])
+
+        move_task(1000, 1)
+        utils.wait_for(lambda: user_score() == "8")
+        self.assertEqual(len(Oia.post('/task/get', json={}).json()["tasks"]), 1)
+        progress = Oia.post('/lists/progress', json={"user_id": uid}).json()["progress"]
+        self.assertEqual([(p["solved"], p["total"]) for p in progress], [(1, 1)])
+
+    def test_groups(self):
+        Database.populate_with_contests(["envido"])
+        Cms.start()
+        Oia.start()
+
+        def create_user(username):
+            return Oia.post(f'/user/create', json={
+                "username": username,
+                "password": "test_pass",
+                "school": "escuela",
+                "email": f"{username}@lala.com",
+                "name": username,
+            }).json()
+
+        teacher = create_user("teacher")
+        student = create_user("student")
+
+        Oia.set_access_token(teacher["token"])
+        group = Oia.post('/group/create', json={"user_id": teacher["user_id"], "name": "Clase"}).json()
+        resp = Oia.post('/group/assignment/create', json={
+            "user_id": teacher["user_id"],
+            "group_id": group["group_id"],
+            "assignment": {"title": "Tarea 1", "tasks": [1], "deadline": "2030-01-01T00:00:00Z"},
+        })
+        self.assertEqual(resp.status_code, 200)
+
+        Oia.set_access_token(student["token"])
+        resp = Oia.post('/group/join', json={"user_id": student["user_id"], "invite_code": group["invite_code"]})
+        self.assertEqual(resp.json()["group_id"], group["group_id"])
+        groups = Oia.post('/group/get', json={"user_id": student["user_id"]}).json()
+        self.assertEqual(groups["joined"][0]["assignments"][0]["tasks"], [1])
+        self.assertNotIn("invite_code", groups["joined"][0])
+
+        # only the owner can see the dashboard
+        resp = Oia.post('/group/dashboard', json={"user_id": student["user_id"], "group_id": group["group_id"]})
+        self.assertEqual(resp.status_code, 403)
+
+        with open(Config.TASK_PATH / 'envido.cpp', "rb") as f:
+            source = f.read()
+        Oia.post(f'/submission/create', json={
+            "task_id": 1,
+            "user_id": student["user_id"],
+            "sources": {
+                "envido.%l": base64.b64encode(source).decode('utf-8')
+            }
+        }, can_fail=False)
+
+        Oia.set_access_token(teacher["token"])
+
+        def dashboard_ready():
+            dashboard = Oia.post('/group/dashboard', json={
+                "user_id": teacher["user_id"],
+                "group_id": group["group_id"],
+            }).json()["dashboard"]
+            return dashboard["members"][0]["cells"][0]["score"] == 2
+
+        utils.wait_for(dashboard_ready)
+        dashboard = Oia.post('/group/dashboard', json={
+            "user_id": teacher["user_id"],
+            "group_id": group["group_id"],
+        }).json()["dashboard"]
+        self.assertEqual(dashboard["tasks"], [1])
+        self.assertEqual(dashboard["members"][0]["username"], "student")
+        self.assertEqual(dashboard["members"][0]["cells"][0]["submissions"], 1)
+        self.assertIsNotNone(dashboard["members"][0]["last_activity"])
+
+        resp = Oia.get('/group/dashboard/csv', params={"user_id": teacher["user_id"], "group_id": group["group_id"]})
+        self.assertEqual(resp.status_code, 200)
+        lines = resp.text.splitlines()
+        self.assertEqual(lines[0], "username,last_activity,envido score,envido submissions,envido last_submission,envido late_score,envido late_submissions")
+        self.assertTrue(lines[1].startswith("student,"))
+
+        # submissions after the deadline are shown apart
+        Database.execute("UPDATE oia_group_assignment SET deadline = '2000-01-01T00:00:00Z'")
+        dashboard = Oia.post('/group/dashboard', json={
+            "user_id": teacher["user_id"],
+            "group_id": group["group_id"],
+        }).json()["dashboard"]
+        self.assertTrue(dashboard["deadlines"][0].startswith("2000-01-01"))
+        cell = dashboard["members"][0]["cells"][0]
+        self.assertEqual(cell["score"], 0)
+        self.assertEqual(cell["submissions"], 0)
+        self.assertIsNone(cell["last_submission"])
+        self.assertEqual(cell["late_score"], 2)
+        self.assertEqual(cell["late_submissions"], 1)
+
+    def test_virtual_contest(self):
+        Database.populate_with_contests(["envido"])
+        Cms.start()
+        Oia.start(extra_envs={"OIAJ_SUBMISSION_COOLDOWN_MS": 0})
+
+        resp = Oia.post(f'/user/create', json={
+            "username": "test_user",
+            "password": "test_pass",
+            "school": "escuela",
+            "email": "lala@lala.com",
+            "name": "Carlos",
+        }).json()
+        uid = resp["user_id"]
+        Oia.set_access_token(resp["token"])
+
+        Oia.admin_post('/admin/historic/import', json={
+            "year": "2023",
+            "certamen": "selectivo",
+            "results": [
+                {"contestant": "A", "task_scores": {"envido": 2}},
+                {"contestant": "B", "task_scores": {"envido": 1}},
+                {"contestant": "C", "task_scores": {"envido": 0}},
+            ],
+        })
+
+        resp = Oia.admin_post('/admin/historic/import', json={
+            "year": "2023",
+            "certamen": "selectivo",
+            "results": [
+                {"contestant": "A", "task_scores": {"envido": 2}},
+                {"contestant": "A", "task_scores": {"envido": 1}},
+            ],
+        })
+        self.assertEqual(resp.status_code, 400)
+
+        with open(Config.TASK_PATH / 'envido.cpp', "rb") as f:
+            source = f.read()
+
+        def submit():
+            return Oia.post(f'/submission/create', json={
+                "task_id": 1,
+                "user_id": uid,
+                "sources": {
+                    "envido.%l": base64.b64encode(source).decode('utf-8')
+                }
+            }, can_fail=False).json()["submission"]
+
+        Oia.post(f'/mock/time/set', json={"time": "2000-01-01T00:00:00Z"}, can_fail=False)
+        contest = Oia.post('/virtual/start', json={
+            "user_id": uid,
+            "year": "2023",
+            "certamen": "Selectivo",
+            "duration_minutes": 60,
+        }).json()["contest"]
+        self.assertEqual(contest["name"], "2023/selectivo")
+        self.assertEqual(contest["tasks"], [1])
+
+        # only one virtual contest at a time
+        resp = Oia.post('/virtual/start', json={"user_id": uid, "year": "2023", "certamen": "selectivo"})
+        self.assertEqual(resp.status_code, 409)
+
+        Oia.post(f'/mock/time/set', json={"time": "2000-01-01T00:30:00Z"}, can_fail=False)
+        submit()
+
+        def contest_scored():
+            result = Oia.post('/virtual/get', json={"user_id": uid, "contest_id": contest["id"]}).json()["result"]
+            return result["tasks"][0]["pending"] == 0
+
+        utils.wait_for(contest_scored)
+        result = Oia.post('/virtual/get', json={"user_id": uid, "contest_id": contest["id"]}).json()["result"]
+        self.assertTrue(result["running"])
+        self.assertFalse(result["tasks"][0]["gave_up"])
+
+        # the editorial is locked while the virtual contest runs
+        resp = Oia.admin_post('/admin/editorial/save', json={"task_id": 1, "content": "Se suman los valores", "solutions": []})
+        self.assertEqual(resp.status_code, 200)
+        self.assertEqual(Oia.post('/task/giveup', json={"user_id": uid, "task_id": 1}).status_code, 403)
+        self.assertEqual(Oia.post('/task/editorial', json={"user_id": uid, "task_id": 1}).status_code, 403)
+        self.assertEqual(result["total"], 2)
+        self.assertEqual(result["tasks"][0]["submissions"], 1)
+        self.assertEqual(result["historic"], {"rank": 1, "contestants": 3})
+
+        # submissions after the end don't count
+        Oia.post(f'/mock/time/set', json={"time": "2000-01-01T01:30:00Z"}, can_fail=False)
+        submit()
+        result = Oia.post('/virtual/get', json={"user_id": uid, "contest_id": contest["id"]}).json()["result"]
+        self.assertFalse(result["running"])
+        self.assertEqual(result["tasks"][0]["submissions"], 1)
+        self.assertEqual(Oia.post('/task/editorial', json={"user_id": uid, "task_id": 1}).status_code, 200)
+
+        scoreboard = Oia.post('/virtual/scoreboard', json={"year": "2023", "certamen": "selectivo"}).json()
+        self.assertEqual([e["username"] for e in scoreboard["virtual"]], ["test_user"])
+        self.assertEqual([h["contestant"] for h in scoreboard["historic"]], ["A", "B", "C"])
+
+    def test_live_contest(self):
+        Database.populate_with_contests(["envido"])
+        Cms.start()
+        Oia.start(extra_envs={"OIAJ_SUBMISSION_COOLDOWN_MS": 0})
+
+        def create_user(username):
+            return Oia.post(f'/user/create', json={
+                "username": username,
+                "password": "test_pass",
+                "school": "escuela",
+                "email": f"{username}@lala.com",
+                "name": username,
+            }).json()
+
+        participant = create_user("participant")
+        outsider = create_user("outsider")
+        quitter = create_user("quitter")
+        latecomer = create_user("latecomer")
+
+        contest_id = Oia.admin_post('/admin/contest/save', json={"contest": {
+            "name": "Selectivo",
+            "tasks": [1],
+            "start_time": "2000-01-01T10:00:00Z",
+            "end_time": "2000-01-01T15:00:00Z",
+            "freeze_time": "2000-01-01T14:00:00Z",
+        }}).json()["contest_id"]
+        Oia.admin_post('/admin/contest/participants', json={"contest_id": contest_id, "add": [participant["user_id"], quitter["user_id"], latecomer["user_id"]]})
+
+        def task_ready():
+            tasks = Oia.post('/task/get', json={}).json()["tasks"]
+            return tasks is not None
+        utils.wait_for(task_ready)
+        resp = Oia.admin_post('/admin/editorial/save', json={"task_id": 1, "content": "Se suman los valores", "solutions": []})
+        self.assertEqual(resp.status_code, 200)
+
+        with open(Config.TASK_PATH / 'envido.cpp', "rb") as f:
+            source = f.read()
+
+        def submit(user):
+            Oia.set_access_token(user["token"])
+            return Oia.post(f'/submission/create', json={
+                "task_id": 1,
+                "user_id": user["user_id"],
+                "sources": {
+                    "envido.%l": base64.b64encode(source).decode('utf-8')
+                }
+            })
+
+        # before the contest nobody can submit or see the task
+        Oia.post(f'/mock/time/set', json={"time": "2000-01-01T09:00:00Z"}, can_fail=False)
+        self.assertEqual(submit(participant).status_code, 403)
+        tasks = Oia.post('/task/get', json={}).json()["tasks"] or []
+        self.assertNotIn(1, [task["id"] for task in tasks])
+        self.assertEqual(Oia.post('/task/get/single', json={"task_id": 1}).status_code, 403)
+        self.assertEqual(Oia.post('/task/samples', json={"task_id": 1}).status_code, 403)
+        self.assertEqual(Oia.get('/task/statement/1').status_code, 403)
+
+        # nor see the editorial, until the contest ends
+        for now in ["2000-01-01T09:00:00Z", "2000-01-01T11:00:00Z"]:
+            Oia.post(f'/mock/time/set', json={"time": now}, can_fail=False)
+            Oia.set_access_token(quitter["token"])
+            self.assertEqual(Oia.post('/task/giveup', json={"user_id": quitter["user_id"], "task_id": 1}).status_code, 403)
+            self.assertEqual(Oia.post('/task/editorial', json={"user_id": quitter["user_id"], "task_id": 1}).status_code, 403)
+
+        # during the contest only participants can submit
+        Oia.post(f'/mock/time/set', json={"time": "2000-01-01T11:00:00Z"}, can_fail=False)
+        self.assertEqual(submit(outsider).status_code, 403)
+        self.assertEqual(submit(participant).status_code, 200)
+
+        def scored():
+            scoreboard = Oia.post('/contest/scoreboard', json={"contest_id": contest_id}).json()["scoreboard"]
+            return all(e["tasks"][0]["pending"] == 0 for e in scoreboard["entries"])
+        utils.wait_for(scored)
+
+        def entry(scoreboard, username):
+            return [e for e in scoreboard["entries"] if e["username"] == username][0]
+
+        # submissions during the freeze are hidden until the end
+        Oia.post(f'/mock/time/set', json={"time": "2000-01-01T14:30:00Z"}, can_fail=False)
+        self.assertEqual(submit(participant).status_code, 200)
+        self.assertEqual(submit(latecomer).status_code, 200)
+        scoreboard = Oia.post('/contest/scoreboard', json={"contest_id": contest_id}).json()["scoreboard"]
+        self.assertTrue(scoreboard["frozen"])
+        self.assertEqual(entry(scoreboard, "participant")["total"], 2)
+        self.assertEqual(entry(scoreboard, "participant")["tasks"][0]["submissions"], 1)
+        self.assertEqual(entry(scoreboard, "participant")["hidden"], 1)
+
+        scoreboard = Oia.admin_post('/admin/contest/scoreboard', json={"contest_id": contest_id}).json()["scoreboard"]
+        self.assertFalse(scoreboard["frozen"])
+        self.assertEqual(entry(scoreboard, "participant")["tasks"][0]["submissions"], 2)
+
+        # the results hidden from the scoreboard aren't shown anywhere else
+        def all_scored():
+            scoreboard = Oia.admin_post('/admin/contest/scoreboard', json={"contest_id": contest_id}).json()["scoreboard"]
+            return all(e["tasks"][0]["pending"] == 0 for e in scoreboard["entries"])
+        utils.wait_for(all_scored)
+        Oia.set_access_token(participant["token"])
+        submissions = Oia.post('/submissions/get', json={"task_id": 1, "user_id": participant["user_id"]}).json()["submissions"]
+        statuses = sorted(submission["submission_status"] for submission in submissions)
+        self.assertEqual(statuses, ["evaluating", "scored"])
+        hidden = [submission for submission in submissions if submission["submission_status"] == "evaluating"][0]
+        self.assertIsNone(hidden["result"])
+        resp = Oia.post('/submissions/get/single', json={"submission_id": hidden["id"]}).json()
+        self.assertIsNone(resp["submission"]["result"])
+        self.assertNotIn("progress", resp["submission"])
+        # the only submission of the latecomer is frozen, so it doesn't count
+        # in their score yet
+        Oia.set_access_token(latecomer["token"])
+        self.assertEqual(Oia.post('/user/get', json={"user_id": latecomer["user_id"]}).json()["score"], 0)
+
+        Oia.post(f'/mock/time/set', json={"time": "2000-01-01T16:00:00Z"}, can_fail=False)
+        scoreboard = Oia.post('/contest/scoreboard', json={"contest_id": contest_id}).json()["scoreboard"]
+        self.assertFalse(scoreboard["frozen"])
+        self.assertEqual(entry(scoreboard, "participant")["tasks"][0]["submissions"], 2)
+        self.assertEqual(Oia.post('/user/get', json={"user_id": latecomer["user_id"]}).json()["score"], 8)
+
+        # giving up after the contest is shown in the scoreboard
+        Oia.set_access_token(quitter["token"])
+        self.assertEqual(Oia.post('/task/giveup', json={"user_id": quitter["user_id"], "task_id": 1}).status_code, 200)
+        self.assertEqual(Oia.post('/task/editorial', json={"user_id": quitter["user_id"], "task_id": 1}).status_code, 200)
+        scoreboard = Oia.post('/contest/scoreboard', json={"contest_id": contest_id}).json()["scoreboard"]
+        gave_up = {entry["username"]: entry["tasks"][0]["gave_up"] for entry in scoreboard["entries"]}
+        self.assertEqual(gave_up, {"participant": False, "quitter": True, "latecomer": False})
+
+        # after the contest the task is back in the archive
+        self.assertEqual(submit(outsider).status_code, 200)
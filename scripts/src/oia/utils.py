@@ -12,6 +12,11 @@ def run(command, env=None, cwd=None):
     subprocess.run(["bash", "-c", command], env=env, cwd=cwd)
 
 
+def output(command, env=None, cwd=None):
+    print("RUNNING: " + command)
+    return subprocess.run(["bash", "-c", command], env=env, cwd=cwd, capture_output=True, text=True).stdout
+
+
 def clear_screens():
     run("kilall screen")
     run("screen -wipe")